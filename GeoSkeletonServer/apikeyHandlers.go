@@ -0,0 +1,191 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// getOwnApikey returns the apikey record matching the key id if it belongs to the customer
+func getOwnApikey(customer Customer, key_id string) (ApiKey, error) {
+	key, err := DB.GetApikeyById(key_id)
+	if nil != err {
+		return ApiKey{}, err
+	}
+	if customer.Id != key.Customer {
+		return ApiKey{}, fmt.Errorf(`Unauthorized`)
+	}
+	return key, nil
+}
+
+// ViewApikeysHandler lists the customer's apikeys without their secrets.
+// @param apikey
+// @return json
+func ViewApikeysHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		customer, err := job.GetCustomer()
+		if nil != err {
+			return []byte{}, err
+		}
+		keys, err := DB.GetCustomerApikeys(customer.Id)
+		if nil != err {
+			return []byte{}, err
+		}
+		for i := range keys {
+			keys[i] = keys[i].public()
+		}
+		data := HttpMessageResponse{Status: "success", Data: keys}
+		js := job.MarshalJsonFromStruct(data)
+		return js, err
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
+
+// NewApikeyHandler creates an additional apikey for the customer.
+// The secret is only returned in this response.
+// @param apikey
+// @body {"label": "", "expires": 0}
+// @return json
+func NewApikeyHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		customer, err := job.GetCustomer()
+		if nil != err {
+			return []byte{}, err
+		}
+		body, err := job.GetRequestBody()
+		if nil != err {
+			return []byte{}, err
+		}
+		req := ApikeyRequest{}
+		if 0 != len(body) {
+			err = json.Unmarshal(body, &req)
+			if nil != err {
+				return []byte{}, err
+			}
+		}
+		key, err := DB.CreateApikey(customer.Id, req.Label, expiresAt(req.Expires))
+		if nil != err {
+			return []byte{}, err
+		}
+		data := HttpMessageResponse{Status: "success", Apikey: key.Apikey, Data: key.public()}
+		js := job.MarshalJsonFromStruct(data)
+		return js, err
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
+
+// RotateApikeyHandler replaces an apikey. The old apikey keeps working for the grace period.
+// @param key
+// @param apikey
+// @body {"grace_period": 3600}
+// @return json
+func RotateApikeyHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		customer, err := job.GetCustomer()
+		if nil != err {
+			return []byte{}, err
+		}
+		key_id, err := job.GetKeyId()
+		if nil != err {
+			return []byte{}, err
+		}
+		key, err := getOwnApikey(customer, key_id)
+		if nil != err {
+			return []byte{}, err
+		}
+		body, err := job.GetRequestBody()
+		if nil != err {
+			return []byte{}, err
+		}
+		req := ApikeyRequest{}
+		if 0 != len(body) {
+			err = json.Unmarshal(body, &req)
+			if nil != err {
+				return []byte{}, err
+			}
+		}
+		rotated, err := DB.RotateApikey(key, time.Duration(req.GracePeriod)*time.Second)
+		if nil != err {
+			return []byte{}, err
+		}
+		data := HttpMessageResponse{Status: "success", Apikey: rotated.Apikey, Data: rotated.public()}
+		js := job.MarshalJsonFromStruct(data)
+		return js, err
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
+
+// RevokeApikeyHandler immediately disables an apikey.
+// @param key
+// @param apikey
+// @return json
+func RevokeApikeyHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		customer, err := job.GetCustomer()
+		if nil != err {
+			return []byte{}, err
+		}
+		key_id, err := job.GetKeyId()
+		if nil != err {
+			return []byte{}, err
+		}
+		key, err := getOwnApikey(customer, key_id)
+		if nil != err {
+			return []byte{}, err
+		}
+		key, err = DB.RevokeApikey(key)
+		if nil != err {
+			return []byte{}, err
+		}
+		data := HttpMessageResponse{Status: "success", Data: key.public()}
+		js := job.MarshalJsonFromStruct(data)
+		return js, err
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
+
+// ViewUsageHandler returns the customer's storage usage, quota and rate limit.
+// @param apikey
+// @return json
+func ViewUsageHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		customer, err := job.GetCustomer()
+		if nil != err {
+			return []byte{}, err
+		}
+		report, err := GetUsageReport(customer)
+		if nil != err {
+			return []byte{}, err
+		}
+		data := HttpMessageResponse{Status: "success", Data: report}
+		js := job.MarshalJsonFromStruct(data)
+		return js, err
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
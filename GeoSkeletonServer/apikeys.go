@@ -0,0 +1,600 @@
+package geo_skeleton_server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"./utils"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// APIKEY_TOUCH_INTERVAL limits how often the last used time of a key is saved
+	APIKEY_TOUCH_INTERVAL = time.Minute
+	// APIKEY_LENGTH length of generated apikeys
+	APIKEY_LENGTH = 24
+	// APIKEY_PREFIX_LENGTH length of the public apikey prefix used for lookups
+	APIKEY_PREFIX_LENGTH = 4
+)
+
+// ApiKey structure for database. Customers can hold several apikeys.
+// Only a salted hash of the apikey is stored, the apikey itself is
+// only set on newly created keys and is never written to the database.
+type ApiKey struct {
+	Id       string     `json:"id"`
+	Prefix   string     `json:"prefix"`
+	Salt     string     `json:"salt,omitempty"`
+	Hash     string     `json:"hash,omitempty"`
+	Apikey   string     `json:"apikey,omitempty"`
+	Customer string     `json:"customer"`
+	Label    string     `json:"label"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	Revoked  *time.Time `json:"revoked,omitempty"`
+}
+
+// isActive checks if the apikey is neither revoked nor expired
+func (self ApiKey) isActive(now time.Time) bool {
+	if nil != self.Revoked {
+		return false
+	}
+	return nil == self.Expires || now.Before(*self.Expires)
+}
+
+// matches checks an apikey against the stored hash
+func (self ApiKey) matches(apikey string) bool {
+	if "" == self.Hash || apikeyPrefix(apikey) != self.Prefix {
+		return false
+	}
+	return 1 == subtle.ConstantTimeCompare([]byte(self.Hash), []byte(hashApikey(self.Salt, apikey)))
+}
+
+// public returns a copy of the apikey without the salt and hash
+func (self ApiKey) public() ApiKey {
+	self.Salt = ""
+	self.Hash = ""
+	return self
+}
+
+// apikeyPrefix returns the public part of an apikey
+func apikeyPrefix(apikey string) string {
+	if len(apikey) < APIKEY_PREFIX_LENGTH {
+		return apikey
+	}
+	return apikey[:APIKEY_PREFIX_LENGTH]
+}
+
+// hashApikey returns the hex encoded sha256 of the salted apikey
+func hashApikey(salt string, apikey string) string {
+	sum := sha256.Sum256([]byte(salt + apikey))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSalt returns a random hex encoded salt
+func newSalt() string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return hex.EncodeToString(salt)
+}
+
+// expiresAt converts a unix timestamp to an apikey expiry. Zero never expires.
+func expiresAt(ts int64) *time.Time {
+	if 0 == ts {
+		return nil
+	}
+	expires := time.Unix(ts, 0).UTC()
+	return &expires
+}
+
+// newApikey creates an apikey record for a customer.
+// The returned record holds the apikey so it can be shown once.
+func newApikey(apikey string, customer string, label string, expires *time.Time) ApiKey {
+	id, _ := utils.NewUUID()
+	salt := newSalt()
+	return ApiKey{
+		Id:       id,
+		Prefix:   apikeyPrefix(apikey),
+		Salt:     salt,
+		Hash:     hashApikey(salt, apikey),
+		Apikey:   apikey,
+		Customer: customer,
+		Label:    label,
+		Created:  time.Now().UTC(),
+		Expires:  expires,
+	}
+}
+
+// InsertApikey inserts apikey into keys table. The apikey itself is not stored.
+// @param key {ApiKey}
+// @returns Error
+func (self *Database) InsertApikey(key ApiKey) error {
+	if "" == key.Hash {
+		return fmt.Errorf("Apikey hash missing")
+	}
+	key.Apikey = ""
+	value, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	// index before saving so every saved apikey can be found
+	err = self.indexApikeys(key)
+	if err != nil {
+		return err
+	}
+	self.commit(`{"method": "insert_key", "data":` + string(value) + `}`)
+	return self.DB.Insert("keys", key.Id, value)
+}
+
+// apikeyIndexKey returns the prefix index entry of an apikey record
+func apikeyIndexKey(key ApiKey) string {
+	return key.Prefix + "/" + key.Id
+}
+
+// indexApikeys adds apikey records to the prefix index used for lookups.
+// Entries of deleted apikeys are skipped by lookups.
+func (self *Database) indexApikeys(keys ...ApiKey) error {
+	conn := self.DB.Connect()
+	defer conn.Close()
+	return conn.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("key_prefixes"))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if "" == key.Hash {
+				continue
+			}
+			err = bucket.Put([]byte(apikeyIndexKey(key)), []byte(key.Id))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// getApikeyCandidates returns the ids of apikey records sharing the prefix of an apikey
+func (self *Database) getApikeyCandidates(apikey string) ([]string, error) {
+	prefix := []byte(apikeyPrefix(apikey) + "/")
+	ids := []string{}
+	conn := self.DB.Connect()
+	defer conn.Close()
+	err := conn.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("key_prefixes"))
+		if nil == bucket {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek(prefix); nil != k && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			ids = append(ids, string(v))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// ReindexApikeys rebuilds the apikey prefix index from the keys table
+// @returns Error
+func (self *Database) ReindexApikeys() error {
+	keys, err := self.GetApikeys()
+	if err != nil {
+		return err
+	}
+	return self.indexApikeys(keys...)
+}
+
+// apikeyUsage last used time of an apikey. Kept apart from the apikey
+// record so saving it can't undo a revoke or rotation made meanwhile.
+type apikeyUsage struct {
+	Id       string    `json:"id"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// touchApikey saves the last used time of an apikey.
+// Not written to the commit log.
+func (self *Database) touchApikey(key ApiKey, now time.Time) {
+	if nil != key.LastUsed && now.Sub(*key.LastUsed) < APIKEY_TOUCH_INTERVAL {
+		return
+	}
+	value, err := json.Marshal(apikeyUsage{Id: key.Id, LastUsed: now})
+	if err != nil {
+		ServerLogger.Error(err)
+		return
+	}
+	err = self.DB.Insert("key_usage", key.Id, value)
+	if err != nil {
+		ServerLogger.Error(err)
+	}
+}
+
+// withUsage sets the last used time of an apikey record from its usage record
+func (self ApiKey) withUsage(usage apikeyUsage) ApiKey {
+	if usage.LastUsed.IsZero() {
+		return self
+	}
+	if nil == self.LastUsed || usage.LastUsed.After(*self.LastUsed) {
+		last_used := usage.LastUsed
+		self.LastUsed = &last_used
+	}
+	return self
+}
+
+// getApikeyUsage returns the usage record of an apikey
+func (self *Database) getApikeyUsage(id string) apikeyUsage {
+	usage := apikeyUsage{}
+	val, err := self.DB.Select("key_usage", id)
+	if nil == err && "" != string(val) {
+		json.Unmarshal(val, &usage)
+	}
+	return usage
+}
+
+// getApikeyUsages returns the usage records of all apikeys by apikey id
+func (self *Database) getApikeyUsages() (map[string]apikeyUsage, error) {
+	values, err := self.DB.SelectAll("key_usage")
+	if err != nil {
+		return nil, err
+	}
+	usages := make(map[string]apikeyUsage)
+	for _, value := range values {
+		usage := apikeyUsage{}
+		if nil == json.Unmarshal([]byte(value), &usage) {
+			usages[usage.Id] = usage
+		}
+	}
+	return usages, nil
+}
+
+// GetApikey returns the apikey record matching an apikey
+// @param apikey {string}
+// @returns ApiKey
+// @returns Error
+func (self *Database) GetApikey(apikey string) (ApiKey, error) {
+	ids, err := self.getApikeyCandidates(apikey)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	for _, id := range ids {
+		key, err := self.GetApikeyById(id)
+		if nil == err && key.matches(apikey) {
+			return key, nil
+		}
+	}
+	return ApiKey{}, fmt.Errorf("Apikey not found")
+}
+
+// GetApikeys returns all apikey records
+// @returns []ApiKey
+// @returns Error
+func (self *Database) GetApikeys() ([]ApiKey, error) {
+	values, err := self.DB.SelectAll("keys")
+	if err != nil {
+		return nil, err
+	}
+	usages, err := self.getApikeyUsages()
+	if err != nil {
+		return nil, err
+	}
+	keys := []ApiKey{}
+	for _, value := range values {
+		key := ApiKey{}
+		err = json.Unmarshal([]byte(value), &key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key.withUsage(usages[key.Id]))
+	}
+	return keys, nil
+}
+
+// GetCustomerApikeys returns all apikey records belonging to a customer
+// @param customer {string}
+// @returns []ApiKey
+// @returns Error
+func (self *Database) GetCustomerApikeys(customer string) ([]ApiKey, error) {
+	keys, err := self.GetApikeys()
+	if err != nil {
+		return nil, err
+	}
+	result := []ApiKey{}
+	for _, key := range keys {
+		if customer == key.Customer {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
+
+// GetApikeyById returns apikey record matching the public key id
+// @param id {string}
+// @returns ApiKey
+// @returns Error
+func (self *Database) GetApikeyById(id string) (ApiKey, error) {
+	val, err := self.DB.Select("keys", id)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	if "" == string(val) {
+		return ApiKey{}, fmt.Errorf("Apikey not found")
+	}
+	key := ApiKey{}
+	err = json.Unmarshal(val, &key)
+	if err != nil {
+		return key, err
+	}
+	return key.withUsage(self.getApikeyUsage(id)), nil
+}
+
+// AuthenticateApikey returns an active apikey record and the customer owning it.
+// Records when the apikey was last used.
+// @param apikey {string}
+// @returns ApiKey
+// @returns Customer
+// @returns Error
+func (self *Database) AuthenticateApikey(apikey string) (ApiKey, Customer, error) {
+	key, err := self.GetApikey(apikey)
+	if err != nil {
+		return ApiKey{}, Customer{}, err
+	}
+	now := time.Now().UTC()
+	if !key.isActive(now) {
+		return ApiKey{}, Customer{}, fmt.Errorf("Apikey expired or revoked")
+	}
+	self.touchApikey(key, now)
+	customer, err := self.GetCustomer(key.Customer)
+	return key.public(), customer, err
+}
+
+// LookupCustomer returns a customer by id or by one of their apikeys
+// without checking whether the apikey is still active.
+// @param customer {string} customer id or apikey
+// @returns Customer
+// @returns Error
+func (self *Database) LookupCustomer(customer string) (Customer, error) {
+	result, err := self.GetCustomer(customer)
+	if nil == err {
+		return result, nil
+	}
+	key, err := self.GetApikey(customer)
+	if err != nil {
+		return Customer{}, fmt.Errorf("Customer not found")
+	}
+	return self.GetCustomer(key.Customer)
+}
+
+// CreateApikey generates a new apikey for a customer
+// @param customer {string}
+// @param label {string}
+// @param expires {*time.Time}
+// @returns ApiKey
+// @returns Error
+func (self *Database) CreateApikey(customer string, label string, expires *time.Time) (ApiKey, error) {
+	_, err := self.GetCustomer(customer)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	key := newApikey(utils.NewAPIKey(APIKEY_LENGTH), customer, label, expires)
+	err = self.InsertApikey(key)
+	if nil == err {
+		publishApikeyEvent(EVENT_APIKEY_CREATED, key.Customer, key.Id)
+	}
+	return key, err
+}
+
+// RevokeApikey immediately disables an apikey
+// @param key {ApiKey}
+// @returns ApiKey
+// @returns Error
+func (self *Database) RevokeApikey(key ApiKey) (ApiKey, error) {
+	unlock := lockCustomer(key.Customer)
+	defer unlock()
+	return self.revokeApikey(key.Id)
+}
+
+// revokeApikey re-reads and revokes an apikey. Callers hold the customer lock.
+func (self *Database) revokeApikey(id string) (ApiKey, error) {
+	key, err := self.GetApikeyById(id)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	now := time.Now().UTC()
+	key.Revoked = &now
+	err = self.InsertApikey(key)
+	if nil == err {
+		publishApikeyEvent(EVENT_APIKEY_REVOKED, key.Customer, key.Id)
+	}
+	return key, err
+}
+
+// RotateApikey creates a replacement apikey with the same label and expires
+// the old apikey after the grace period. Both apikeys work during the grace period.
+// @param key {ApiKey}
+// @param grace {time.Duration}
+// @returns ApiKey
+// @returns Error
+func (self *Database) RotateApikey(key ApiKey, grace time.Duration) (ApiKey, error) {
+	unlock := lockCustomer(key.Customer)
+	defer unlock()
+	// re-read holding the lock so a revoke made meanwhile isn't undone
+	key, err := self.GetApikeyById(key.Id)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	if !key.isActive(time.Now()) {
+		return ApiKey{}, fmt.Errorf("Apikey expired or revoked")
+	}
+	rotated, err := self.CreateApikey(key.Customer, key.Label, key.Expires)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	if 0 >= grace {
+		_, err = self.revokeApikey(key.Id)
+	} else {
+		expires := time.Now().UTC().Add(grace)
+		if nil == key.Expires || expires.Before(*key.Expires) {
+			key.Expires = &expires
+		}
+		err = self.InsertApikey(key)
+	}
+	if nil == err {
+		publishApikeyEvent(EVENT_APIKEY_ROTATED, key.Customer, key.Id)
+	}
+	return rotated, err
+}
+
+// deleteCustomerApikeys removes all apikey records belonging to a customer
+func (self *Database) deleteCustomerApikeys(customer string) error {
+	keys, err := self.GetCustomerApikeys(customer)
+	if err != nil {
+		return err
+	}
+	ids := []string{}
+	entries := []string{}
+	for _, key := range keys {
+		ids = append(ids, key.Id)
+		entries = append(entries, apikeyIndexKey(key))
+	}
+	err = self.deleteRecords("key_usage", ids...)
+	if err != nil {
+		return err
+	}
+	err = self.deleteRecords("keys", ids...)
+	if err != nil {
+		return err
+	}
+	return self.deleteRecords("key_prefixes", entries...)
+}
+
+// deleteRecords removes records from a table without writing to the commit log
+func (self *Database) deleteRecords(table string, keys ...string) error {
+	conn := self.DB.Connect()
+	defer conn.Close()
+	return conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(table))
+		if nil == bucket {
+			return nil
+		}
+		for _, key := range keys {
+			err := bucket.Delete([]byte(key))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// migrateCustomer moves a customer stored under their plaintext apikey
+// to a customer id and replaces their apikey records with hashed ones.
+// Every step can be repeated: the customer id is saved on the legacy record
+// first, so a migration interrupted by a crash resumes with the same customer.
+// @param customer {Customer}
+// @returns Customer
+// @returns Error
+func (self *Database) migrateCustomer(customer Customer) (Customer, error) {
+	legacy := customer.Apikey
+	if "" == customer.Id {
+		customer.Id = newCustomer().Id
+		value, err := json.Marshal(customer)
+		if err != nil {
+			return Customer{}, err
+		}
+		err = self.DB.Insert("apikeys", legacy, value)
+		if err != nil {
+			return Customer{}, err
+		}
+	}
+
+	migrated := Customer{Id: customer.Id}
+	migrated.Datasources = customer.Datasources
+	migrated.Roles = customer.Roles
+	migrated.TileLayers = customer.TileLayers
+	migrated.migrateRoles()
+
+	err := self.InsertCustomer(migrated)
+	if err != nil {
+		return Customer{}, err
+	}
+
+	// hash apikeys stored in plaintext, the plaintext record is
+	// only removed once the hashed record is saved
+	keys, err := self.GetCustomerApikeys(legacy)
+	if err != nil {
+		return Customer{}, err
+	}
+	hashed_keys := 0
+	for _, key := range keys {
+		if "" != key.Hash || "" == key.Apikey {
+			continue
+		}
+		hashed := newApikey(key.Apikey, migrated.Id, key.Label, key.Expires)
+		hashed.Id = key.Id
+		hashed.Created = key.Created
+		hashed.LastUsed = key.LastUsed
+		hashed.Revoked = key.Revoked
+		err = self.InsertApikey(hashed)
+		if err != nil {
+			return Customer{}, err
+		}
+		if key.Apikey != key.Id {
+			err = self.deleteRecords("keys", key.Apikey)
+			if err != nil {
+				return Customer{}, err
+			}
+		}
+		hashed_keys++
+	}
+
+	// customers keep the apikey they were created with
+	keys, err = self.GetCustomerApikeys(migrated.Id)
+	if err != nil {
+		return Customer{}, err
+	}
+	found := false
+	for _, key := range keys {
+		found = found || key.matches(legacy)
+	}
+	if !found {
+		err = self.InsertApikey(newApikey(legacy, migrated.Id, "default", nil))
+		if err != nil {
+			return Customer{}, err
+		}
+	}
+
+	ServerLogger.Info("Migrated customer ", migrated.Id, " with ", hashed_keys, " apikeys")
+	return migrated, self.deleteRecords("apikeys", legacy)
+}
+
+// MigrateApikeys moves customers stored under their plaintext apikey to
+// customer ids and hashes their apikeys.
+// @returns Error
+func (self *Database) MigrateApikeys() error {
+	customers, err := self.GetCustomers()
+	if err != nil {
+		return err
+	}
+	for _, value := range customers {
+		customer := Customer{}
+		err = json.Unmarshal([]byte(value), &customer)
+		if err != nil {
+			ServerLogger.Warn("Unable to migrate customer: ", err)
+			continue
+		}
+		// customers with an id and an apikey are unfinished migrations
+		if "" == customer.Apikey {
+			continue
+		}
+		_, err = self.migrateCustomer(customer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package geo_skeleton_server
+
+import (
+	"testing"
+	"time"
+)
+
+// Unittest ApiKey.matches
+func TestApikeyMatches(t *testing.T) {
+	key := newApikey("12dB6BlenIeB", "customer", "default", nil)
+	if "12dB" != key.Prefix {
+		t.Errorf("Unexpected prefix: %v", key.Prefix)
+	}
+	if !key.matches("12dB6BlenIeB") {
+		t.Error("Apikey should match its hash")
+	}
+	if key.matches("12dB6BlenIeC") {
+		t.Error("Different apikey should not match")
+	}
+	other := newApikey("12dB6BlenIeB", "customer", "default", nil)
+	if key.Hash == other.Hash {
+		t.Error("Hashes should be salted")
+	}
+}
+
+// Unittest ApiKey.withUsage
+func TestApikeyWithUsage(t *testing.T) {
+	now := time.Now().UTC()
+	earlier := now.Add(-time.Hour)
+	key := ApiKey{Id: "key", LastUsed: &earlier}
+	if !key.withUsage(apikeyUsage{}).LastUsed.Equal(earlier) {
+		t.Error("Missing usage should keep the record's last used time")
+	}
+	if !key.withUsage(apikeyUsage{Id: "key", LastUsed: now}).LastUsed.Equal(now) {
+		t.Error("Later usage should replace the record's last used time")
+	}
+	key.LastUsed = &now
+	if !key.withUsage(apikeyUsage{Id: "key", LastUsed: earlier}).LastUsed.Equal(now) {
+		t.Error("Earlier usage should not replace the record's last used time")
+	}
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// tcp JSON-RPC error codes
+const (
+	RPC_PARSE_ERROR      = -32700
+	RPC_INVALID_REQUEST  = -32600
+	RPC_METHOD_NOT_FOUND = -32601
+	RPC_INVALID_PARAMS   = -32602
+	RPC_INTERNAL_ERROR   = -32603
+	RPC_SERVER_ERROR     = -32000
+	RPC_UNAUTHORIZED     = -32001
+	RPC_BATCH_FAILED     = -32002
+	RPC_RESTORE_FAILED   = -32003
+)
+
+// HttpError error returned by the http api. StatusCode is the response
+// status, RetryAfter is set when the apikey is rate limited.
+type HttpError struct {
+	StatusCode int
+	Message    string
+	Version    string
+	RetryAfter time.Duration
+}
+
+func (self HttpError) Error() string {
+	return fmt.Sprintf("%v: %v", self.StatusCode, self.Message)
+}
+
+// TcpError error returned by the tcp server. Data holds error details,
+// such as the steps of a failed batch.
+type TcpError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (self TcpError) Error() string {
+	return fmt.Sprintf("%v: %v", self.Code, self.Message)
+}
+
+// IsUnauthorized checks if the apikey or authkey was rejected
+func IsUnauthorized(err error) bool {
+	switch e := err.(type) {
+	case HttpError:
+		return http.StatusUnauthorized == e.StatusCode || "Unauthorized" == e.Message
+	case TcpError:
+		return RPC_UNAUTHORIZED == e.Code || "Unauthorized" == e.Message
+	}
+	return false
+}
+
+// IsRateLimited checks if the apikey is over its rate limit
+func IsRateLimited(err error) bool {
+	e, ok := err.(HttpError)
+	return ok && http.StatusTooManyRequests == e.StatusCode
+}
+
+// IsQuotaExceeded checks if a write was rejected by a storage quota
+func IsQuotaExceeded(err error) bool {
+	e, ok := err.(HttpError)
+	return ok && http.StatusForbidden == e.StatusCode
+}
+
+// IsPreconditionFailed checks if a feature or layer version didn't match.
+// The current version is returned in the error.
+func IsPreconditionFailed(err error) bool {
+	e, ok := err.(HttpError)
+	return ok && http.StatusPreconditionFailed == e.StatusCode
+}
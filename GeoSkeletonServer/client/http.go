@@ -0,0 +1,527 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulmach/go.geojson"
+)
+
+const (
+	DEFAULT_RETRIES    = 3
+	DEFAULT_RETRY_WAIT = 500 * time.Millisecond
+	DEFAULT_TIMEOUT    = 30 * time.Second
+)
+
+// HttpClient calls the http api with an apikey. Superuser routes are
+// called with the superuser key as apikey. Idempotent calls are retried
+// on connection errors, server errors and rate limits.
+type HttpClient struct {
+	Url       string
+	Apikey    string
+	Client    *http.Client
+	Retries   int
+	RetryWait time.Duration
+}
+
+// httpEnvelope http api response
+type httpEnvelope struct {
+	Status     string          `json:"status"`
+	Datasource string          `json:"datasource"`
+	Apikey     string          `json:"apikey"`
+	Data       json.RawMessage `json:"data"`
+	Message    string          `json:"message"`
+}
+
+// NewHttpClient creates a client for the server at url, e.g. http://localhost:8080
+func NewHttpClient(server_url string, apikey string) *HttpClient {
+	return &HttpClient{
+		Url:       strings.TrimRight(server_url, "/"),
+		Apikey:    apikey,
+		Client:    &http.Client{Timeout: DEFAULT_TIMEOUT},
+		Retries:   DEFAULT_RETRIES,
+		RetryWait: DEFAULT_RETRY_WAIT,
+	}
+}
+
+// httpCall a request to the http api
+type httpCall struct {
+	method     string
+	path       string
+	query      url.Values
+	body       interface{}
+	header     http.Header
+	idempotent bool
+}
+
+// httpResult body and headers of a successful response
+type httpResult struct {
+	body   []byte
+	header http.Header
+}
+
+// version returns the version sent in the ETag header. ETags of compressed
+// responses end with the content encoding.
+func (self httpResult) version() string {
+	version := strings.Trim(strings.TrimPrefix(self.header.Get("ETag"), "W/"), `"`)
+	for _, encoding := range []string{"-gzip", "-deflate"} {
+		version = strings.TrimSuffix(version, encoding)
+	}
+	return version
+}
+
+// envelope parses the api response envelope
+func (self httpResult) envelope(data interface{}) (httpEnvelope, error) {
+	env := httpEnvelope{}
+	err := json.Unmarshal(self.body, &env)
+	if nil != err || nil == data || 0 == len(env.Data) {
+		return env, err
+	}
+	return env, json.Unmarshal(env.Data, data)
+}
+
+// retryable checks if a failed attempt can be retried
+func retryable(err error) bool {
+	e, ok := err.(HttpError)
+	if !ok {
+		return true
+	}
+	return http.StatusTooManyRequests == e.StatusCode || http.StatusInternalServerError <= e.StatusCode
+}
+
+// do sends the request, retrying idempotent requests
+func (self *HttpClient) do(call httpCall) (httpResult, error) {
+	var body []byte
+	if nil != call.body {
+		js, err := json.Marshal(call.body)
+		if nil != err {
+			return httpResult{}, err
+		}
+		body = js
+	}
+	attempts := 1
+	if call.idempotent && 0 < self.Retries {
+		attempts += self.Retries
+	}
+	var result httpResult
+	var err error
+	for i := 0; i < attempts; i++ {
+		if 0 < i {
+			wait := self.RetryWait * time.Duration(1<<uint(i-1))
+			if e, ok := err.(HttpError); ok && 0 < e.RetryAfter {
+				wait = e.RetryAfter
+			}
+			time.Sleep(wait)
+		}
+		result, err = self.attempt(call, body)
+		if nil == err || !retryable(err) {
+			return result, err
+		}
+	}
+	return result, err
+}
+
+// attempt sends the request once
+func (self *HttpClient) attempt(call httpCall, body []byte) (httpResult, error) {
+	request_url := self.Url + call.path
+	if 0 != len(call.query) {
+		request_url += "?" + call.query.Encode()
+	}
+	var reader io.Reader
+	if nil != body {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(call.method, request_url, reader)
+	if nil != err {
+		return httpResult{}, err
+	}
+	for key, values := range call.header {
+		req.Header[key] = values
+	}
+	if "" != self.Apikey {
+		req.Header.Set("X-API-Key", self.Apikey)
+	}
+	if nil != body {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := self.Client
+	if nil == client {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if nil != err {
+		return httpResult{}, err
+	}
+	defer resp.Body.Close()
+	js, err := ioutil.ReadAll(resp.Body)
+	if nil != err {
+		return httpResult{}, err
+	}
+	result := httpResult{body: js, header: resp.Header}
+	return result, checkResponse(resp, js)
+}
+
+// checkResponse returns an HttpError for error responses. Some errors
+// are sent with a 200 status and only marked in the response body.
+func checkResponse(resp *http.Response, js []byte) error {
+	env := httpEnvelope{}
+	json.Unmarshal(js, &env)
+	if http.StatusBadRequest > resp.StatusCode && "error" != env.Status {
+		return nil
+	}
+	err := HttpError{StatusCode: resp.StatusCode, Message: env.Message}
+	if "" == err.Message {
+		err.Message = strings.TrimSpace(string(js))
+	}
+	if "" == err.Message {
+		err.Message = http.StatusText(resp.StatusCode)
+	}
+	if http.StatusPreconditionFailed == resp.StatusCode {
+		err.Version = httpResult{header: resp.Header}.version()
+	}
+	if seconds, e := strconv.Atoi(resp.Header.Get("Retry-After")); nil == e {
+		err.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return err
+}
+
+// ifMatch returns the If-Match header for a version
+func ifMatch(version string) http.Header {
+	header := http.Header{}
+	if "" != version {
+		header.Set("If-Match", `"`+version+`"`)
+	}
+	return header
+}
+
+func layerPath(datasource_id string) string {
+	return "/api/v1/layer/" + url.PathEscape(datasource_id)
+}
+
+func featurePath(datasource_id string, geo_id string) string {
+	return layerPath(datasource_id) + "/feature/" + url.PathEscape(geo_id)
+}
+
+// Ping checks the server is running
+func (self *HttpClient) Ping() (map[string]interface{}, error) {
+	result, err := self.do(httpCall{method: "GET", path: "/ping", idempotent: true})
+	if nil != err {
+		return nil, err
+	}
+	data := make(map[string]interface{})
+	_, err = result.envelope(&data)
+	return data, err
+}
+
+// GetCustomer returns the customer of the apikey
+func (self *HttpClient) GetCustomer() (Customer, error) {
+	customer := Customer{}
+	result, err := self.do(httpCall{method: "GET", path: "/api/v1/customer", idempotent: true})
+	if nil != err {
+		return customer, err
+	}
+	err = json.Unmarshal(result.body, &customer)
+	return customer, err
+}
+
+// GetUsage returns the storage used by the customer and their limits
+func (self *HttpClient) GetUsage() (UsageReport, error) {
+	report := UsageReport{}
+	result, err := self.do(httpCall{method: "GET", path: "/api/v1/customer/usage", idempotent: true})
+	if nil != err {
+		return report, err
+	}
+	_, err = result.envelope(&report)
+	return report, err
+}
+
+// NewLayer creates a layer owned by the customer. Returns the datasource id.
+func (self *HttpClient) NewLayer() (string, error) {
+	result, err := self.do(httpCall{method: "POST", path: "/api/v1/layer"})
+	if nil != err {
+		return "", err
+	}
+	env, err := result.envelope(nil)
+	return env.Datasource, err
+}
+
+// GetLayer returns a layer and its version
+func (self *HttpClient) GetLayer(datasource_id string) (*geojson.FeatureCollection, string, error) {
+	result, err := self.do(httpCall{method: "GET", path: layerPath(datasource_id), idempotent: true})
+	if nil != err {
+		return nil, "", err
+	}
+	lyr, err := geojson.UnmarshalFeatureCollection(result.body)
+	return lyr, result.version(), err
+}
+
+// DeleteLayer deletes a layer. When version is set the layer is only
+// deleted if it wasn't changed since. Deletes aren't retried, a retry
+// after a lost response would fail as the layer is already gone.
+func (self *HttpClient) DeleteLayer(datasource_id string, version string) error {
+	_, err := self.do(httpCall{method: "DELETE", path: layerPath(datasource_id), header: ifMatch(version)})
+	return err
+}
+
+// NewFeature adds a feature to a layer
+func (self *HttpClient) NewFeature(datasource_id string, feat *geojson.Feature) error {
+	_, err := self.do(httpCall{method: "POST", path: layerPath(datasource_id) + "/feature", body: feat})
+	return err
+}
+
+// GetFeature returns a feature and its version
+func (self *HttpClient) GetFeature(datasource_id string, geo_id string) (*geojson.Feature, string, error) {
+	result, err := self.do(httpCall{method: "GET", path: featurePath(datasource_id, geo_id), idempotent: true})
+	if nil != err {
+		return nil, "", err
+	}
+	feat, err := geojson.UnmarshalFeature(result.body)
+	return feat, result.version(), err
+}
+
+// EditFeature replaces a feature. When version is set the feature is only
+// replaced if it wasn't changed since. Returns the new version. Conditional
+// edits aren't retried, a retry of an applied edit would fail its version check.
+func (self *HttpClient) EditFeature(datasource_id string, geo_id string, feat *geojson.Feature, version string) (string, error) {
+	result, err := self.do(httpCall{method: "PUT", path: featurePath(datasource_id, geo_id), body: feat, header: ifMatch(version), idempotent: "" == version})
+	if nil != err {
+		return "", err
+	}
+	return result.version(), nil
+}
+
+// GetFeatureHistory returns every stored version of a feature
+func (self *HttpClient) GetFeatureHistory(datasource_id string, geo_id string) ([]FeatureVersion, error) {
+	versions := []FeatureVersion{}
+	result, err := self.do(httpCall{method: "GET", path: featurePath(datasource_id, geo_id) + "/history", idempotent: true})
+	if nil != err {
+		return versions, err
+	}
+	_, err = result.envelope(&versions)
+	return versions, err
+}
+
+// GetFeatureAsOf returns a feature as it was stored at a timestamp
+func (self *HttpClient) GetFeatureAsOf(datasource_id string, geo_id string, ts int64) (*geojson.Feature, error) {
+	query := url.Values{"as_of": {fmt.Sprintf("%v", ts)}}
+	result, err := self.do(httpCall{method: "GET", path: featurePath(datasource_id, geo_id) + "/history", query: query, idempotent: true})
+	if nil != err {
+		return nil, err
+	}
+	return geojson.UnmarshalFeature(result.body)
+}
+
+// GetLayerTimestamps returns the snapshot timestamps of a layer
+func (self *HttpClient) GetLayerTimestamps(datasource_id string) ([]int64, error) {
+	data := struct {
+		Snapshots []string `json:"snapshots"`
+	}{}
+	result, err := self.do(httpCall{method: "GET", path: layerPath(datasource_id) + "/ts", idempotent: true})
+	if nil != err {
+		return nil, err
+	}
+	_, err = result.envelope(&data)
+	if nil != err {
+		return nil, err
+	}
+	timestamps := []int64{}
+	for _, snapshot := range data.Snapshots {
+		ts, err := strconv.ParseInt(snapshot, 10, 64)
+		if nil != err {
+			return timestamps, err
+		}
+		timestamps = append(timestamps, ts)
+	}
+	return timestamps, nil
+}
+
+// GetLayerAtTimestamp returns a layer as it was stored at a timestamp
+func (self *HttpClient) GetLayerAtTimestamp(datasource_id string, ts int64) (*geojson.FeatureCollection, error) {
+	result, err := self.do(httpCall{method: "GET", path: fmt.Sprintf("%v/ts/%v", layerPath(datasource_id), ts), idempotent: true})
+	if nil != err {
+		return nil, err
+	}
+	return geojson.UnmarshalFeatureCollection(result.body)
+}
+
+// GetLayerDiff returns the changes between two snapshots of a layer
+func (self *HttpClient) GetLayerDiff(datasource_id string, a int64, b int64) (LayerDiff, error) {
+	diff := LayerDiff{}
+	result, err := self.do(httpCall{method: "GET", path: fmt.Sprintf("%v/ts/%v/diff/%v", layerPath(datasource_id), a, b), idempotent: true})
+	if nil != err {
+		return diff, err
+	}
+	_, err = result.envelope(&diff)
+	return diff, err
+}
+
+// RestoreLayer restores a layer to a snapshot. With dry_run set only the changes are returned.
+func (self *HttpClient) RestoreLayer(datasource_id string, ts int64, dry_run bool) (LayerDiff, error) {
+	diff := LayerDiff{}
+	query := url.Values{"dry_run": {strconv.FormatBool(dry_run)}}
+	result, err := self.do(httpCall{method: "POST", path: fmt.Sprintf("%v/ts/%v/restore", layerPath(datasource_id), ts), query: query, idempotent: true})
+	if nil != err {
+		return diff, err
+	}
+	_, err = result.envelope(&diff)
+	return diff, err
+}
+
+// ShareLayer gives a customer, by id or apikey, a role on a layer
+func (self *HttpClient) ShareLayer(datasource_id string, customer string, role string) (LayerShare, error) {
+	share := LayerShare{}
+	body := map[string]string{"customer": customer, "role": role}
+	result, err := self.do(httpCall{method: "POST", path: layerPath(datasource_id) + "/share", body: body, idempotent: true})
+	if nil != err {
+		return share, err
+	}
+	_, err = result.envelope(&share)
+	return share, err
+}
+
+// GetLayerShares lists the customers with access to a layer
+func (self *HttpClient) GetLayerShares(datasource_id string) (LayerShares, error) {
+	shares := LayerShares{}
+	result, err := self.do(httpCall{method: "GET", path: layerPath(datasource_id) + "/share", idempotent: true})
+	if nil != err {
+		return shares, err
+	}
+	_, err = result.envelope(&shares)
+	return shares, err
+}
+
+// RevokeLayerShare removes a customer's access to a layer
+func (self *HttpClient) RevokeLayerShare(datasource_id string, customer string) error {
+	body := map[string]string{"customer": customer}
+	_, err := self.do(httpCall{method: "DELETE", path: layerPath(datasource_id) + "/share", body: body, idempotent: true})
+	return err
+}
+
+// PublishLayer sets if a layer can be read without an apikey
+func (self *HttpClient) PublishLayer(datasource_id string, public bool) (LayerMeta, error) {
+	meta := LayerMeta{}
+	body := map[string]bool{"public": public}
+	result, err := self.do(httpCall{method: "PUT", path: layerPath(datasource_id) + "/public", body: body, idempotent: true})
+	if nil != err {
+		return meta, err
+	}
+	_, err = result.envelope(&meta)
+	return meta, err
+}
+
+// GetApikeys lists the apikeys of the customer
+func (self *HttpClient) GetApikeys() ([]ApiKey, error) {
+	keys := []ApiKey{}
+	result, err := self.do(httpCall{method: "GET", path: "/api/v1/apikeys", idempotent: true})
+	if nil != err {
+		return keys, err
+	}
+	_, err = result.envelope(&keys)
+	return keys, err
+}
+
+// NewApikey creates an apikey for the customer. The secret is only returned here.
+func (self *HttpClient) NewApikey(label string, expires *time.Time) (ApiKey, error) {
+	key := ApiKey{}
+	body := map[string]interface{}{"label": label}
+	if nil != expires {
+		body["expires"] = expires.Unix()
+	}
+	result, err := self.do(httpCall{method: "POST", path: "/api/v1/apikeys", body: body})
+	if nil != err {
+		return key, err
+	}
+	env, err := result.envelope(&key)
+	key.Apikey = env.Apikey
+	return key, err
+}
+
+// RotateApikey replaces an apikey, the old apikey keeps working for the grace period
+func (self *HttpClient) RotateApikey(key_id string, grace time.Duration) (ApiKey, error) {
+	key := ApiKey{}
+	body := map[string]int64{"grace_period": int64(grace.Seconds())}
+	result, err := self.do(httpCall{method: "POST", path: "/api/v1/apikeys/" + url.PathEscape(key_id) + "/rotate", body: body})
+	if nil != err {
+		return key, err
+	}
+	env, err := result.envelope(&key)
+	key.Apikey = env.Apikey
+	return key, err
+}
+
+// RevokeApikey disables an apikey
+func (self *HttpClient) RevokeApikey(key_id string) (ApiKey, error) {
+	key := ApiKey{}
+	result, err := self.do(httpCall{method: "DELETE", path: "/api/v1/apikeys/" + url.PathEscape(key_id), idempotent: true})
+	if nil != err {
+		return key, err
+	}
+	_, err = result.envelope(&key)
+	return key, err
+}
+
+// NewCustomer creates a customer. Requires the superuser key. Returns the customer and their apikey.
+func (self *HttpClient) NewCustomer() (Customer, string, error) {
+	customer := Customer{}
+	result, err := self.do(httpCall{method: "POST", path: "/api/v1/customers"})
+	if nil != err {
+		return customer, "", err
+	}
+	env, err := result.envelope(&customer)
+	return customer, env.Apikey, err
+}
+
+// GetCustomers lists the customers. Requires the superuser key.
+func (self *HttpClient) GetCustomers() ([]Customer, error) {
+	customers := []Customer{}
+	result, err := self.do(httpCall{method: "GET", path: "/api/v1/customers", idempotent: true})
+	if nil != err {
+		return customers, err
+	}
+	_, err = result.envelope(&customers)
+	return customers, err
+}
+
+// DeleteCustomer deletes a customer and their apikeys. Requires the superuser key.
+func (self *HttpClient) DeleteCustomer(customer string) error {
+	_, err := self.do(httpCall{method: "DELETE", path: "/api/v1/customers/" + url.PathEscape(customer), idempotent: true})
+	return err
+}
+
+// AssignDatasource gives a customer a role on a datasource. Requires the superuser key.
+func (self *HttpClient) AssignDatasource(customer string, datasource_id string, role string) (LayerShare, error) {
+	share := LayerShare{}
+	body := map[string]string{"datasource": datasource_id, "role": role}
+	result, err := self.do(httpCall{method: "POST", path: "/api/v1/customers/" + url.PathEscape(customer) + "/datasources", body: body, idempotent: true})
+	if nil != err {
+		return share, err
+	}
+	_, err = result.envelope(&share)
+	return share, err
+}
+
+// UnassignDatasource removes a customer's access to a datasource. Requires the superuser key.
+func (self *HttpClient) UnassignDatasource(customer string, datasource_id string) error {
+	path := "/api/v1/customers/" + url.PathEscape(customer) + "/datasources/" + url.PathEscape(datasource_id)
+	_, err := self.do(httpCall{method: "DELETE", path: path, idempotent: true})
+	return err
+}
+
+// GetDatasources lists every datasource and its owners. Requires the superuser key.
+func (self *HttpClient) GetDatasources() (map[string][]string, error) {
+	owners := make(map[string][]string)
+	result, err := self.do(httpCall{method: "GET", path: "/api/v1/datasources", idempotent: true})
+	if nil != err {
+		return owners, err
+	}
+	_, err = result.envelope(&owners)
+	return owners, err
+}
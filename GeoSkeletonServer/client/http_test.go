@@ -0,0 +1,93 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Unittest HttpClient errors and retries
+func TestHttpClient(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		switch r.URL.Path {
+		case "/ping":
+			if 3 > attempts {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"status":"ok","data":{"result":"pong"}}`))
+		case "/api/v1/layer":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/api/v1/layer/missing":
+			w.Write([]byte(`{"status":"error","message":"Not found"}`))
+		case "/api/v1/layer/stale/feature/1":
+			w.Header().Set("ETag", `"3f786850e387550fdab836ed7e6dc881de23001b-gzip"`)
+			w.WriteHeader(http.StatusPreconditionFailed)
+			w.Write([]byte(`{"status":"error","message":"Version mismatch"}`))
+		}
+	}))
+	defer server.Close()
+
+	client := NewHttpClient(server.URL, "12dB6BlenIeB")
+	client.RetryWait = time.Millisecond
+
+	_, err := client.Ping()
+	if nil != err || 3 != attempts {
+		t.Errorf("Ping should succeed on the third attempt: %v %v", attempts, err)
+	}
+
+	attempts = 0
+	_, err = client.NewLayer()
+	if nil == err || 1 != attempts {
+		t.Errorf("NewLayer should not be retried: %v %v", attempts, err)
+	}
+
+	_, _, err = client.GetLayer("missing")
+	if e, ok := err.(HttpError); !ok || "Not found" != e.Message {
+		t.Errorf("Error body should be returned as an error: %v", err)
+	}
+
+	_, err = client.EditFeature("stale", "1", nil, "da39a3ee5e6b4b0d3255bfef95601890afd80709")
+	if !IsPreconditionFailed(err) || "3f786850e387550fdab836ed7e6dc881de23001b" != err.(HttpError).Version {
+		t.Errorf("Precondition failure should return the current version: %v", err)
+	}
+}
+
+// Unittest HttpClient conditional writes aren't retried
+func TestHttpClientConditionalWrites(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := NewHttpClient(server.URL, "12dB6BlenIeB")
+	client.RetryWait = time.Millisecond
+
+	_, err := client.EditFeature("a", "1", nil, "da39a3ee5e6b4b0d3255bfef95601890afd80709")
+	if nil == err || 1 != attempts {
+		t.Errorf("Conditional edit should not be retried: %v %v", attempts, err)
+	}
+
+	attempts = 0
+	err = client.DeleteLayer("a", "da39a3ee5e6b4b0d3255bfef95601890afd80709")
+	if nil == err || 1 != attempts {
+		t.Errorf("Conditional delete should not be retried: %v %v", attempts, err)
+	}
+
+	attempts = 0
+	err = client.DeleteLayer("a", "")
+	if nil == err || 1 != attempts {
+		t.Errorf("Delete should not be retried: %v %v", attempts, err)
+	}
+
+	attempts = 0
+	_, err = client.EditFeature("a", "1", nil, "")
+	if nil == err || 1 == attempts {
+		t.Errorf("Unconditional edit should be retried: %v %v", attempts, err)
+	}
+}
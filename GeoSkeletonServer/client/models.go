@@ -0,0 +1,216 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/paulmach/go.geojson"
+)
+
+// Roles customers can have on a datasource
+const (
+	ROLE_VIEWER = "viewer"
+	ROLE_EDITOR = "editor"
+	ROLE_OWNER  = "owner"
+)
+
+// Customer api customer and the datasources they can access
+type Customer struct {
+	Id          string            `json:"id"`
+	Datasources []string          `json:"datasources"`
+	Roles       map[string]string `json:"roles,omitempty"`
+}
+
+// ApiKey apikey record. Apikey is only set when the apikey is created.
+type ApiKey struct {
+	Id       string     `json:"id"`
+	Prefix   string     `json:"prefix"`
+	Apikey   string     `json:"apikey,omitempty"`
+	Customer string     `json:"customer"`
+	Label    string     `json:"label"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	Revoked  *time.Time `json:"revoked,omitempty"`
+}
+
+// LayerShare customer with access to a datasource
+type LayerShare struct {
+	Customer string `json:"customer"`
+	Role     string `json:"role"`
+}
+
+// LayerShares customers with access to a datasource and if it is public
+type LayerShares struct {
+	Shares []LayerShare `json:"shares"`
+	Public bool         `json:"public"`
+}
+
+// LayerMeta layer metadata
+type LayerMeta struct {
+	Datasource string `json:"datasource"`
+	Public     bool   `json:"public"`
+}
+
+// RateLimit apikey rate limit
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+// Quota customer storage quota. Zero means unlimited.
+type Quota struct {
+	MaxLayers   int   `json:"max_layers"`
+	MaxFeatures int   `json:"max_features"`
+	MaxBytes    int64 `json:"max_bytes"`
+}
+
+// Usage storage used by a customer's layers
+type Usage struct {
+	Layers   int   `json:"layers"`
+	Features int   `json:"features"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// UsageReport customer usage and limits
+type UsageReport struct {
+	Usage     Usage      `json:"usage"`
+	Quota     *Quota     `json:"quota,omitempty"`
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+}
+
+// PropertyChange before and after value of a feature property
+type PropertyChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// GeometryChange before and after geometry of a feature
+type GeometryChange struct {
+	Before *geojson.Geometry `json:"before"`
+	After  *geojson.Geometry `json:"after"`
+}
+
+// FeatureChange changes of a feature between two snapshots
+type FeatureChange struct {
+	GeoId      string                    `json:"geo_id"`
+	Properties map[string]PropertyChange `json:"properties,omitempty"`
+	Geometry   *GeometryChange           `json:"geometry,omitempty"`
+}
+
+// LayerDiff features added, removed and modified between two snapshots
+type LayerDiff struct {
+	From     string             `json:"from"`
+	To       string             `json:"to"`
+	Added    []*geojson.Feature `json:"added"`
+	Removed  []*geojson.Feature `json:"removed"`
+	Modified []FeatureChange    `json:"modified"`
+}
+
+// FeatureVersion feature as stored at a snapshot
+type FeatureVersion struct {
+	Timestamp string           `json:"timestamp"`
+	Deleted   bool             `json:"deleted,omitempty"`
+	Feature   *geojson.Feature `json:"feature,omitempty"`
+}
+
+// LayerSnapshot layer as stored at a snapshot
+type LayerSnapshot struct {
+	Datasource string                     `json:"datasource_id"`
+	Timestamp  string                     `json:"timestamp"`
+	Layer      *geojson.FeatureCollection `json:"layer"`
+}
+
+// Event change streamed to tcp subscribers
+type Event struct {
+	Epoch      string `json:"epoch"`
+	Sequence   uint64 `json:"sequence"`
+	Type       string `json:"type"`
+	Datasource string `json:"datasource,omitempty"`
+	GeoId      string `json:"geo_id,omitempty"`
+	Customer   string `json:"customer,omitempty"`
+	KeyId      string `json:"key_id,omitempty"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// BatchRequest step of a tcp batch. Params are merged into the request.
+type BatchRequest map[string]interface{}
+
+// BatchStep result of a batch step
+type BatchStep struct {
+	Method string          `json:"method"`
+	Status string          `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// BatchResult result of a tcp batch
+type BatchResult struct {
+	Committed bool        `json:"committed"`
+	Steps     []BatchStep `json:"steps"`
+}
+
+// RestoreProgress commit log lines replayed by a restore
+type RestoreProgress struct {
+	Lines      int   `json:"lines"`
+	Applied    int   `json:"applied"`
+	Failed     int   `json:"failed"`
+	Skipped    int   `json:"skipped"`
+	Bytes      int64 `json:"bytes"`
+	TotalBytes int64 `json:"total_bytes"`
+	Committed  int64 `json:"committed,omitempty"`
+}
+
+// RestoreLineError commit log line rejected during a restore
+type RestoreLineError struct {
+	Line   int    `json:"line"`
+	Method string `json:"method,omitempty"`
+	Error  string `json:"error"`
+}
+
+// RestoreVerification contents of a restored database
+type RestoreVerification struct {
+	Customers int      `json:"customers"`
+	Apikeys   int      `json:"apikeys"`
+	Layers    int      `json:"layers"`
+	Features  int      `json:"features"`
+	Problems  []string `json:"problems"`
+	Warnings  []string `json:"warnings"`
+}
+
+// RestoreReport result of a commit log restore
+type RestoreReport struct {
+	RestoreProgress
+	Stopped      bool                `json:"stopped"`
+	Errors       []RestoreLineError  `json:"errors"`
+	Verification RestoreVerification `json:"verification"`
+	Verified     bool                `json:"verified"`
+}
+
+// MethodParam tcp method parameter
+type MethodParam struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required"`
+	Description string `json:"description"`
+}
+
+// Method tcp method description returned by describe
+type Method struct {
+	Name        string          `json:"name"`
+	Group       string          `json:"group"`
+	Description string          `json:"description"`
+	Params      []MethodParam   `json:"params"`
+	Example     json.RawMessage `json:"example"`
+	Public      bool            `json:"public"`
+	AliasOf     string          `json:"alias_of,omitempty"`
+}
+
+// LayerMessage websocket message. Update is set when the layer changed and
+// Viewers counts the open sockets. Raw holds the message as received, which
+// for edits relayed from other editors is the only content.
+type LayerMessage struct {
+	Update  bool            `json:"update"`
+	Viewers int             `json:"viewers"`
+	Raw     json.RawMessage `json:"-"`
+}
@@ -0,0 +1,766 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulmach/go.geojson"
+)
+
+// EVENT_BUFFER events queued for a subscriber before the connection stops reading
+const EVENT_BUFFER = 256
+
+// ErrClosed is returned by calls made after the client was closed
+var ErrClosed = errors.New("Client closed")
+
+// ErrTimeout is returned when a response doesn't arrive in time. The request
+// may still be applied by the server.
+var ErrTimeout = errors.New("Timed out waiting for response")
+
+// tcpRequest JSON-RPC 2.0 request
+type tcpRequest struct {
+	JsonRpc string      `json:"jsonrpc"`
+	Id      int64       `json:"id"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+// tcpResponse JSON-RPC 2.0 response or event notification
+type tcpResponse struct {
+	Id     *int64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *TcpError       `json:"error"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// tcpStreamRecord record streamed ahead of the response to a request
+type tcpStreamRecord struct {
+	Request int64           `json:"request"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// tcpReply response delivered to a waiting call. Err is set when the connection failed.
+type tcpReply struct {
+	resp tcpResponse
+	err  error
+}
+
+// connError connection failure, the request may or may not have been applied
+type connError struct {
+	err error
+}
+
+func (self connError) Error() string {
+	return self.err.Error()
+}
+
+// subscription events requested by the client. epoch and since are moved
+// forward as events arrive so the subscription can resume after a reconnect.
+type subscription struct {
+	datasources []string
+	types       []string
+	epoch       atomic.Value
+	since       uint64
+	id          int64
+	events      chan Event
+	done        chan bool
+	once        sync.Once
+	lock        sync.Mutex
+	closed      bool
+}
+
+// MarshalJSON writes the subscribe params
+func (self *subscription) MarshalJSON() ([]byte, error) {
+	epoch, _ := self.epoch.Load().(string)
+	return json.Marshal(struct {
+		Datasources []string `json:"datasources,omitempty"`
+		Events      []string `json:"events,omitempty"`
+		Epoch       string   `json:"epoch,omitempty"`
+		Since       uint64   `json:"since,omitempty"`
+	}{self.datasources, self.types, epoch, atomic.LoadUint64(&self.since)})
+}
+
+// deliver queues an event, blocking until it is read or the subscription is closed
+func (self *subscription) deliver(event Event) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return
+	}
+	select {
+	case self.events <- event:
+		self.epoch.Store(event.Epoch)
+		atomic.StoreUint64(&self.since, event.Sequence)
+	case <-self.done:
+	}
+}
+
+// close stops delivery and closes the events channel
+func (self *subscription) close() {
+	self.once.Do(func() {
+		close(self.done)
+		self.lock.Lock()
+		self.closed = true
+		close(self.events)
+		self.lock.Unlock()
+	})
+}
+
+// TcpClient calls the tcp server over JSON-RPC. Calls can be made from several
+// goroutines and are answered as they finish. Broken connections are redialed
+// and idempotent calls are retried.
+type TcpClient struct {
+	Network   string
+	Address   string
+	Authkey   string
+	TLS       *tls.Config
+	Timeout   time.Duration
+	Retries   int
+	RetryWait time.Duration
+
+	lock         sync.Mutex
+	conn         net.Conn
+	id           int64
+	pending      map[int64]chan tcpReply
+	streams      map[int64]func(json.RawMessage)
+	subscription *subscription
+	closed       bool
+}
+
+// DialTcp connects to the tcp server at address, e.g. localhost:3333. The
+// authkey is sent when set, tls_config enables tls when it isn't nil.
+func DialTcp(address string, authkey string, tls_config *tls.Config) (*TcpClient, error) {
+	return dial("tcp", address, authkey, tls_config)
+}
+
+// DialUnix connects to the unix socket of the tcp server. The authkey is
+// only needed when the server sets require_auth.
+func DialUnix(socket_file string, authkey string) (*TcpClient, error) {
+	return dial("unix", socket_file, authkey, nil)
+}
+
+// dial creates a client and connects it
+func dial(network string, address string, authkey string, tls_config *tls.Config) (*TcpClient, error) {
+	client := &TcpClient{
+		Network:   network,
+		Address:   address,
+		Authkey:   authkey,
+		TLS:       tls_config,
+		Timeout:   DEFAULT_TIMEOUT,
+		Retries:   DEFAULT_RETRIES,
+		RetryWait: DEFAULT_RETRY_WAIT,
+		pending:   make(map[int64]chan tcpReply),
+		streams:   make(map[int64]func(json.RawMessage)),
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	_, err := client.connect()
+	return client, err
+}
+
+// Close closes the connection and the events channel
+func (self *TcpClient) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	if nil != self.subscription {
+		self.subscription.close()
+		self.subscription = nil
+	}
+	if nil == self.conn {
+		return nil
+	}
+	err := self.conn.Close()
+	self.conn = nil
+	return err
+}
+
+// nextId returns a request id. Must be called with the lock held.
+func (self *TcpClient) nextId() int64 {
+	self.id++
+	return self.id
+}
+
+// connect dials the server, authenticates and restores the event
+// subscription. Must be called with the lock held.
+func (self *TcpClient) connect() (net.Conn, error) {
+	if self.closed {
+		return nil, ErrClosed
+	}
+	if nil != self.conn {
+		return self.conn, nil
+	}
+	dialer := &net.Dialer{Timeout: self.Timeout}
+	var conn net.Conn
+	var err error
+	if nil != self.TLS {
+		conn, err = tls.DialWithDialer(dialer, self.Network, self.Address, self.TLS)
+	} else {
+		conn, err = dialer.Dial(self.Network, self.Address)
+	}
+	if nil != err {
+		return nil, connError{err}
+	}
+	reader := bufio.NewReader(conn)
+	if "" != self.Authkey {
+		_, err = self.handshake(conn, reader, "auth", map[string]string{"authkey": self.Authkey})
+		if nil != err {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if nil != self.subscription {
+		self.subscription.id, err = self.handshake(conn, reader, "subscribe", self.subscription)
+		if nil != err {
+			conn.Close()
+			return nil, err
+		}
+	}
+	self.conn = conn
+	go self.readLoop(conn, reader)
+	return conn, nil
+}
+
+// handshake sends a request before responses are read in the background.
+// Returns the request id.
+func (self *TcpClient) handshake(conn net.Conn, reader *bufio.Reader, method string, params interface{}) (int64, error) {
+	id := self.nextId()
+	js, err := json.Marshal(tcpRequest{JsonRpc: "2.0", Id: id, Method: method, Params: params})
+	if nil != err {
+		return id, err
+	}
+	conn.SetDeadline(time.Now().Add(self.Timeout))
+	defer conn.SetDeadline(time.Time{})
+	_, err = conn.Write(append(js, '\n'))
+	if nil != err {
+		return id, connError{err}
+	}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if nil != err {
+			return id, connError{err}
+		}
+		resp := tcpResponse{}
+		err = json.Unmarshal(line, &resp)
+		if nil != err {
+			return id, fmt.Errorf("Invalid response: %v", err)
+		}
+		if nil == resp.Id || id != *resp.Id {
+			continue
+		}
+		if nil != resp.Error {
+			return id, *resp.Error
+		}
+		return id, nil
+	}
+}
+
+// readLoop dispatches responses to waiting calls and events to the subscription
+func (self *TcpClient) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadBytes('\n')
+		if nil != err {
+			self.disconnect(conn, err)
+			return
+		}
+		resp := tcpResponse{}
+		if nil != json.Unmarshal(line, &resp) {
+			continue
+		}
+
+		if "event" == resp.Method {
+			event := Event{}
+			if nil != json.Unmarshal(resp.Params, &event) {
+				continue
+			}
+			self.lock.Lock()
+			sub := self.subscription
+			self.lock.Unlock()
+			if nil != sub {
+				sub.deliver(event)
+			}
+			continue
+		}
+
+		// records streamed ahead of a response are read in order on this goroutine
+		if "stream" == resp.Method {
+			record := tcpStreamRecord{}
+			if nil != json.Unmarshal(resp.Params, &record) {
+				continue
+			}
+			self.lock.Lock()
+			stream := self.streams[record.Request]
+			self.lock.Unlock()
+			if nil != stream {
+				stream(record.Data)
+			}
+			continue
+		}
+
+		if nil == resp.Id {
+			continue
+		}
+		self.lock.Lock()
+		reply, ok := self.pending[*resp.Id]
+		delete(self.pending, *resp.Id)
+		delete(self.streams, *resp.Id)
+		dropped := nil != self.subscription && *resp.Id == self.subscription.id
+		self.lock.Unlock()
+		if ok {
+			reply <- tcpReply{resp: resp}
+			continue
+		}
+		// the server drops subscribers that fall behind, resume where the events stopped
+		if dropped && nil != resp.Error {
+			conn.Close()
+		}
+	}
+}
+
+// disconnect fails the calls waiting on a broken connection. Subscribed
+// clients reconnect right away so events keep arriving.
+func (self *TcpClient) disconnect(conn net.Conn, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	conn.Close()
+	if self.conn != conn {
+		return
+	}
+	self.conn = nil
+	for id, reply := range self.pending {
+		reply <- tcpReply{err: connError{err}}
+		delete(self.pending, id)
+		delete(self.streams, id)
+	}
+	if nil != self.subscription && !self.closed {
+		go self.resubscribe()
+	}
+}
+
+// resubscribe reconnects a subscribed client, giving up and closing the
+// events channel when the server can't be reached
+func (self *TcpClient) resubscribe() {
+	for i := 0; i <= self.Retries; i++ {
+		time.Sleep(self.RetryWait * time.Duration(1<<uint(i)))
+		self.lock.Lock()
+		if self.closed || nil == self.subscription {
+			self.lock.Unlock()
+			return
+		}
+		_, err := self.connect()
+		if nil == err {
+			self.lock.Unlock()
+			return
+		}
+		if _, ok := err.(connError); !ok || i == self.Retries {
+			self.subscription.close()
+			self.subscription = nil
+		}
+		self.lock.Unlock()
+	}
+}
+
+// send writes a request and returns the channel its response is delivered to.
+// Records streamed ahead of the response are passed to stream when it is set.
+func (self *TcpClient) send(method string, params interface{}, stream func(json.RawMessage)) (int64, chan tcpReply, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	conn, err := self.connect()
+	if nil != err {
+		return 0, nil, err
+	}
+	id := self.nextId()
+	js, err := json.Marshal(tcpRequest{JsonRpc: "2.0", Id: id, Method: method, Params: params})
+	if nil != err {
+		return id, nil, err
+	}
+	reply := make(chan tcpReply, 1)
+	self.pending[id] = reply
+	if nil != stream {
+		self.streams[id] = stream
+	}
+	// events can follow the subscribe response right away
+	if sub, ok := params.(*subscription); ok {
+		if nil != self.subscription {
+			self.subscription.close()
+		}
+		sub.id = id
+		self.subscription = sub
+	}
+	_, err = conn.Write(append(js, '\n'))
+	if nil != err {
+		delete(self.pending, id)
+		delete(self.streams, id)
+		conn.Close()
+		return id, nil, connError{err}
+	}
+	return id, reply, nil
+}
+
+// forget stops waiting for the response to a request
+func (self *TcpClient) forget(id int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.pending, id)
+	delete(self.streams, id)
+}
+
+// roundTrip sends one request and waits for its result. A timeout of zero
+// waits until the connection fails. Timed out requests may still be running
+// on the server, they fail with ErrTimeout and aren't retried.
+func (self *TcpClient) roundTrip(method string, params interface{}, stream func(json.RawMessage), wait time.Duration) (json.RawMessage, error) {
+	id, reply, err := self.send(method, params, stream)
+	if nil != err {
+		return nil, err
+	}
+	var timeout <-chan time.Time
+	if 0 != wait {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case r := <-reply:
+		if nil != r.err {
+			return nil, r.err
+		}
+		if nil != r.resp.Error {
+			return nil, *r.resp.Error
+		}
+		return r.resp.Result, nil
+	case <-timeout:
+		self.forget(id)
+		return nil, ErrTimeout
+	}
+}
+
+// call sends a request and decodes its result. Idempotent requests are
+// retried when the connection fails.
+func (self *TcpClient) call(method string, params interface{}, idempotent bool, result interface{}) error {
+	var js json.RawMessage
+	var err error
+	for i := 0; i <= self.Retries; i++ {
+		if 0 < i {
+			time.Sleep(self.RetryWait * time.Duration(1<<uint(i-1)))
+		}
+		js, err = self.roundTrip(method, params, nil, self.Timeout)
+		if _, ok := err.(connError); !ok || !idempotent {
+			break
+		}
+	}
+	if nil != err || nil == result || 0 == len(js) {
+		return err
+	}
+	return json.Unmarshal(js, result)
+}
+
+// Call sends any tcp method with named params and decodes its result. It isn't retried.
+func (self *TcpClient) Call(method string, params interface{}, result interface{}) error {
+	return self.call(method, params, false, result)
+}
+
+// Ping checks the connection. Returns the server version.
+func (self *TcpClient) Ping() (string, error) {
+	data := struct {
+		Version string `json:"version"`
+	}{}
+	err := self.call("ping", nil, true, &data)
+	return data.Version, err
+}
+
+// Help lists the tcp method names
+func (self *TcpClient) Help() ([]string, error) {
+	names := []string{}
+	err := self.call("help", nil, true, &names)
+	return names, err
+}
+
+// Describe returns the description of a tcp method
+func (self *TcpClient) Describe(name string) (Method, error) {
+	method := Method{}
+	err := self.call("describe", map[string]string{"name": name}, true, &method)
+	return method, err
+}
+
+// DescribeAll returns the description of every tcp method
+func (self *TcpClient) DescribeAll() ([]Method, error) {
+	methods := []Method{}
+	err := self.call("describe", nil, true, &methods)
+	return methods, err
+}
+
+// CreateApikey creates a customer with a default apikey. Returns the customer id and apikey.
+func (self *TcpClient) CreateApikey() (string, string, error) {
+	data := struct {
+		Apikey   string `json:"apikey"`
+		Customer string `json:"customer"`
+	}{}
+	err := self.call("create_apikey", nil, false, &data)
+	return data.Customer, data.Apikey, err
+}
+
+// ExportApikeys returns a page of customers, a limit of zero returns all customers
+func (self *TcpClient) ExportApikeys(offset int, limit int) ([]Customer, error) {
+	customers := []Customer{}
+	records := []string{}
+	err := self.call("export_apikeys", map[string]int{"offset": offset, "limit": limit}, true, &records)
+	if nil != err {
+		return customers, err
+	}
+	for _, record := range records {
+		customer := Customer{}
+		err = json.Unmarshal([]byte(record), &customer)
+		if nil != err {
+			return customers, err
+		}
+		customers = append(customers, customer)
+	}
+	return customers, nil
+}
+
+// ExportApikey returns a customer by id or apikey
+func (self *TcpClient) ExportApikey(apikey string) (Customer, error) {
+	customer := Customer{}
+	err := self.call("export_apikey", map[string]string{"apikey": apikey}, true, &customer)
+	return customer, err
+}
+
+// CreateKey creates an apikey for a customer. The secret is only returned here.
+func (self *TcpClient) CreateKey(apikey string, label string, expires *time.Time) (ApiKey, error) {
+	key := ApiKey{}
+	params := map[string]interface{}{"apikey": apikey, "label": label}
+	if nil != expires {
+		params["expires"] = expires.Unix()
+	}
+	err := self.call("create_key", params, false, &key)
+	return key, err
+}
+
+// ListKeys lists the apikeys of a customer
+func (self *TcpClient) ListKeys(apikey string) ([]ApiKey, error) {
+	keys := []ApiKey{}
+	err := self.call("list_keys", map[string]string{"apikey": apikey}, true, &keys)
+	return keys, err
+}
+
+// RotateKey replaces an apikey, the old apikey keeps working for the grace period
+func (self *TcpClient) RotateKey(key_id string, grace time.Duration) (ApiKey, error) {
+	key := ApiKey{}
+	params := map[string]interface{}{"key_id": key_id, "grace_period": int64(grace.Seconds())}
+	err := self.call("rotate_key", params, false, &key)
+	return key, err
+}
+
+// RevokeKey disables an apikey
+func (self *TcpClient) RevokeKey(key_id string) (ApiKey, error) {
+	key := ApiKey{}
+	err := self.call("revoke_key", map[string]string{"key_id": key_id}, true, &key)
+	return key, err
+}
+
+// AssignDatasource gives a customer a role on a datasource, the role defaults to owner
+func (self *TcpClient) AssignDatasource(apikey string, datasource_id string, role string) (string, error) {
+	data := struct {
+		Role string `json:"role"`
+	}{}
+	params := map[string]string{"apikey": apikey, "datasource": datasource_id, "role": role}
+	err := self.call("assign_datasource", params, true, &data)
+	return data.Role, err
+}
+
+// InsertFeature adds a feature to a layer
+func (self *TcpClient) InsertFeature(datasource_id string, feat *geojson.Feature) error {
+	params := map[string]interface{}{"datasource": datasource_id, "feature": feat}
+	return self.call("insert_feature", params, false, nil)
+}
+
+// EditFeature replaces a feature. When version is set the feature is only
+// replaced if it wasn't changed since. Returns the new version. Conditional
+// edits aren't retried, a retry of an applied edit would fail its version check.
+func (self *TcpClient) EditFeature(datasource_id string, geo_id string, feat *geojson.Feature, version string) (string, error) {
+	data := struct {
+		Version string `json:"version"`
+	}{}
+	params := map[string]interface{}{"datasource": datasource_id, "geo_id": geo_id, "feature": feat, "version": version}
+	err := self.call("edit_feature", params, "" == version, &data)
+	return data.Version, err
+}
+
+// CreateDatasource creates an empty layer. Returns the datasource id.
+func (self *TcpClient) CreateDatasource() (string, error) {
+	data := struct {
+		Datasource string `json:"datasource_id"`
+	}{}
+	err := self.call("create_datasource", nil, false, &data)
+	return data.Datasource, err
+}
+
+// InsertLayer creates or replaces a layer
+func (self *TcpClient) InsertLayer(datasource_id string, lyr *geojson.FeatureCollection) error {
+	params := map[string]interface{}{"datasource": datasource_id, "layer": lyr}
+	return self.call("insert_layer", params, true, nil)
+}
+
+// DeleteDatasource deletes a layer
+func (self *TcpClient) DeleteDatasource(datasource_id string) error {
+	return self.call("delete_datasource", map[string]string{"datasource": datasource_id}, true, nil)
+}
+
+// InsertLayerMeta stores layer metadata
+func (self *TcpClient) InsertLayerMeta(meta LayerMeta) (LayerMeta, error) {
+	result := LayerMeta{}
+	err := self.call("insert_layer_meta", map[string]LayerMeta{"data": meta}, true, &result)
+	return result, err
+}
+
+// ExportDatasources returns a page of datasource ids, a limit of zero returns all ids
+func (self *TcpClient) ExportDatasources(offset int, limit int) ([]string, error) {
+	ids := []string{}
+	err := self.call("export_datasources", map[string]int{"offset": offset, "limit": limit}, true, &ids)
+	return ids, err
+}
+
+// ExportDatasource returns a layer
+func (self *TcpClient) ExportDatasource(datasource_id string) (*geojson.FeatureCollection, error) {
+	lyr := geojson.NewFeatureCollection()
+	err := self.call("export_datasource", map[string]string{"datasource": datasource_id}, true, lyr)
+	return lyr, err
+}
+
+// ImportFile imports a file on the server into a new layer. Returns the datasource id.
+func (self *TcpClient) ImportFile(file string) (string, error) {
+	data := struct {
+		Datasource string `json:"datasource"`
+	}{}
+	err := self.call("import_file", map[string]string{"file": file}, false, &data)
+	return data.Datasource, err
+}
+
+// ExportDatasourceSnapshots returns the snapshot timestamps of a layer
+func (self *TcpClient) ExportDatasourceSnapshots(datasource_id string) ([]int64, error) {
+	data := struct {
+		Snapshots []string `json:"snapshots"`
+	}{}
+	err := self.call("export_datasource_snapshots", map[string]string{"datasource": datasource_id}, true, &data)
+	if nil != err {
+		return nil, err
+	}
+	timestamps := []int64{}
+	for _, snapshot := range data.Snapshots {
+		ts, err := strconv.ParseInt(snapshot, 10, 64)
+		if nil != err {
+			return timestamps, err
+		}
+		timestamps = append(timestamps, ts)
+	}
+	return timestamps, nil
+}
+
+// ExportDatasourceBySnapshot returns a layer as it was stored at a timestamp
+func (self *TcpClient) ExportDatasourceBySnapshot(datasource_id string, ts int64) (*geojson.FeatureCollection, error) {
+	lyr := geojson.NewFeatureCollection()
+	params := map[string]interface{}{"datasource": datasource_id, "timestamp": ts}
+	err := self.call("export_datasource_by_snapshot", params, true, lyr)
+	return lyr, err
+}
+
+// ExportDatasourceByRange returns the snapshots of a layer taken between
+// two timestamps in nanoseconds. It isn't retried.
+func (self *TcpClient) ExportDatasourceByRange(datasource_id string, begin int64, end int64) ([]LayerSnapshot, error) {
+	snapshots := []LayerSnapshot{}
+	var decodeErr error
+	stream := func(record json.RawMessage) {
+		snapshot := LayerSnapshot{}
+		err := json.Unmarshal(record, &snapshot)
+		if nil != err {
+			decodeErr = err
+			return
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	params := map[string]interface{}{"datasource": datasource_id, "begin_timestamp": begin, "end_timestamp": end}
+	_, err := self.roundTrip("export_datasource_by_range", params, stream, self.Timeout)
+	if nil != err {
+		return nil, err
+	}
+	return snapshots, decodeErr
+}
+
+// Batch applies the requests in order, undoing them all when one fails.
+// The steps of a failed batch are returned along with the error.
+func (self *TcpClient) Batch(requests []BatchRequest) (BatchResult, error) {
+	result := BatchResult{}
+	err := self.call("batch", map[string][]BatchRequest{"requests": requests}, false, &result)
+	if e, ok := err.(TcpError); ok && RPC_BATCH_FAILED == e.Code {
+		json.Unmarshal(e.Data, &result)
+	}
+	return result, err
+}
+
+// RestoreCommitLog replays a commit log on the server into its empty
+// database. Lines committed after stop_at, in unix nanoseconds, are skipped
+// when it is set. The report of a restore that failed verification is
+// returned along with the error. Waits for the restore to finish.
+func (self *TcpClient) RestoreCommitLog(file string, stop_at int64, stop_on_error bool) (RestoreReport, error) {
+	report := RestoreReport{}
+	params := map[string]interface{}{"file": file, "stop_at": stop_at, "stop_on_error": stop_on_error}
+	js, err := self.roundTrip("restore_commit_log", params, nil, 0)
+	if e, ok := err.(TcpError); ok && RPC_RESTORE_FAILED == e.Code {
+		json.Unmarshal(e.Data, &report)
+	}
+	if nil != err {
+		return report, err
+	}
+	err = json.Unmarshal(js, &report)
+	return report, err
+}
+
+// Subscribe streams events of the datasources and event types, empty
+// filters receive everything. When since is set the events published after
+// that sequence number are sent first, epoch has to be the epoch of that
+// event. The client resumes the subscription after reconnecting, the channel
+// is closed by Unsubscribe, Close, when the server can't be reached or when
+// the server restarted and the missed events are gone. Events have to be
+// read, the connection stops reading responses while the channel is full.
+func (self *TcpClient) Subscribe(datasources []string, events []string, epoch string, since uint64) (<-chan Event, error) {
+	sub := &subscription{
+		datasources: datasources,
+		types:       events,
+		since:       since,
+		events:      make(chan Event, EVENT_BUFFER),
+		done:        make(chan bool),
+	}
+	sub.epoch.Store(epoch)
+	err := self.call("subscribe", sub, false, nil)
+	if nil != err {
+		self.lock.Lock()
+		if sub == self.subscription {
+			self.subscription = nil
+		}
+		self.lock.Unlock()
+		sub.close()
+		return nil, err
+	}
+	return sub.events, nil
+}
+
+// Unsubscribe stops the event stream and closes the events channel
+func (self *TcpClient) Unsubscribe() error {
+	self.lock.Lock()
+	sub := self.subscription
+	self.subscription = nil
+	self.lock.Unlock()
+	if nil != sub {
+		sub.close()
+	}
+	return self.call("unsubscribe", nil, true, nil)
+}
@@ -0,0 +1,267 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubRequest request received by the stub tcp server
+type stubRequest struct {
+	Id     int64           `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// stubTcpServer answers JSON-RPC requests with handle. Connections are
+// numbered from zero in the order they are accepted.
+type stubTcpServer struct {
+	listener net.Listener
+	handle   func(conn net.Conn, number int, req stubRequest)
+	lock     sync.Mutex
+	requests []stubRequest
+	conns    int
+}
+
+func newStubTcpServer(t *testing.T, handle func(conn net.Conn, number int, req stubRequest)) *stubTcpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	server := &stubTcpServer{listener: listener, handle: handle}
+	go server.serve()
+	return server
+}
+
+func (self *stubTcpServer) serve() {
+	for {
+		conn, err := self.listener.Accept()
+		if nil != err {
+			return
+		}
+		self.lock.Lock()
+		number := self.conns
+		self.conns++
+		self.lock.Unlock()
+		go self.read(conn, number)
+	}
+}
+
+func (self *stubTcpServer) read(conn net.Conn, number int) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if nil != err {
+			return
+		}
+		req := stubRequest{}
+		json.Unmarshal(line, &req)
+		self.lock.Lock()
+		self.requests = append(self.requests, req)
+		self.lock.Unlock()
+		self.handle(conn, number, req)
+	}
+}
+
+// received returns the requests received so far
+func (self *stubTcpServer) received() []stubRequest {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]stubRequest{}, self.requests...)
+}
+
+func (self *stubTcpServer) Close() {
+	self.listener.Close()
+}
+
+// stubReply writes a JSON-RPC result
+func stubReply(conn net.Conn, id int64, result string) {
+	conn.Write([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%v,"result":%v}`+"\n", id, result)))
+}
+
+// stubNotify writes a JSON-RPC notification
+func stubNotify(conn net.Conn, method string, params string) {
+	conn.Write([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","method":"%v","params":%v}`+"\n", method, params)))
+}
+
+// dialStub connects a client with short timeouts to the stub server
+func dialStub(t *testing.T, server *stubTcpServer) *TcpClient {
+	client, err := DialTcp(server.listener.Addr().String(), "", nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	client.Timeout = time.Second
+	client.RetryWait = time.Millisecond
+	return client
+}
+
+// Unittest TcpClient response, stream and event dispatch
+func TestTcpClientDispatch(t *testing.T) {
+	var first int64
+	server := newStubTcpServer(t, func(conn net.Conn, number int, req stubRequest) {
+		switch req.Method {
+		case "first":
+			first = req.Id
+		case "second":
+			// answer out of order
+			stubReply(conn, req.Id, `{"n":2}`)
+			stubReply(conn, first, `{"n":1}`)
+		case "export_datasource_by_range":
+			for i := 0; i < 2; i++ {
+				stubNotify(conn, "stream", fmt.Sprintf(`{"request":%v,"data":{"datasource_id":"a","timestamp":"%v","layer":null}}`, req.Id, i))
+			}
+			stubReply(conn, req.Id, `{"datasource_id":"a","snapshots":2}`)
+		case "subscribe":
+			stubReply(conn, req.Id, `{"subscribed":true,"epoch":"e1","sequence":0}`)
+			stubNotify(conn, "event", `{"epoch":"e1","sequence":1,"type":"layer_created","datasource":"a"}`)
+		}
+	})
+	defer server.Close()
+	client := dialStub(t, server)
+	defer client.Close()
+
+	results := make(chan string, 2)
+	go func() {
+		result := struct{ N int }{}
+		client.Call("first", nil, &result)
+		results <- fmt.Sprintf("first %v", result.N)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	result := struct{ N int }{}
+	err := client.Call("second", nil, &result)
+	if nil != err || 2 != result.N {
+		t.Errorf("Second call got the wrong response: %v %v", result, err)
+	}
+	if answer := <-results; "first 1" != answer {
+		t.Errorf("First call got the wrong response: %v", answer)
+	}
+
+	snapshots, err := client.ExportDatasourceByRange("a", 0, 1)
+	if nil != err || 2 != len(snapshots) || "1" != snapshots[1].Timestamp {
+		t.Errorf("Streamed snapshots not collected: %v %v", snapshots, err)
+	}
+
+	events, err := client.Subscribe(nil, nil, "", 0)
+	if nil != err {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if "e1" != event.Epoch || 1 != event.Sequence {
+			t.Errorf("Unexpected event: %v", event)
+		}
+	case <-time.After(time.Second):
+		t.Error("Event not delivered")
+	}
+}
+
+// Unittest TcpClient timeouts
+func TestTcpClientTimeout(t *testing.T) {
+	server := newStubTcpServer(t, func(conn net.Conn, number int, req stubRequest) {})
+	defer server.Close()
+	client := dialStub(t, server)
+	defer client.Close()
+	client.Timeout = 50 * time.Millisecond
+
+	_, err := client.Ping()
+	if ErrTimeout != err {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+	if 1 != len(server.received()) {
+		t.Errorf("Timed out call should not be retried: %v", server.received())
+	}
+	client.lock.Lock()
+	pending := len(client.pending)
+	client.lock.Unlock()
+	if 0 != pending {
+		t.Errorf("Timed out call left %v pending responses", pending)
+	}
+}
+
+// Unittest TcpClient reconnects and retries idempotent calls
+func TestTcpClientReconnect(t *testing.T) {
+	server := newStubTcpServer(t, func(conn net.Conn, number int, req stubRequest) {
+		// the first connection fails before answering
+		if 0 == number {
+			conn.Close()
+			return
+		}
+		stubReply(conn, req.Id, `{"message":"pong","version":"1.0"}`)
+	})
+	defer server.Close()
+	client := dialStub(t, server)
+	defer client.Close()
+
+	version, err := client.Ping()
+	if nil != err || "1.0" != version {
+		t.Errorf("Ping should be retried on a new connection: %v %v", version, err)
+	}
+
+	// fail the current connection as well
+	server.lock.Lock()
+	server.conns = 0
+	server.lock.Unlock()
+	client.lock.Lock()
+	client.conn.Close()
+	client.lock.Unlock()
+	time.Sleep(50 * time.Millisecond)
+
+	requests := len(server.received())
+	err = client.Call("create_apikey", nil, nil)
+	if _, ok := err.(connError); !ok {
+		t.Errorf("Expected connection error, got %v", err)
+	}
+	if requests+1 != len(server.received()) {
+		t.Error("Calls that aren't idempotent should not be retried")
+	}
+}
+
+// Unittest TcpClient resumes subscriptions after reconnecting
+func TestTcpClientResubscribe(t *testing.T) {
+	params := make(chan string, 2)
+	server := newStubTcpServer(t, func(conn net.Conn, number int, req stubRequest) {
+		if "subscribe" != req.Method {
+			return
+		}
+		params <- string(req.Params)
+		stubReply(conn, req.Id, `{"subscribed":true,"epoch":"e1","sequence":5}`)
+		stubNotify(conn, "event", fmt.Sprintf(`{"epoch":"e1","sequence":%v,"type":"layer_created"}`, 5+number))
+		if 0 == number {
+			conn.Close()
+		}
+	})
+	defer server.Close()
+	client := dialStub(t, server)
+	defer client.Close()
+
+	events, err := client.Subscribe(nil, []string{"layer_created"}, "", 0)
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, sequence := range []uint64{5, 6} {
+		select {
+		case event := <-events:
+			if sequence != event.Sequence {
+				t.Errorf("Expected event %v, got %v", sequence, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Event %v not delivered", sequence)
+		}
+	}
+
+	<-params
+	resumed := struct {
+		Events []string `json:"events"`
+		Epoch  string   `json:"epoch"`
+		Since  uint64   `json:"since"`
+	}{}
+	json.Unmarshal([]byte(<-params), &resumed)
+	if "e1" != resumed.Epoch || 5 != resumed.Since || 1 != len(resumed.Events) {
+		t.Errorf("Subscription not resumed after the last event: %v", resumed)
+	}
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// LayerSubscriber receives websocket messages of a layer. Messages are
+// read until Close is called or the socket fails, Err then returns the
+// reason and the Messages channel is closed.
+type LayerSubscriber struct {
+	Messages <-chan LayerMessage
+	ws       *websocket.Conn
+	lock     sync.Mutex
+	err      error
+	closed   bool
+}
+
+// SubscribeLayer opens the websocket of a layer, e.g. http://localhost:8080
+// connects to ws://localhost:8080/ws/{ds}
+func SubscribeLayer(server_url string, apikey string, datasource_id string) (*LayerSubscriber, error) {
+	u, err := url.Parse(strings.TrimRight(server_url, "/") + "/ws/" + url.PathEscape(datasource_id))
+	if nil != err {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	header := http.Header{}
+	if "" != apikey {
+		header.Set("X-API-Key", apikey)
+	}
+	ws, resp, err := websocket.DefaultDialer.Dial(u.String(), header)
+	if nil != err {
+		// the server answers rejected sockets with an api error
+		if nil != resp {
+			defer resp.Body.Close()
+			js, _ := ioutil.ReadAll(resp.Body)
+			if e := checkResponse(resp, js); nil != e {
+				return nil, e
+			}
+		}
+		return nil, err
+	}
+	messages := make(chan LayerMessage, EVENT_BUFFER)
+	subscriber := &LayerSubscriber{Messages: messages, ws: ws}
+	go subscriber.read(messages)
+	return subscriber, nil
+}
+
+// read delivers messages until the socket fails
+func (self *LayerSubscriber) read(messages chan LayerMessage) {
+	defer close(messages)
+	for {
+		_, js, err := self.ws.ReadMessage()
+		if nil != err {
+			self.lock.Lock()
+			// reads fail once Close closed the socket
+			if nil == self.err && !self.closed {
+				self.err = err
+			}
+			self.lock.Unlock()
+			return
+		}
+		msg := LayerMessage{}
+		json.Unmarshal(js, &msg)
+		msg.Raw = json.RawMessage(js)
+		messages <- msg
+	}
+}
+
+// Send relays a message to the other sockets of the layer. Requires the editor role.
+func (self *LayerSubscriber) Send(msg interface{}) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.ws.WriteJSON(msg)
+}
+
+// Err returns why the socket stopped, nil while it is open
+func (self *LayerSubscriber) Err() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if websocket.IsCloseError(self.err, websocket.CloseNormalClosure) {
+		return nil
+	}
+	return self.err
+}
+
+// Close closes the socket
+func (self *LayerSubscriber) Close() error {
+	self.lock.Lock()
+	self.closed = true
+	closing := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	self.ws.WriteMessage(websocket.CloseMessage, closing)
+	self.lock.Unlock()
+	return self.ws.Close()
+}
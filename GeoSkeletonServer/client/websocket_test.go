@@ -0,0 +1,78 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Unittest SubscribeLayer
+func TestSubscribeLayer(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "12dB6BlenIeB" != r.Header.Get("X-API-Key") {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"status":"error","message":"Unauthorized"}`))
+			return
+		}
+		if "/ws/a" != r.URL.Path {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if nil != err {
+			return
+		}
+		defer ws.Close()
+		ws.WriteMessage(websocket.TextMessage, []byte(`{"viewers":2}`))
+		// echo messages sent by the client
+		for {
+			kind, js, err := ws.ReadMessage()
+			if nil != err {
+				return
+			}
+			ws.WriteMessage(kind, js)
+		}
+	}))
+	defer server.Close()
+
+	_, err := SubscribeLayer(server.URL, "wrong", "a")
+	if e, ok := err.(HttpError); !ok || http.StatusUnauthorized != e.StatusCode || "Unauthorized" != e.Message {
+		t.Errorf("Rejected socket should return the api error: %v", err)
+	}
+
+	subscriber, err := SubscribeLayer(server.URL, "12dB6BlenIeB", "a")
+	if nil != err {
+		t.Fatal(err)
+	}
+	next := func() LayerMessage {
+		select {
+		case msg := <-subscriber.Messages:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("Message not delivered")
+		}
+		return LayerMessage{}
+	}
+
+	if msg := next(); 2 != msg.Viewers {
+		t.Errorf("Unexpected message: %v", string(msg.Raw))
+	}
+	err = subscriber.Send(map[string]bool{"update": true})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if msg := next(); !msg.Update {
+		t.Errorf("Unexpected message: %v", string(msg.Raw))
+	}
+
+	subscriber.Close()
+	for range subscriber.Messages {
+	}
+	if err := subscriber.Err(); nil != err {
+		t.Errorf("Closed socket should not report an error: %v", err)
+	}
+}
@@ -6,10 +6,13 @@ import (
 	"log"
 	"math"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 import (
+	"github.com/paulmach/go.geojson"
 	"github.com/sjsafranek/GeoSkeletonDB"
 	"github.com/sjsafranek/SkeletonDB"
 )
@@ -29,13 +32,17 @@ var (
 	DB              Database
 	GeoDB           geoskeleton.Database
 	COMMIT_LOG_FILE string = "api_commit.log"
+	GEO_DB_FILE     string = "geo.db"
+	API_DB_FILE     string = "api.db"
 )
 
 // Database strust for application.
 type Database struct {
-	File             string
-	commit_log_queue chan string
-	DB               skeleton.Database
+	File               string
+	commit_log_queue   chan string
+	commit_log_pending *sync.WaitGroup
+	replay_committed   int64
+	DB                 skeleton.Database
 }
 
 // Init creates bolt database if existing one not found.
@@ -44,22 +51,23 @@ type Database struct {
 func (self *Database) Init() error {
 
 	// start commit log
+	self.commit_log_queue = make(chan string, 10000)
+	self.commit_log_pending = &sync.WaitGroup{}
 	go self.StartCommitLog()
 
 	// create database if not exists
-	self.DB = skeleton.Database{File: "api.db"}
+	self.DB = skeleton.Database{File: API_DB_FILE}
 	self.DB.Init()
 
 	// connect to db
 	conn := self.DB.Connect()
-	defer conn.Close()
 	// datasources
 	err := self.DB.CreateTable(conn, "layers")
 	if err != nil {
 		panic(err)
 	}
 
-	GeoDB = geoskeleton.NewGeoSkeletonDB("geo.db")
+	GeoDB = geoskeleton.NewGeoSkeletonDB(GEO_DB_FILE)
 	go GeoDB.StartCommitLog()
 
 	// Add table for datasource owner
@@ -68,13 +76,68 @@ func (self *Database) Init() error {
 	if err != nil {
 		panic(err)
 	}
-	// close and return err
-	return err
+
+	// apikeys held by customers
+	err = self.DB.CreateTable(conn, "keys")
+	if err != nil {
+		panic(err)
+	}
+
+	// last used times of apikeys
+	err = self.DB.CreateTable(conn, "key_usage")
+	if err != nil {
+		panic(err)
+	}
+
+	// close before migrations open their own connections
+	conn.Close()
+
+	// hash apikeys of customers stored under their plaintext apikey
+	err = self.MigrateApikeys()
+	if err != nil {
+		return err
+	}
+
+	// index apikeys saved before lookups used their prefix
+	err = self.ReindexApikeys()
+	if err != nil {
+		return err
+	}
+
+	// assign roles to customers created before datasource roles
+	return self.MigrateCustomerRoles()
+}
+
+// MigrateCustomerRoles makes customers owners of datasources assigned without a role
+// @returns Error
+func (self *Database) MigrateCustomerRoles() error {
+	customers, err := self.GetCustomers()
+	if err != nil {
+		return err
+	}
+	for _, value := range customers {
+		customer := Customer{}
+		err = json.Unmarshal([]byte(value), &customer)
+		if err != nil {
+			ServerLogger.Warn("Unable to migrate customer: ", err)
+			continue
+		}
+		if customer.migrateRoles() {
+			err = self.InsertCustomer(customer)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // Starts Database commit log
 func (self *Database) StartCommitLog() {
-	self.commit_log_queue = make(chan string, 10000)
+	if nil == self.commit_log_queue {
+		self.commit_log_queue = make(chan string, 10000)
+		self.commit_log_pending = &sync.WaitGroup{}
+	}
 	// open file to write database commit log
 	COMMIT_LOG, err := os.OpenFile(COMMIT_LOG_FILE, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
@@ -88,12 +151,44 @@ func (self *Database) StartCommitLog() {
 			if _, err := COMMIT_LOG.WriteString(line + "\n"); err != nil {
 				panic(err)
 			}
+			self.commit_log_pending.Done()
 		} else {
 			time.Sleep(1000 * time.Millisecond)
 		}
 	}
 }
 
+// commit queues a commit log line stamped with the time it was committed,
+// restores can stop at a point in time using the stamp. Lines written while
+// a restore replays a stamped line keep the original commit time, requests
+// of other clients are refused until the restore ends.
+// @param line {string} json object
+func (self *Database) commit(line string) {
+	committed := atomic.LoadInt64(&self.replay_committed)
+	if 0 == committed {
+		committed = time.Now().UnixNano()
+	}
+	self.commit_log_pending.Add(1)
+	self.commit_log_queue <- fmt.Sprintf(`{"committed": %v, %v`, committed, line[1:])
+}
+
+// FlushCommitLog waits until the queued commit log lines are written
+// @param timeout {time.Duration}
+// @returns Error
+func (self *Database) FlushCommitLog(timeout time.Duration) error {
+	done := make(chan bool)
+	go func() {
+		self.commit_log_pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("%v commit log lines not written after %v", self.CommitQueueLength(), timeout)
+	}
+}
+
 // CommitQueueLength returns length of database commit_log_queue
 // @returns int
 func (self *Database) CommitQueueLength() int {
@@ -104,32 +199,80 @@ func (self *Database) CommitQueueLength() int {
 // @param customer {Customer}
 // @returns Error
 func (self *Database) InsertCustomer(customer Customer) error {
+	if "" == customer.Id {
+		return fmt.Errorf("Customer id missing")
+	}
 	value, err := json.Marshal(customer)
 	if err != nil {
 		return err
 	}
-	self.commit_log_queue <- `{"method": "insert_apikey", "data":` + string(value) + `}`
+	self.commit(`{"method": "insert_apikey", "data":` + string(value) + `}`)
 	// Insert customer into database
-	err = self.DB.Insert("apikeys", customer.Apikey, value)
+	err = self.DB.Insert("apikeys", customer.Id, value)
+	resetDatasourceOwners()
 	if err != nil {
 		panic(err)
 	}
 	return err
 }
 
+// customerLocks serializes read-modify-write updates of a customer
+var customerLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+// lockCustomer locks a customer for updating and returns the matching unlock function
+func lockCustomer(customer_id string) func() {
+	customerLocks.Lock()
+	lock, ok := customerLocks.locks[customer_id]
+	if !ok {
+		lock = &sync.Mutex{}
+		customerLocks.locks[customer_id] = lock
+	}
+	customerLocks.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// UpdateCustomer reads a customer, applies an update and saves the customer
+// when the update changed it. Updates of the same customer are serialized,
+// so concurrent requests can't overwrite each other's changes.
+// @param customer_id {string} customer id or apikey
+// @param update {func(*Customer) bool} returns true if the customer changed
+// @returns Customer
+// @returns Error
+func (self *Database) UpdateCustomer(customer_id string, update func(*Customer) bool) (Customer, error) {
+	customer, err := self.LookupCustomer(customer_id)
+	if err != nil {
+		return Customer{}, err
+	}
+	unlock := lockCustomer(customer.Id)
+	defer unlock()
+	// re-read holding the lock
+	customer, err = self.GetCustomer(customer.Id)
+	if err != nil {
+		return Customer{}, err
+	}
+	if !update(&customer) {
+		return customer, nil
+	}
+	return customer, self.InsertCustomer(customer)
+}
+
 // GetCustomer returns customer from database
-// @param apikey {string}
+// @param customer_id {string}
 // @returns Customer
 // @returns Error
-func (self *Database) GetCustomer(apikey string) (Customer, error) {
+func (self *Database) GetCustomer(customer_id string) (Customer, error) {
 	// If customer not found get from database
-	val, err := self.DB.Select("apikeys", apikey)
+	val, err := self.DB.Select("apikeys", customer_id)
 	if err != nil {
 		panic(err)
 	}
 	// datasource not found
 	if "" == string(val) {
-		return Customer{}, fmt.Errorf("Apikey not found")
+		return Customer{}, fmt.Errorf("Customer not found")
 	}
 	// Read to struct
 	customer := Customer{}
@@ -141,6 +284,23 @@ func (self *Database) GetCustomer(apikey string) (Customer, error) {
 	return customer, nil
 }
 
+// DeleteCustomer removes customer and their apikeys from the database
+// @param customer_id {string}
+// @returns Error
+func (self *Database) DeleteCustomer(customer_id string) error {
+	err := self.deleteCustomerApikeys(customer_id)
+	if err != nil {
+		return err
+	}
+	self.commit(`{"method": "delete_apikey", "apikey":"` + customer_id + `"}`)
+	err = self.deleteRecords("apikeys", customer_id)
+	resetDatasourceOwners()
+	if nil == err {
+		publishApikeyEvent(EVENT_APIKEY_DELETED, customer_id, "")
+	}
+	return err
+}
+
 func (self *Database) GetCustomers() ([]string, error) {
 	// If customer not found get from database
 	val, err := self.DB.SelectAll("apikeys")
@@ -149,3 +309,224 @@ func (self *Database) GetCustomers() ([]string, error) {
 	}
 	return val, nil
 }
+
+// GetLayerMeta returns layer metadata from the layers table
+// @param datasource_id {string}
+// @returns LayerMeta
+// @returns Error
+func (self *Database) GetLayerMeta(datasource_id string) (LayerMeta, error) {
+	val, err := self.DB.Select("layers", datasource_id)
+	if err != nil {
+		return LayerMeta{}, err
+	}
+	meta := LayerMeta{Datasource: datasource_id}
+	// no metadata stored for layer
+	if "" == string(val) {
+		return meta, nil
+	}
+	err = json.Unmarshal(val, &meta)
+	return meta, err
+}
+
+// InsertLayerMeta inserts layer metadata into layers table
+// @param meta {LayerMeta}
+// @returns Error
+func (self *Database) InsertLayerMeta(meta LayerMeta) error {
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	self.commit(`{"method": "insert_layer_meta", "data":` + string(value) + `}`)
+	return self.DB.Insert("layers", meta.Datasource, value)
+}
+
+// layerCommit commit log line of a layer or feature write, replayed
+// through the tcp method of the same name
+type layerCommit struct {
+	Method     string                     `json:"method"`
+	Datasource string                     `json:"datasource"`
+	GeoId      string                     `json:"geo_id,omitempty"`
+	Layer      *geojson.FeatureCollection `json:"layer,omitempty"`
+	Feature    *geojson.Feature           `json:"feature,omitempty"`
+}
+
+// commitLayer queues a layer write. Layer writes are committed once they
+// succeeded, a replay of a failed write would fail the restore.
+// @param line {layerCommit}
+// @returns Error
+func (self *Database) commitLayer(line layerCommit) error {
+	value, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	self.commit(string(value))
+	return nil
+}
+
+// NewLayer creates an empty layer in GeoDB
+// @returns string datasource_id
+// @returns Error
+func (self *Database) NewLayer() (string, error) {
+	datasource_id, err := GeoDB.NewLayer()
+	if err != nil {
+		return datasource_id, err
+	}
+	lyr, err := GeoDB.GetLayer(datasource_id)
+	if err != nil {
+		return datasource_id, err
+	}
+	if nil == lyr {
+		lyr = geojson.NewFeatureCollection()
+	}
+	return datasource_id, self.commitLayer(layerCommit{Method: "insert_layer", Datasource: datasource_id, Layer: lyr})
+}
+
+// InsertLayer saves a layer in GeoDB, replacing a stored layer
+// @param datasource_id {string}
+// @param lyr {*geojson.FeatureCollection}
+// @returns Error
+func (self *Database) InsertLayer(datasource_id string, lyr *geojson.FeatureCollection) error {
+	err := GeoDB.InsertLayer(datasource_id, lyr)
+	if err != nil {
+		return err
+	}
+	return self.commitLayer(layerCommit{Method: "insert_layer", Datasource: datasource_id, Layer: lyr})
+}
+
+// DeleteLayer deletes a layer from GeoDB and removes it from the
+// customers it is assigned to
+// @param datasource_id {string}
+// @returns Error
+func (self *Database) DeleteLayer(datasource_id string) error {
+	err := GeoDB.DeleteLayer(datasource_id)
+	if err != nil {
+		return err
+	}
+	err = self.commitLayer(layerCommit{Method: "delete_layer", Datasource: datasource_id})
+	if err != nil {
+		return err
+	}
+	roles, err := self.GetDatasourceRoles(datasource_id)
+	if err != nil {
+		return err
+	}
+	for customer_id := range roles {
+		_, err = self.UpdateCustomer(customer_id, func(customer *Customer) bool {
+			return customer.applyRole(datasource_id, "")
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertFeature adds a feature to a layer in GeoDB
+// @param datasource_id {string}
+// @param feat {*geojson.Feature}
+// @returns Error
+func (self *Database) InsertFeature(datasource_id string, feat *geojson.Feature) error {
+	err := GeoDB.InsertFeature(datasource_id, feat)
+	if err != nil {
+		return err
+	}
+	return self.commitLayer(layerCommit{Method: "insert_feature", Datasource: datasource_id, Feature: feat})
+}
+
+// EditFeature replaces a feature of a layer in GeoDB
+// @param datasource_id {string}
+// @param geo_id {string}
+// @param feat {*geojson.Feature}
+// @returns Error
+func (self *Database) EditFeature(datasource_id string, geo_id string, feat *geojson.Feature) error {
+	err := GeoDB.EditFeature(datasource_id, geo_id, feat)
+	if err != nil {
+		return err
+	}
+	return self.commitLayer(layerCommit{Method: "edit_feature", Datasource: datasource_id, GeoId: geo_id, Feature: feat})
+}
+
+// GetDatasourceRoles returns the roles of the customers assigned a datasource
+// @param datasource_id {string}
+// @returns map[string]string customer ids and their roles
+// @returns Error
+func (self *Database) GetDatasourceRoles(datasource_id string) (map[string]string, error) {
+	values, err := self.GetCustomers()
+	if err != nil {
+		return nil, err
+	}
+	roles := make(map[string]string)
+	for _, value := range values {
+		customer := Customer{}
+		err = json.Unmarshal([]byte(value), &customer)
+		if err != nil {
+			return nil, err
+		}
+		if role := customer.getRole(datasource_id); "" != role {
+			roles[customer.Id] = role
+		}
+	}
+	return roles, nil
+}
+
+// IsPublicLayer checks if layer can be read without an apikey
+// @param datasource_id {string}
+// @returns bool
+func (self *Database) IsPublicLayer(datasource_id string) bool {
+	meta, err := self.GetLayerMeta(datasource_id)
+	return nil == err && meta.Public
+}
+
+// GetLayerShares returns customers with access to a datasource
+// @param datasource_id {string}
+// @returns []LayerShare
+// @returns Error
+func (self *Database) GetLayerShares(datasource_id string) ([]LayerShare, error) {
+	customers, err := self.GetCustomers()
+	if err != nil {
+		return nil, err
+	}
+	shares := []LayerShare{}
+	for _, value := range customers {
+		customer := Customer{}
+		err = json.Unmarshal([]byte(value), &customer)
+		if err != nil {
+			return nil, err
+		}
+		if customer.hasDatasource(datasource_id) {
+			shares = append(shares, LayerShare{Customer: customer.Id, Role: customer.getRole(datasource_id)})
+		}
+	}
+	return shares, nil
+}
+
+// GetDatasourceOwners returns all layers and the customers owning them
+// @returns map[string][]string
+// @returns Error
+func (self *Database) GetDatasourceOwners() (map[string][]string, error) {
+	layers, err := GeoDB.GetLayers()
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string][]string)
+	for _, datasource_id := range layers {
+		owners[datasource_id] = []string{}
+	}
+	customers, err := self.GetCustomers()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range customers {
+		customer := Customer{}
+		err = json.Unmarshal([]byte(value), &customer)
+		if err != nil {
+			return nil, err
+		}
+		for _, datasource_id := range customer.Datasources {
+			if _, ok := owners[datasource_id]; ok && customer.hasRole(datasource_id, ROLE_OWNER) {
+				owners[datasource_id] = append(owners[datasource_id], customer.Id)
+			}
+		}
+	}
+	return owners, nil
+}
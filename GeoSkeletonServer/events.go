@@ -0,0 +1,270 @@
+package geo_skeleton_server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"./utils"
+	"github.com/paulmach/go.geojson"
+)
+
+// Event types
+const (
+	EVENT_FEATURE_INSERTED = "feature_inserted"
+	EVENT_FEATURE_EDITED   = "feature_edited"
+	EVENT_FEATURE_DELETED  = "feature_deleted"
+	EVENT_LAYER_CREATED    = "layer_created"
+	EVENT_LAYER_DELETED    = "layer_deleted"
+	EVENT_LAYER_RESTORED   = "layer_restored"
+	EVENT_APIKEY_CREATED   = "apikey_created"
+	EVENT_APIKEY_ROTATED   = "apikey_rotated"
+	EVENT_APIKEY_REVOKED   = "apikey_revoked"
+	EVENT_APIKEY_DELETED   = "apikey_deleted"
+)
+
+// EVENT_HISTORY_SIZE events kept so subscribers can resume
+const EVENT_HISTORY_SIZE = 1000
+
+// EVENT_SUBSCRIBER_BUFFER events queued per subscriber before it is dropped
+const EVENT_SUBSCRIBER_BUFFER = 256
+
+var eventTypes = map[string]bool{
+	EVENT_FEATURE_INSERTED: true,
+	EVENT_FEATURE_EDITED:   true,
+	EVENT_FEATURE_DELETED:  true,
+	EVENT_LAYER_CREATED:    true,
+	EVENT_LAYER_DELETED:    true,
+	EVENT_LAYER_RESTORED:   true,
+	EVENT_APIKEY_CREATED:   true,
+	EVENT_APIKEY_ROTATED:   true,
+	EVENT_APIKEY_REVOKED:   true,
+	EVENT_APIKEY_DELETED:   true,
+}
+
+// Event change published to subscribers. Sequence numbers increase by one
+// per event and start over when the server restarts, the epoch changes
+// with every start so sequence numbers of different runs can't be mixed up.
+type Event struct {
+	Epoch      string `json:"epoch"`
+	Sequence   uint64 `json:"sequence"`
+	Type       string `json:"type"`
+	Datasource string `json:"datasource,omitempty"`
+	GeoId      string `json:"geo_id,omitempty"`
+	Customer   string `json:"customer,omitempty"`
+	KeyId      string `json:"key_id,omitempty"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// EventFilter selects the events sent to a subscriber. Empty filters match everything.
+// Apikey events have no datasource and are skipped when datasources are filtered.
+type EventFilter struct {
+	Datasources map[string]bool
+	Types       map[string]bool
+}
+
+// NewEventFilter builds a filter from datasource ids and event types
+// @param datasources {[]string}
+// @param types {[]string}
+// @returns EventFilter
+// @returns Error
+func NewEventFilter(datasources []string, types []string) (EventFilter, error) {
+	filter := EventFilter{}
+	if 0 != len(datasources) {
+		filter.Datasources = make(map[string]bool)
+		for _, datasource_id := range datasources {
+			filter.Datasources[datasource_id] = true
+		}
+	}
+	if 0 != len(types) {
+		filter.Types = make(map[string]bool)
+		for _, event_type := range types {
+			if !eventTypes[event_type] {
+				return filter, fmt.Errorf("Invalid event type: %v", event_type)
+			}
+			filter.Types[event_type] = true
+		}
+	}
+	return filter, nil
+}
+
+func (self EventFilter) matches(event Event) bool {
+	if nil != self.Types && !self.Types[event.Type] {
+		return false
+	}
+	if nil != self.Datasources && !self.Datasources[event.Datasource] {
+		return false
+	}
+	return true
+}
+
+// eventSubscriber receives matching events. The events channel is closed
+// when the subscriber unsubscribes or falls too far behind.
+type eventSubscriber struct {
+	filter  EventFilter
+	events  chan Event
+	dropped bool
+}
+
+// eventBus assigns sequence numbers to events and fans them out to subscribers.
+// While held, layer and feature events are queued until they are released.
+type eventBus struct {
+	sync.Mutex
+	epoch       string
+	sequence    uint64
+	history     []Event
+	subscribers map[*eventSubscriber]bool
+	holding     bool
+	held        []Event
+}
+
+// Events publishes layer, feature and apikey changes
+var Events = newEventBus()
+
+// newEventBus creates an event bus with a new epoch
+func newEventBus() *eventBus {
+	epoch, _ := utils.NewUUID()
+	return &eventBus{epoch: epoch, subscribers: make(map[*eventSubscriber]bool)}
+}
+
+// publish sends an event to every matching subscriber. Subscribers that
+// can't keep up are dropped instead of blocking the writer.
+func (self *eventBus) publish(event Event) {
+	self.Lock()
+	defer self.Unlock()
+	if self.holding && "" != event.Datasource {
+		self.held = append(self.held, event)
+		return
+	}
+	self.send(event)
+}
+
+// hold queues layer and feature events until release is called.
+// Used by batches so subscribers don't see steps that are rolled back.
+func (self *eventBus) hold() {
+	self.Lock()
+	defer self.Unlock()
+	self.holding = true
+}
+
+// release publishes the queued events, except those of discarded datasources
+// @param discard {map[string]bool} datasources whose events are dropped
+func (self *eventBus) release(discard map[string]bool) {
+	self.Lock()
+	defer self.Unlock()
+	for _, event := range self.held {
+		if !discard[event.Datasource] {
+			self.send(event)
+		}
+	}
+	self.holding = false
+	self.held = nil
+}
+
+// send numbers an event and sends it to every matching subscriber.
+// Must be called holding the lock.
+func (self *eventBus) send(event Event) {
+	event.Epoch = self.epoch
+	self.sequence++
+	event.Sequence = self.sequence
+	event.Timestamp = time.Now().UnixNano()
+	self.history = append(self.history, event)
+	if EVENT_HISTORY_SIZE < len(self.history) {
+		self.history = self.history[len(self.history)-EVENT_HISTORY_SIZE:]
+	}
+	for subscriber := range self.subscribers {
+		if !subscriber.filter.matches(event) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			NetworkLogger.Warn("Dropping slow event subscriber at sequence ", event.Sequence)
+			delete(self.subscribers, subscriber)
+			subscriber.dropped = true
+			close(subscriber.events)
+		}
+	}
+}
+
+// subscribe registers a subscriber. When since is set the matching events
+// published after that sequence number are returned to be sent first.
+// Since has to come with the epoch it was received in.
+// @param filter {EventFilter}
+// @param epoch {string}
+// @param since {uint64}
+// @returns *eventSubscriber
+// @returns []Event missed events
+// @returns uint64 current sequence number
+// @returns Error
+func (self *eventBus) subscribe(filter EventFilter, epoch string, since uint64) (*eventSubscriber, []Event, uint64, error) {
+	self.Lock()
+	defer self.Unlock()
+	missed := []Event{}
+	if 0 != since {
+		if "" == epoch {
+			return nil, missed, self.sequence, fmt.Errorf("Epoch required with since, current epoch is %v", self.epoch)
+		}
+		if epoch != self.epoch {
+			return nil, missed, self.sequence, fmt.Errorf("Events of epoch %v are no longer available, current epoch is %v", epoch, self.epoch)
+		}
+		if since > self.sequence {
+			return nil, missed, self.sequence, fmt.Errorf("Unknown sequence %v, current sequence is %v", since, self.sequence)
+		}
+		if 0 != len(self.history) && since+1 < self.history[0].Sequence {
+			return nil, missed, self.sequence, fmt.Errorf("Events after sequence %v are no longer available", since)
+		}
+		for _, event := range self.history {
+			if event.Sequence > since && filter.matches(event) {
+				missed = append(missed, event)
+			}
+		}
+	}
+	subscriber := &eventSubscriber{filter: filter, events: make(chan Event, EVENT_SUBSCRIBER_BUFFER)}
+	self.subscribers[subscriber] = true
+	return subscriber, missed, self.sequence, nil
+}
+
+// unsubscribe removes a subscriber and closes its events channel
+func (self *eventBus) unsubscribe(subscriber *eventSubscriber) {
+	self.Lock()
+	defer self.Unlock()
+	if self.subscribers[subscriber] {
+		delete(self.subscribers, subscriber)
+		close(subscriber.events)
+	}
+}
+
+// publishLayerEvent publishes a layer change
+func publishLayerEvent(event_type string, datasource_id string) {
+	Events.publish(Event{Type: event_type, Datasource: datasource_id})
+}
+
+// publishFeatureEvent publishes a feature change
+func publishFeatureEvent(event_type string, datasource_id string, feat *geojson.Feature) {
+	geo_id := ""
+	if nil != feat {
+		if value, ok := feat.Properties["geo_id"]; ok {
+			geo_id = fmt.Sprintf("%v", value)
+		}
+	}
+	Events.publish(Event{Type: event_type, Datasource: datasource_id, GeoId: geo_id})
+}
+
+// publishLayerDiff publishes the feature changes made by replacing a layer
+func publishLayerDiff(datasource_id string, diff LayerDiff) {
+	for _, feat := range diff.Added {
+		publishFeatureEvent(EVENT_FEATURE_INSERTED, datasource_id, feat)
+	}
+	for _, change := range diff.Modified {
+		Events.publish(Event{Type: EVENT_FEATURE_EDITED, Datasource: datasource_id, GeoId: change.GeoId})
+	}
+	for _, feat := range diff.Removed {
+		publishFeatureEvent(EVENT_FEATURE_DELETED, datasource_id, feat)
+	}
+}
+
+// publishApikeyEvent publishes an apikey change
+func publishApikeyEvent(event_type string, customer_id string, key_id string) {
+	Events.publish(Event{Type: event_type, Customer: customer_id, KeyId: key_id})
+}
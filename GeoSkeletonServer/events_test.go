@@ -0,0 +1,82 @@
+package geo_skeleton_server
+
+import (
+	"testing"
+)
+
+// Unittest eventBus subscribe
+func TestEventBusSubscribe(t *testing.T) {
+	bus := newEventBus()
+	bus.publish(Event{Type: EVENT_LAYER_CREATED, Datasource: "a"})
+	bus.publish(Event{Type: EVENT_LAYER_CREATED, Datasource: "b"})
+
+	filter, err := NewEventFilter([]string{"a"}, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	subscriber, missed, sequence, err := bus.subscribe(filter, "", 0)
+	if nil != err || 0 != len(missed) || 2 != sequence {
+		t.Errorf("Subscribe without since should not replay events: %v %v %v", missed, sequence, err)
+	}
+
+	bus.publish(Event{Type: EVENT_FEATURE_INSERTED, Datasource: "b"})
+	bus.publish(Event{Type: EVENT_FEATURE_INSERTED, Datasource: "a"})
+	event := <-subscriber.events
+	if 4 != event.Sequence || "a" != event.Datasource {
+		t.Errorf("Filtered event not received: %v", event)
+	}
+	bus.unsubscribe(subscriber)
+	bus.unsubscribe(subscriber)
+
+	_, missed, _, err = bus.subscribe(EventFilter{}, bus.epoch, 1)
+	if nil != err || 3 != len(missed) || 2 != missed[0].Sequence {
+		t.Errorf("Events after since not replayed: %v %v", missed, err)
+	}
+
+	_, _, _, err = bus.subscribe(EventFilter{}, bus.epoch, 5)
+	if nil == err {
+		t.Error("Unknown sequence should fail")
+	}
+
+	_, _, _, err = bus.subscribe(EventFilter{}, "", 1)
+	if nil == err {
+		t.Error("Since without epoch should fail")
+	}
+
+	restarted := newEventBus()
+	for i := 0; i < 4; i++ {
+		restarted.publish(Event{Type: EVENT_LAYER_CREATED, Datasource: "a"})
+	}
+	_, _, _, err = restarted.subscribe(EventFilter{}, bus.epoch, 1)
+	if nil == err {
+		t.Error("Since from another epoch should fail")
+	}
+
+	_, err = NewEventFilter(nil, []string{"feature_moved"})
+	if nil == err {
+		t.Error("Invalid event type should fail")
+	}
+}
+
+// Unittest eventBus hold and release
+func TestEventBusHold(t *testing.T) {
+	bus := newEventBus()
+	bus.hold()
+	bus.publish(Event{Type: EVENT_LAYER_CREATED, Datasource: "a"})
+	bus.publish(Event{Type: EVENT_LAYER_CREATED, Datasource: "b"})
+	bus.publish(Event{Type: EVENT_APIKEY_CREATED, Customer: "c"})
+	if 1 != bus.sequence {
+		t.Errorf("Only apikey events should be published while held, sequence %v", bus.sequence)
+	}
+
+	bus.release(map[string]bool{"a": true})
+	_, missed, sequence, err := bus.subscribe(EventFilter{}, bus.epoch, 1)
+	if nil != err || 2 != sequence || 1 != len(missed) || "b" != missed[0].Datasource {
+		t.Errorf("Discarded events should be dropped: %v %v %v", missed, sequence, err)
+	}
+
+	bus.publish(Event{Type: EVENT_LAYER_DELETED, Datasource: "a"})
+	if 3 != bus.sequence {
+		t.Error("Events should be published after release")
+	}
+}
@@ -27,7 +27,7 @@ func NewFeatureHandler(w http.ResponseWriter, r *http.Request) {
 			return []byte{}, err
 		}
 
-		if customer.hasDatasource(datasource_id) {
+		if customer.hasRole(datasource_id, ROLE_EDITOR) {
 
 			body, err := job.GetRequestBody()
 			if nil != err {
@@ -39,10 +39,21 @@ func NewFeatureHandler(w http.ResponseWriter, r *http.Request) {
 				return []byte{}, err
 			}
 
-			err = GeoDB.InsertFeature(datasource_id, feat)
+			// count the layer and insert holding the lock so concurrent inserts can't exceed the quota
+			unlock := lockLayer(datasource_id)
+			defer unlock()
+
+			err = job.CheckFeatureQuota(datasource_id, 1, int64(len(body)))
+			if err != nil {
+				return []byte{}, err
+			}
+
+			err = DB.InsertFeature(datasource_id, feat)
 			if err != nil {
 				return []byte{}, err
 			}
+			addDatasourceUsage(datasource_id, Usage{Features: 1, Bytes: int64(len(body))})
+			publishFeatureEvent(EVENT_FEATURE_INSERTED, datasource_id, feat)
 
 			data := HttpMessageResponse{Status: "success", Datasource: datasource_id, Data: "feature added"}
 			js := job.MarshalJsonFromStruct(data)
@@ -62,6 +73,7 @@ func NewFeatureHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // ViewFeatureHandler finds feature in layer via array index. Returns feature geojson.
+// The feature version is returned in the ETag header. Replies 304 if the client version is current.
 // @param apikey customer id
 // @oaram ds datasource uuid
 // @return feature geojson
@@ -69,17 +81,17 @@ func ViewFeatureHandler(w http.ResponseWriter, r *http.Request) {
 	job := HttpRequest{w: w, r: r}
 	js, err := func() ([]byte, error) {
 
-		customer, err := job.GetCustomer()
+		datasource_id, err := job.GetDatasource()
 		if nil != err {
 			return []byte{}, err
 		}
 
-		datasource_id, err := job.GetDatasource()
+		customer, err := job.GetViewer(datasource_id)
 		if nil != err {
 			return []byte{}, err
 		}
 
-		if customer.hasDatasource(datasource_id) {
+		if customer.hasRole(datasource_id, ROLE_VIEWER) {
 
 			data, err := GeoDB.GetLayer(datasource_id)
 			if err != nil {
@@ -95,6 +107,17 @@ func ViewFeatureHandler(w http.ResponseWriter, r *http.Request) {
 				geo_id := fmt.Sprintf("%v", v.Properties["geo_id"])
 				if geo_id == feat_id {
 					js, err := v.MarshalJSON()
+					if err != nil {
+						return []byte{}, err
+					}
+					version := hashVersion(js)
+					job.SetVersion(version)
+					if modified, ok := GetFeatureLastModified(v); ok {
+						job.SetLastModified(modified)
+					}
+					if job.NotModified(version) {
+						return []byte{}, nil
+					}
 					return js, err
 				}
 			}
@@ -115,6 +138,7 @@ func ViewFeatureHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // EditFeatureHandler finds feature in layer via array index. Edits feature.
+// Honours the If-Match header against the current feature version.
 // @param apikey customer id
 // @oaram ds datasource uuid
 func EditFeatureHandler(w http.ResponseWriter, r *http.Request) {
@@ -131,7 +155,7 @@ func EditFeatureHandler(w http.ResponseWriter, r *http.Request) {
 			return []byte{}, err
 		}
 
-		if customer.hasDatasource(datasource_id) {
+		if customer.hasRole(datasource_id, ROLE_EDITOR) {
 
 			body, err := job.GetRequestBody()
 			if nil != err {
@@ -148,11 +172,47 @@ func EditFeatureHandler(w http.ResponseWriter, r *http.Request) {
 				return []byte{}, err
 			}
 
-			err = GeoDB.EditFeature(datasource_id, geo_id, feat)
+			unlock := lockLayer(datasource_id)
+			defer unlock()
+
+			stored, err := GetStoredFeature(datasource_id, geo_id)
+			if err != nil {
+				return []byte{}, err
+			}
+
+			version, err := GetFeatureVersion(stored)
+			if err != nil {
+				return []byte{}, err
+			}
+
+			err = job.CheckIfMatch(version)
 			if err != nil {
 				return []byte{}, err
 			}
 
+			// only the size difference to the stored feature counts against the quota
+			added, err := getFeatureSizeDifference(stored, feat)
+			if err != nil {
+				return []byte{}, err
+			}
+
+			err = job.CheckFeatureQuota(datasource_id, 0, added)
+			if err != nil {
+				return []byte{}, err
+			}
+
+			err = DB.EditFeature(datasource_id, geo_id, feat)
+			if err != nil {
+				return []byte{}, err
+			}
+			addDatasourceUsage(datasource_id, Usage{Bytes: added})
+			Events.publish(Event{Type: EVENT_FEATURE_EDITED, Datasource: datasource_id, GeoId: geo_id})
+
+			version, err = GetStoredFeatureVersion(datasource_id, geo_id)
+			if err == nil {
+				job.SetVersion(version)
+			}
+
 			data := HttpMessageResponse{Status: "success", Datasource: datasource_id, Data: "feature edited"}
 			js := job.MarshalJsonFromStruct(data)
 			return js, err
@@ -167,3 +227,64 @@ func EditFeatureHandler(w http.ResponseWriter, r *http.Request) {
 
 	job.SendJsonResponse(js)
 }
+
+// ViewFeatureHistoryHandler returns every distinct version of a feature found in the layer timeseries.
+// When as_of is supplied the feature is returned as it was stored at that timestamp.
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @param as_of timestamp
+// @return json
+func ViewFeatureHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+
+		datasource_id, err := job.GetDatasource()
+		if nil != err {
+			return []byte{}, err
+		}
+
+		customer, err := job.GetViewer(datasource_id)
+		if nil != err {
+			return []byte{}, err
+		}
+
+		if customer.hasRole(datasource_id, ROLE_VIEWER) {
+
+			geo_id, err := job.GetFeatureId()
+			if err != nil {
+				return []byte{}, err
+			}
+
+			ts, ok, err := job.GetAsOfTimestamp()
+			if err != nil {
+				return []byte{}, err
+			}
+
+			if ok {
+				feat, err := GetFeatureAtTimestamp(datasource_id, geo_id, ts)
+				if err != nil {
+					return []byte{}, err
+				}
+				js, err := feat.MarshalJSON()
+				return js, err
+			}
+
+			versions, err := GetFeatureHistory(datasource_id, geo_id)
+			if err != nil {
+				return []byte{}, err
+			}
+
+			data := HttpMessageResponse{Status: "success", Datasource: datasource_id, Data: versions}
+			js := job.MarshalJsonFromStruct(data)
+			return js, err
+		}
+		return []byte{}, fmt.Errorf(`Unauthorized`)
+	}()
+
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+
+	job.SendJsonResponse(js)
+}
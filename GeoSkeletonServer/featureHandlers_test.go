@@ -0,0 +1,46 @@
+package geo_skeleton_server
+
+import (
+	"sync"
+	"testing"
+)
+
+// Unittest NewFeatureHandler quota checks
+func TestNewFeatureHandlerQuota(t *testing.T) {
+	setupTestDb(t)
+	datasource_id, err := DB.NewLayer()
+	if nil != err {
+		t.Fatal(err)
+	}
+	owner, apikey := newTestCustomer(t, datasource_id, ROLE_OWNER)
+	defer func(limits LimitsConfig) { Limits = limits }(Limits)
+	Limits = LimitsConfig{Customers: map[string]CustomerLimits{owner.Id: {Quota: &Quota{MaxFeatures: 3}}}}
+
+	// concurrent inserts must not get past the quota
+	var wg sync.WaitGroup
+	results := make([]HttpMessageResponse, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, results[i] = serveTestRequest(NewFeatureHandler, "/api/v1/layer/{ds}/feature", "POST", "/api/v1/layer/"+datasource_id+"/feature", apikey, `{"type":"Feature","geometry":{"type":"Point","coordinates":[0,0]},"properties":{}}`)
+		}(i)
+	}
+	wg.Wait()
+
+	added := 0
+	for _, resp := range results {
+		if "success" == resp.Status {
+			added++
+		} else if "Quota exceeded, max_features is 3" != resp.Message {
+			t.Errorf("Unexpected response: %v", resp)
+		}
+	}
+	layer, err := GeoDB.GetLayer(datasource_id)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 3 != added || 3 != len(layer.Features) {
+		t.Errorf("Expected 3 features, %v inserts succeeded and the layer has %v", added, len(layer.Features))
+	}
+}
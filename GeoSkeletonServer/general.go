@@ -11,6 +11,7 @@ const (
 )
 
 var (
-	startTime           = time.Now()
-	SuperuserKey string = utils.NewAPIKey(12)
+	startTime                 = time.Now()
+	SuperuserKey       string = utils.NewAPIKey(12)
+	RejectQueryApikeys bool   = false
 )
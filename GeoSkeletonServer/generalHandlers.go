@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 // IndexHandler returns html page containing api docs
@@ -16,27 +18,33 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
 // @param apikey customer id
 // @return map template
 func MapHandler(w http.ResponseWriter, r *http.Request) {
-	job := HttpRequest{w: w, r: r}
-	customer, err := job.GetCustomer()
-	if nil != err {
-		data := HttpMessageResponse{Status: "error", Message: err.Error()}
-		js := job.MarshalJsonFromStruct(data)
-		job.SendJsonResponse(js)
-		return
-	}
-
-	htmlFile := "./templates/map.html"
-	tmpl, _ := template.ParseFiles(htmlFile)
-	message := fmt.Sprintf(" %v %v [200]", r.Method, r.URL.Path)
-	NetworkLogger.Info(r.RemoteAddr, message)
-	tmpl.Execute(w, PageViewData{Apikey: customer.Apikey, Version: VERSION})
+	servePage(w, r, "./templates/map.html")
 }
 
 // DashboardHandler returns customer management gui.
 // Allows customers to create and delete both geojson layers and tile baselayers.
 func DashboardHandler(w http.ResponseWriter, r *http.Request) {
-	job := HttpRequest{w: w, r: r}
-	customer, err := job.GetCustomer()
+	servePage(w, r, "./templates/management.html")
+}
+
+// servePage renders a page for the customer signed in with the session cookie.
+// Apikeys sent in the query string are moved to the cookie and the page is
+// reloaded without them. Requests without an apikey are sent to the login page.
+func servePage(w http.ResponseWriter, r *http.Request, htmlFile string) {
+	job := HttpRequest{w: w, r: r, page: true}
+
+	if apikey := r.URL.Query().Get("apikey"); "" != apikey && !RejectQueryApikeys {
+		setApikeyCookie(w, r, apikey)
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	if _, err := job.getPageApikey(); nil != err {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.Path), http.StatusSeeOther)
+		return
+	}
+
+	_, err := job.GetCustomer()
 	if nil != err {
 		data := HttpMessageResponse{Status: "error", Message: err.Error()}
 		js := job.MarshalJsonFromStruct(data)
@@ -44,9 +52,40 @@ func DashboardHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	htmlFile := "./templates/management.html"
 	tmpl, _ := template.ParseFiles(htmlFile)
 	message := fmt.Sprintf(" %v %v [200]", r.Method, r.URL.Path)
 	NetworkLogger.Info(r.RemoteAddr, message)
-	tmpl.Execute(w, PageViewData{Apikey: customer.Apikey, Version: VERSION})
+	apikey, _ := job.GetApikey()
+	tmpl.Execute(w, PageViewData{Apikey: apikey, Version: VERSION})
+}
+
+// getNextPage returns the page to open after signing in. Only local paths are accepted.
+func getNextPage(r *http.Request) string {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		return "/map"
+	}
+	return next
+}
+
+// LoginPageHandler returns the login form of the map and dashboard pages
+func LoginPageHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl, _ := template.ParseFiles("./templates/login.html")
+	tmpl.Execute(w, LoginViewData{Next: getNextPage(r), Version: VERSION})
+}
+
+// LoginHandler checks the apikey posted by the login form and stores it in
+// the session cookie of the map and dashboard pages.
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	apikey := strings.TrimSpace(r.PostFormValue("apikey"))
+	_, _, err := DB.AuthenticateApikey(apikey)
+	if "" == apikey || nil != err {
+		NetworkLogger.Warn(r.RemoteAddr, " POST /login [401]")
+		w.WriteHeader(http.StatusUnauthorized)
+		tmpl, _ := template.ParseFiles("./templates/login.html")
+		tmpl.Execute(w, LoginViewData{Next: getNextPage(r), Message: "Invalid apikey", Version: VERSION})
+		return
+	}
+	setApikeyCookie(w, r, apikey)
+	http.Redirect(w, r, getNextPage(r), http.StatusSeeOther)
 }
@@ -1,21 +1,38 @@
 package geo_skeleton_server
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"./utils"
 	"github.com/gorilla/mux"
 )
 
+const (
+	HTTP_COMPRESSION_MIN_SIZE = 1024
+	HTTP_COMPRESSION_LEVEL    = 6
+	// HTTP_APIKEY_COOKIE session cookie of the map and dashboard pages
+	HTTP_APIKEY_COOKIE = "gospatial_apikey"
+)
+
 type HttpRequest struct {
 	w            http.ResponseWriter
 	r            *http.Request
+	page         bool
 	rid          string
 	wroteHeaders bool
+	notModified  bool
+	lastModified time.Time
+	version      string
 }
 
 func (self *HttpRequest) GetRId() string {
@@ -38,24 +55,101 @@ func (self *HttpRequest) WriteHeaders(statusCode int) {
 	NetworkLogger.Info(message)
 }
 
-func (self *HttpRequest) GetApikey() (string, error) {
-	apikey := self.r.FormValue("apikey")
+// getRequestApikey reads the apikey from the Authorization: Bearer or
+// X-API-Key request headers, or the Sec-WebSocket-Protocol header of
+// websocket requests. Falls back to the apikey query parameter unless
+// RejectQueryApikeys is set.
+func getRequestApikey(r *http.Request) (string, error) {
+	authorization := strings.TrimSpace(r.Header.Get("Authorization"))
+	if 7 < len(authorization) && strings.EqualFold("Bearer ", authorization[:7]) {
+		return strings.TrimSpace(authorization[7:]), nil
+	}
+	if apikey := strings.TrimSpace(r.Header.Get("X-API-Key")); "" != apikey {
+		return apikey, nil
+	}
+	if apikey := getWebsocketApikey(r); "" != apikey {
+		return apikey, nil
+	}
+	apikey := r.FormValue("apikey")
+	if "" != apikey && RejectQueryApikeys {
+		return "", fmt.Errorf(`Apikey must be sent in request headers`)
+	}
 	if "" == apikey {
+		return "", fmt.Errorf(`Unauthorized`)
+	}
+	return apikey, nil
+}
+
+func (self *HttpRequest) GetApikey() (string, error) {
+	apikey, err := self.getPageApikey()
+	if nil != err {
 		self.WriteHeaders(http.StatusUnauthorized)
-		err := fmt.Errorf(`Unauthorized`)
+	}
+	return apikey, err
+}
+
+// getPageApikey returns the request apikey. Pages also accept the session
+// cookie, the api routes don't so cross site requests can't use it.
+func (self *HttpRequest) getPageApikey() (string, error) {
+	apikey, err := getRequestApikey(self.r)
+	if nil == err || !self.page {
 		return apikey, err
 	}
-	return apikey, nil
+	cookie, cookieErr := self.r.Cookie(HTTP_APIKEY_COOKIE)
+	if nil != cookieErr || "" == cookie.Value {
+		return apikey, err
+	}
+	return cookie.Value, nil
+}
+
+// setApikeyCookie stores the apikey in the session cookie of the pages.
+// The cookie can't be read by scripts and isn't sent by other sites.
+func setApikeyCookie(w http.ResponseWriter, r *http.Request, apikey string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     HTTP_APIKEY_COOKIE,
+		Value:    apikey,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   nil != r.TLS,
+		SameSite: http.SameSiteStrictMode,
+	})
 }
 
 func (self *HttpRequest) GetAuthkey() (string, error) {
-	apikey := self.r.FormValue("apikey")
-	if "" == apikey {
+	return self.GetApikey()
+}
+
+// CheckSuperuser compares the request apikey with the SuperuserKey
+func (self *HttpRequest) CheckSuperuser() error {
+	authkey, err := self.GetAuthkey()
+	if nil != err {
+		return err
+	}
+	if 1 != subtle.ConstantTimeCompare([]byte(authkey), []byte(SuperuserKey)) {
 		self.WriteHeaders(http.StatusUnauthorized)
-		err := fmt.Errorf(`Unauthorized`)
-		return apikey, err
+		return fmt.Errorf(`Unauthorized`)
 	}
-	return apikey, nil
+	return nil
+}
+
+func (self *HttpRequest) GetKeyId() (string, error) {
+	vars := mux.Vars(self.r)
+	if "" == vars["key"] {
+		self.WriteHeaders(http.StatusBadRequest)
+		err := fmt.Errorf(`Missing parameter`)
+		return vars["key"], err
+	}
+	return vars["key"], nil
+}
+
+func (self *HttpRequest) GetCustomerId() (string, error) {
+	vars := mux.Vars(self.r)
+	if "" == vars["customer"] {
+		self.WriteHeaders(http.StatusBadRequest)
+		err := fmt.Errorf(`Missing parameter`)
+		return vars["customer"], err
+	}
+	return vars["customer"], nil
 }
 
 func (self *HttpRequest) GetDatasource() (string, error) {
@@ -87,19 +181,133 @@ func (self *HttpRequest) GetTimestamp() (int64, error) {
 	return ts, err
 }
 
+func (self *HttpRequest) GetTimestampRange() (int64, int64, error) {
+	vars := mux.Vars(self.r)
+	a, err := strconv.ParseInt(vars["a"], 10, 64)
+	if nil != err {
+		self.WriteHeaders(http.StatusBadRequest)
+		return a, 0, err
+	}
+	b, err := strconv.ParseInt(vars["b"], 10, 64)
+	if nil != err {
+		self.WriteHeaders(http.StatusBadRequest)
+	}
+	return a, b, err
+}
+
+func (self *HttpRequest) GetAsOfTimestamp() (int64, bool, error) {
+	as_of := self.r.FormValue("as_of")
+	if "" == as_of {
+		return 0, false, nil
+	}
+	ts, err := strconv.ParseInt(as_of, 10, 64)
+	if nil != err {
+		self.WriteHeaders(http.StatusBadRequest)
+	}
+	return ts, true, err
+}
+
+func (self *HttpRequest) IsDryRun() bool {
+	dry_run, err := strconv.ParseBool(self.r.FormValue("dry_run"))
+	return nil == err && dry_run
+}
+
 func (self *HttpRequest) GetCustomer() (Customer, error) {
 	apikey, err := self.GetApikey()
 	if nil != err {
 		self.WriteHeaders(http.StatusNotFound)
 		return Customer{}, err
 	}
-	customer, err := DB.GetCustomer(apikey)
+	key, customer, err := DB.AuthenticateApikey(apikey)
 	if nil != err {
 		self.WriteHeaders(http.StatusNotFound)
+		return customer, err
+	}
+	err = CheckRateLimit(key.Id, customer.Id)
+	if limited, ok := err.(rateLimitError); ok {
+		self.w.Header().Set("Retry-After", fmt.Sprintf("%v", limited.Seconds()))
+		self.WriteHeaders(http.StatusTooManyRequests)
 	}
 	return customer, err
 }
 
+// CheckLayerQuota checks the customer can create another layer.
+// Replies 403 when the quota is exceeded.
+func (self *HttpRequest) CheckLayerQuota(customer Customer) error {
+	err := CheckQuota(customer, Usage{Layers: 1})
+	if nil != err {
+		self.WriteHeaders(http.StatusForbidden)
+	}
+	return err
+}
+
+// CheckFeatureQuota checks the owners of a datasource can store the added features and bytes.
+// Replies 403 when a quota is exceeded.
+func (self *HttpRequest) CheckFeatureQuota(datasource_id string, features int, bytes int64) error {
+	err := CheckDatasourceQuota(datasource_id, Usage{Features: features, Bytes: bytes})
+	if nil != err {
+		self.WriteHeaders(http.StatusForbidden)
+	}
+	return err
+}
+
+// GetViewer returns the customer reading a datasource. Public datasources
+// can be read without an apikey and grant viewer access to every customer.
+func (self *HttpRequest) GetViewer(datasource_id string) (Customer, error) {
+	public := DB.IsPublicLayer(datasource_id)
+	if _, err := getRequestApikey(self.r); nil != err && public {
+		return Customer{Datasources: []string{datasource_id}, Roles: map[string]string{datasource_id: ROLE_VIEWER}}, nil
+	}
+	customer, err := self.GetCustomer()
+	if nil != err {
+		return customer, err
+	}
+	if public && !customer.hasRole(datasource_id, ROLE_VIEWER) {
+		customer.setRole(datasource_id, ROLE_VIEWER)
+	}
+	return customer, nil
+}
+
+// SetVersion sets the ETag response header. Compressed responses
+// get the encoding appended to the ETag by compressResponse.
+func (self *HttpRequest) SetVersion(version string) {
+	self.version = version
+	self.w.Header().Set("ETag", `"`+version+`"`)
+}
+
+// CheckIfMatch compares the If-Match request header with the current version.
+// Replies 412 with the current version when it doesn't match.
+func (self *HttpRequest) CheckIfMatch(version string) error {
+	header := self.r.Header.Get("If-Match")
+	if "" == header || etagMatches(header, version) {
+		return nil
+	}
+	self.SetVersion(version)
+	self.WriteHeaders(http.StatusPreconditionFailed)
+	return versionMismatchError{Current: version}
+}
+
+// SetLastModified sets the Last-Modified response header
+func (self *HttpRequest) SetLastModified(modified time.Time) {
+	self.lastModified = modified.UTC().Truncate(time.Second)
+	self.w.Header().Set("Last-Modified", self.lastModified.Format(http.TimeFormat))
+}
+
+// NotModified checks the If-None-Match and If-Modified-Since request headers.
+// Replies 304 when the client already has the current version.
+func (self *HttpRequest) NotModified(version string) bool {
+	if header := self.r.Header.Get("If-None-Match"); "" != header {
+		self.notModified = etagMatches(header, version)
+	} else if header := self.r.Header.Get("If-Modified-Since"); "" != header && !self.lastModified.IsZero() {
+		since, err := http.ParseTime(header)
+		self.notModified = nil == err && !self.lastModified.After(since)
+	}
+	if self.notModified {
+		self.WriteHeaders(http.StatusNotModified)
+	}
+	return self.notModified
+}
+
 func (self *HttpRequest) Success() {
 	self.w.WriteHeader(http.StatusOK)
 }
@@ -146,16 +354,82 @@ func (self *HttpRequest) UnauthorizedHandler(err error) {
 	http.Error(self.w, `{"status": "error", "message": "`+err.Error()+`"}`, http.StatusUnauthorized)
 }
 
+// getContentEncoding returns the compression the client prefers. Encodings
+// with q=0 are refused, gzip is preferred when both have the same weight.
+func (self *HttpRequest) getContentEncoding() string {
+	weights := make(map[string]float64)
+	for _, value := range strings.Split(self.r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(value, ";")
+		encoding := strings.ToLower(strings.TrimSpace(params[0]))
+		if "" == encoding {
+			continue
+		}
+		weight := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if nil != err {
+					q = 0
+				}
+				weight = q
+			}
+		}
+		weights[encoding] = weight
+	}
+	best, best_weight := "", 0.0
+	for _, encoding := range contentEncodings {
+		weight, ok := weights[encoding]
+		if !ok {
+			weight = weights["*"]
+		}
+		if weight > best_weight {
+			best, best_weight = encoding, weight
+		}
+	}
+	return best
+}
+
+// compressResponse compresses the response body when the client accepts it
+func (self *HttpRequest) compressResponse(js []byte) []byte {
+	self.w.Header().Add("Vary", "Accept-Encoding")
+	encoding := self.getContentEncoding()
+	if HTTP_COMPRESSION_MIN_SIZE > len(js) || "" == encoding {
+		return js
+	}
+	compressed := new(bytes.Buffer)
+	switch encoding {
+	case "gzip":
+		compressor, _ := gzip.NewWriterLevel(compressed, HTTP_COMPRESSION_LEVEL)
+		compressor.Write(js)
+		compressor.Close()
+	case "deflate":
+		compressor, _ := zlib.NewWriterLevel(compressed, HTTP_COMPRESSION_LEVEL)
+		compressor.Write(js)
+		compressor.Close()
+	}
+	self.w.Header().Set("Content-Encoding", encoding)
+	// the compressed body is a different representation than the uncompressed one
+	if "" != self.version {
+		self.w.Header().Set("ETag", `"`+encodedVersion(self.version, encoding)+`"`)
+	}
+	return compressed.Bytes()
+}
+
 // Sends http response
 func (self *HttpRequest) SendJsonResponse(js []byte) {
+	NetworkLogger.Trace(fmt.Sprintf("[%v] [In]  %v %v", self.GetRId(), self.r.RemoteAddr, self.r))
+	if self.notModified {
+		return
+	}
+	NetworkLogger.Trace(fmt.Sprintf("[%v] [Out] %v %v", self.GetRId(), self.r.RemoteAddr, string(js)))
 	if !self.wroteHeaders {
+		// set response headers
+		self.w.Header().Set("Content-Type", "application/json")
+		// allow cross domain AJAX requests
+		self.w.Header().Set("Access-Control-Allow-Origin", "*")
+		js = self.compressResponse(js)
 		self.WriteHeaders(http.StatusOK)
 	}
-	NetworkLogger.Trace(fmt.Sprintf("[%v] [In]  %v %v", self.GetRId(), self.r.RemoteAddr, self.r))
-	NetworkLogger.Trace(fmt.Sprintf("[%v] [Out] %v %v", self.GetRId(), self.r.RemoteAddr, string(js)))
-	// set response headers
-	self.w.Header().Set("Content-Type", "application/json")
-	// allow cross domain AJAX requests
-	self.w.Header().Set("Access-Control-Allow-Origin", "*")
 	self.w.Write(js)
 }
@@ -0,0 +1,154 @@
+package geo_skeleton_server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Unittest apikeys read from websocket subprotocols and the page cookie
+func TestGetPageApikey(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws/20f3332781ea4d7b8d509d12517ac5fa", nil)
+	r.Header.Set("Sec-WebSocket-Protocol", "gospatial, apikey.12dB6BlenIeB")
+	apikey, err := getRequestApikey(r)
+	if nil != err || "12dB6BlenIeB" != apikey {
+		t.Errorf("Apikey not read from websocket subprotocol: %v %v", apikey, err)
+	}
+
+	r = httptest.NewRequest("GET", "/api/v1/customer", nil)
+	r.AddCookie(&http.Cookie{Name: HTTP_APIKEY_COOKIE, Value: "12dB6BlenIeB"})
+	job := HttpRequest{w: httptest.NewRecorder(), r: r}
+	if _, err := job.getPageApikey(); nil == err {
+		t.Error("Api routes should not accept the page cookie")
+	}
+	job = HttpRequest{w: httptest.NewRecorder(), r: r, page: true}
+	apikey, err = job.getPageApikey()
+	if nil != err || "12dB6BlenIeB" != apikey {
+		t.Errorf("Apikey not read from page cookie: %v %v", apikey, err)
+	}
+}
+
+// Unittest HttpRequest.getContentEncoding
+func TestGetContentEncoding(t *testing.T) {
+	headers := map[string]string{
+		"":                           "",
+		"gzip":                       "gzip",
+		"deflate":                    "deflate",
+		"deflate, gzip":              "gzip",
+		"GZIP;q=0.5, deflate":        "deflate",
+		"gzip;q=0":                   "",
+		"gzip;q=0, deflate;q=0.1":    "deflate",
+		"br, identity":               "",
+		"*":                          "gzip",
+		"*;q=0.5, gzip;q=0":          "deflate",
+		"gzip;q=0.8, deflate;q=0.80": "gzip",
+	}
+	for header, expected := range headers {
+		r := httptest.NewRequest("GET", "/api/v1/layer/20f3332781ea4d7b8d509d12517ac5fa", nil)
+		r.Header.Set("Accept-Encoding", header)
+		job := HttpRequest{w: httptest.NewRecorder(), r: r}
+		if encoding := job.getContentEncoding(); expected != encoding {
+			t.Errorf("Accept-Encoding %q should give %q, got %q", header, expected, encoding)
+		}
+	}
+}
+
+// Unittest HttpRequest.compressResponse
+func TestCompressResponse(t *testing.T) {
+	large := []byte(`{"status":"success","data":"` + strings.Repeat("a", HTTP_COMPRESSION_MIN_SIZE) + `"}`)
+	readers := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		// deflate is zlib framed
+		"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	}
+	for encoding, reader := range readers {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/v1/layer/20f3332781ea4d7b8d509d12517ac5fa", nil)
+		r.Header.Set("Accept-Encoding", encoding)
+		job := HttpRequest{w: recorder, r: r}
+		job.SetVersion("3f786850e387550fdab836ed7e6dc881de23001b")
+		job.SendJsonResponse(large)
+
+		if encoding != recorder.Header().Get("Content-Encoding") || "Accept-Encoding" != recorder.Header().Get("Vary") {
+			t.Errorf("Missing %v headers: %v", encoding, recorder.Header())
+		}
+		if `"3f786850e387550fdab836ed7e6dc881de23001b-`+encoding+`"` != recorder.Header().Get("ETag") {
+			t.Errorf("ETag should depend on the %v encoding: %v", encoding, recorder.Header().Get("ETag"))
+		}
+		decompressor, err := reader(bytes.NewReader(recorder.Body.Bytes()))
+		if nil != err {
+			t.Fatalf("Unable to read %v body: %v", encoding, err)
+		}
+		body, err := ioutil.ReadAll(decompressor)
+		if nil != err || !bytes.Equal(large, body) {
+			t.Errorf("The %v body doesn't match the response: %v", encoding, err)
+		}
+	}
+
+	// small responses and clients refusing compression get the plain body
+	for _, header := range []string{"gzip", "gzip;q=0"} {
+		body := large
+		if "gzip" == header {
+			body = []byte(`{"status":"success"}`)
+		}
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/v1/layer/20f3332781ea4d7b8d509d12517ac5fa", nil)
+		r.Header.Set("Accept-Encoding", header)
+		job := HttpRequest{w: recorder, r: r}
+		job.SetVersion("3f786850e387550fdab836ed7e6dc881de23001b")
+		job.SendJsonResponse(body)
+		if "" != recorder.Header().Get("Content-Encoding") || !bytes.Equal(body, recorder.Body.Bytes()) {
+			t.Errorf("Response should not be compressed for %q: %v", header, recorder.Header())
+		}
+		if `"3f786850e387550fdab836ed7e6dc881de23001b"` != recorder.Header().Get("ETag") {
+			t.Errorf("Uncompressed ETag should be the version: %v", recorder.Header().Get("ETag"))
+		}
+	}
+}
+
+// Unittest HttpRequest.NotModified
+func TestNotModified(t *testing.T) {
+	version := "3f786850e387550fdab836ed7e6dc881de23001b"
+	modified := time.Date(2017, 6, 30, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		value  string
+		code   int
+	}{
+		{"", "", http.StatusOK},
+		{"If-None-Match", `"3f786850e387550fdab836ed7e6dc881de23001b"`, http.StatusNotModified},
+		{"If-None-Match", `W/"3f786850e387550fdab836ed7e6dc881de23001b-gzip"`, http.StatusNotModified},
+		{"If-None-Match", `"da39a3ee5e6b4b0d3255bfef95601890afd80709"`, http.StatusOK},
+		{"If-Modified-Since", modified.Format(http.TimeFormat), http.StatusNotModified},
+		{"If-Modified-Since", modified.Add(time.Hour).Format(http.TimeFormat), http.StatusNotModified},
+		{"If-Modified-Since", modified.Add(-time.Second).Format(http.TimeFormat), http.StatusOK},
+		{"If-Modified-Since", "yesterday", http.StatusOK},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/v1/layer/20f3332781ea4d7b8d509d12517ac5fa", nil)
+		if "" != test.header {
+			r.Header.Set(test.header, test.value)
+		}
+		job := HttpRequest{w: recorder, r: r}
+		job.SetVersion(version)
+		job.SetLastModified(modified)
+		if job.NotModified(version) != (http.StatusNotModified == test.code) {
+			t.Errorf("%v %v should reply %v", test.header, test.value, test.code)
+		}
+		job.SendJsonResponse([]byte(`{"status":"success"}`))
+		if test.code != recorder.Code {
+			t.Errorf("%v %v should reply %v, got %v", test.header, test.value, test.code, recorder.Code)
+		}
+		if http.StatusNotModified == test.code && 0 != recorder.Body.Len() {
+			t.Errorf("Not modified response should have no body: %v", recorder.Body.String())
+		}
+	}
+}
@@ -23,21 +23,31 @@ func ViewLayersHandler(w http.ResponseWriter, r *http.Request) {
 	job.SendJsonResponse(js)
 }
 
-// NewLayerHandler creates a new geojson layer. Saves layer to database and adds layer to customer
+// NewLayerHandler creates a new geojson layer. Saves layer to database and adds layer to customer.
+// Replies 403 when the customer is at their layer quota.
 // @param apikey
 // @return json
 func NewLayerHandler(w http.ResponseWriter, r *http.Request) {
 	job := HttpRequest{w: w, r: r}
-	customer, err := job.GetCustomer()
-	var js []byte
-	if nil == err {
-		datasource_id, err := GeoDB.NewLayer()
-		if nil == err {
-			customer.addDatasource(datasource_id)
-			data := HttpMessageResponse{Status: "success", Datasource: datasource_id}
-			js = job.MarshalJsonFromStruct(data)
+	js, err := func() ([]byte, error) {
+		customer, err := job.GetCustomer()
+		if nil != err {
+			return []byte{}, err
 		}
-	}
+		err = job.CheckLayerQuota(customer)
+		if nil != err {
+			return []byte{}, err
+		}
+		datasource_id, err := DB.NewLayer()
+		if nil != err {
+			return []byte{}, err
+		}
+		publishLayerEvent(EVENT_LAYER_CREATED, datasource_id)
+		customer.addDatasource(datasource_id)
+		data := HttpMessageResponse{Status: "success", Datasource: datasource_id}
+		js := job.MarshalJsonFromStruct(data)
+		return js, err
+	}()
 	if nil != err {
 		data := HttpMessageResponse{Status: "error", Message: err.Error()}
 		js = job.MarshalJsonFromStruct(data)
@@ -46,26 +56,38 @@ func NewLayerHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // ViewLayerHandler returns geojson of requested layer. Apikey/customer is checked for permissions to requested layer.
+// The layer version is returned in the ETag header. Replies 304 if the client version is current.
 // @param ds
 // @param apikey
 // @return geojson
 func ViewLayerHandler(w http.ResponseWriter, r *http.Request) {
 	job := HttpRequest{w: w, r: r}
 	js, err := func() ([]byte, error) {
-		customer, err := job.GetCustomer()
+		datasource_id, err := job.GetDatasource()
 		if nil != err {
 			return []byte{}, err
 		}
-		datasource_id, err := job.GetDatasource()
+		customer, err := job.GetViewer(datasource_id)
 		if nil != err {
 			return []byte{}, err
 		}
-		if customer.hasDatasource(datasource_id) {
+		if customer.hasRole(datasource_id, ROLE_VIEWER) {
 			lyr, err := GeoDB.GetLayer(datasource_id)
 			if nil != err {
 				return []byte{}, fmt.Errorf(`Not found`)
 			}
 			js, err := lyr.MarshalJSON()
+			if nil != err {
+				return []byte{}, err
+			}
+			version := hashVersion(js)
+			job.SetVersion(version)
+			if modified, err := GetLayerLastModified(datasource_id); nil == err {
+				job.SetLastModified(modified)
+			}
+			if job.NotModified(version) {
+				return []byte{}, nil
+			}
 			return js, err
 		}
 		return []byte{}, fmt.Errorf(`Unauthorized`)
@@ -78,6 +100,7 @@ func ViewLayerHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // DeleteLayerHandler deletes layer from database and removes it from customer list.
+// Honours the If-Match header against the current layer version.
 // @param ds
 // @param apikey
 // @return json
@@ -92,12 +115,23 @@ func DeleteLayerHandler(w http.ResponseWriter, r *http.Request) {
 		if nil != err {
 			return []byte{}, err
 		}
-		if customer.hasDatasource(datasource_id) {
-			customer.removeDatasource(datasource_id)
-			err = GeoDB.DeleteLayer(datasource_id)
+		if customer.hasRole(datasource_id, ROLE_OWNER) {
+			unlock := lockLayer(datasource_id)
+			defer unlock()
+			version, err := GetStoredLayerVersion(datasource_id)
 			if nil != err {
 				return []byte{}, err
 			}
+			err = job.CheckIfMatch(version)
+			if nil != err {
+				return []byte{}, err
+			}
+			err = DB.DeleteLayer(datasource_id)
+			if nil != err {
+				return []byte{}, err
+			}
+			resetDatasourceUsage(datasource_id)
+			publishLayerEvent(EVENT_LAYER_DELETED, datasource_id)
 			data := HttpMessageResponse{Status: "success", Datasource: datasource_id, Data: "datasource deleted"}
 			js := job.MarshalJsonFromStruct(data)
 			return js, err
@@ -118,15 +152,15 @@ func DeleteLayerHandler(w http.ResponseWriter, r *http.Request) {
 func ViewLayerTimestampsHandler(w http.ResponseWriter, r *http.Request) {
 	job := HttpRequest{w: w, r: r}
 	js, err := func() ([]byte, error) {
-		customer, err := job.GetCustomer()
+		datasource_id, err := job.GetDatasource()
 		if nil != err {
 			return []byte{}, err
 		}
-		datasource_id, err := job.GetDatasource()
+		customer, err := job.GetViewer(datasource_id)
 		if nil != err {
 			return []byte{}, err
 		}
-		if customer.hasDatasource(datasource_id) {
+		if customer.hasRole(datasource_id, ROLE_VIEWER) {
 			lyr_ts, err := GeoDB.SelectTimeseriesDatasource(datasource_id)
 			if nil != err {
 				return []byte{}, err
@@ -160,15 +194,15 @@ func ViewLayerTimestampsHandler(w http.ResponseWriter, r *http.Request) {
 func ViewLayerPerviousTimestampHandler(w http.ResponseWriter, r *http.Request) {
 	job := HttpRequest{w: w, r: r}
 	js, err := func() ([]byte, error) {
-		customer, err := job.GetCustomer()
+		datasource_id, err := job.GetDatasource()
 		if nil != err {
 			return []byte{}, err
 		}
-		datasource_id, err := job.GetDatasource()
+		customer, err := job.GetViewer(datasource_id)
 		if nil != err {
 			return []byte{}, err
 		}
-		if customer.hasDatasource(datasource_id) {
+		if customer.hasRole(datasource_id, ROLE_VIEWER) {
 			ts, err := job.GetTimestamp()
 			lyr_ts, err := GeoDB.SelectTimeseriesDatasource(datasource_id)
 			if nil != err {
@@ -193,3 +227,90 @@ func ViewLayerPerviousTimestampHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	job.SendJsonResponse(js)
 }
+
+// ViewLayerTimestampDiffHandler returns features added, removed and modified between two layer timestamps.
+// Features are matched by geo_id. Apikey/customer is checked for permissions to requested layer.
+// @param ds
+// @param a
+// @param b
+// @param apikey
+// @return json
+func ViewLayerTimestampDiffHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		datasource_id, err := job.GetDatasource()
+		if nil != err {
+			return []byte{}, err
+		}
+		customer, err := job.GetViewer(datasource_id)
+		if nil != err {
+			return []byte{}, err
+		}
+		if customer.hasRole(datasource_id, ROLE_VIEWER) {
+			a, b, err := job.GetTimestampRange()
+			if nil != err {
+				return []byte{}, err
+			}
+			diff, err := DiffLayerSnapshots(datasource_id, a, b)
+			if nil != err {
+				return []byte{}, err
+			}
+			data := HttpMessageResponse{Status: "success", Datasource: datasource_id, Data: diff}
+			js := job.MarshalJsonFromStruct(data)
+			return js, err
+		}
+		return []byte{}, fmt.Errorf(`Unauthorized`)
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
+
+// RestoreLayerTimestampHandler replaces the layer with the snapshot stored at the requested timestamp.
+// Active websocket viewers are notified of the update. When dry_run is set the changes are returned
+// without being applied. Apikey/customer is checked for permissions to requested layer.
+// @param ds
+// @param ts
+// @param apikey
+// @param dry_run
+// @return json
+func RestoreLayerTimestampHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		customer, err := job.GetCustomer()
+		if nil != err {
+			return []byte{}, err
+		}
+		datasource_id, err := job.GetDatasource()
+		if nil != err {
+			return []byte{}, err
+		}
+		if customer.hasRole(datasource_id, ROLE_EDITOR) {
+			ts, err := job.GetTimestamp()
+			if nil != err {
+				return []byte{}, err
+			}
+			dry_run := job.IsDryRun()
+			unlock := lockLayer(datasource_id)
+			diff, err := RestoreLayerSnapshot(datasource_id, ts, dry_run)
+			unlock()
+			if nil != err {
+				return []byte{}, err
+			}
+			if !dry_run {
+				Hub.broadcastAllDsViewers(true, datasource_id)
+			}
+			data := HttpMessageResponse{Status: "success", Datasource: datasource_id, Data: diff}
+			js := job.MarshalJsonFromStruct(data)
+			return js, err
+		}
+		return []byte{}, fmt.Errorf(`Unauthorized`)
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
@@ -0,0 +1,415 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/paulmach/go.geojson"
+)
+
+// RateLimit token bucket settings. Apikeys receive RequestsPerSecond
+// tokens per second and can store up to Burst tokens.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+// Quota limits the storage used by a customer. Zero means unlimited.
+type Quota struct {
+	MaxLayers   int   `json:"max_layers"`
+	MaxFeatures int   `json:"max_features"`
+	MaxBytes    int64 `json:"max_bytes"`
+}
+
+// CustomerLimits overrides the global limits for a customer
+type CustomerLimits struct {
+	RateLimit *RateLimit `json:"rate_limit"`
+	Quota     *Quota     `json:"quota"`
+}
+
+// LimitsConfig holds the global rate limit and quota and per customer overrides.
+// Customers without limits are not limited.
+type LimitsConfig struct {
+	RateLimit *RateLimit                `json:"rate_limit"`
+	Quota     *Quota                    `json:"quota"`
+	Customers map[string]CustomerLimits `json:"customers"`
+}
+
+// Usage storage used by a customer's layers
+type Usage struct {
+	Layers   int   `json:"layers"`
+	Features int   `json:"features"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// UsageReport usage counters and limits returned to customers
+type UsageReport struct {
+	Usage     Usage      `json:"usage"`
+	Quota     *Quota     `json:"quota,omitempty"`
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+}
+
+var Limits LimitsConfig
+
+// rateLimitError is returned when an apikey has no tokens left
+type rateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (self rateLimitError) Error() string {
+	return fmt.Sprintf("Rate limit exceeded, retry after %v seconds", self.Seconds())
+}
+
+// Seconds returns the whole seconds to wait before retrying
+func (self rateLimitError) Seconds() int64 {
+	return int64(math.Ceil(self.RetryAfter.Seconds()))
+}
+
+// quotaExceededError is returned when a write would exceed a customer quota
+type quotaExceededError struct {
+	Limit string
+	Max   int64
+}
+
+func (self quotaExceededError) Error() string {
+	return fmt.Sprintf("Quota exceeded, %v is %v", self.Limit, self.Max)
+}
+
+// getRateLimit returns the rate limit for a customer
+func (self LimitsConfig) getRateLimit(customer_id string) (RateLimit, bool) {
+	if limits, ok := self.Customers[customer_id]; ok && nil != limits.RateLimit {
+		return *limits.RateLimit, true
+	}
+	if nil != self.RateLimit {
+		return *self.RateLimit, true
+	}
+	return RateLimit{}, false
+}
+
+// getQuota returns the storage quota for a customer
+func (self LimitsConfig) getQuota(customer_id string) (Quota, bool) {
+	if limits, ok := self.Customers[customer_id]; ok && nil != limits.Quota {
+		return *limits.Quota, true
+	}
+	if nil != self.Quota {
+		return *self.Quota, true
+	}
+	return Quota{}, false
+}
+
+// getBurst returns the bucket size, at least one request
+func (self RateLimit) getBurst() float64 {
+	if 0 < self.Burst {
+		return float64(self.Burst)
+	}
+	return math.Max(1, math.Ceil(self.RequestsPerSecond))
+}
+
+// RATE_LIMIT_IDLE keeps buckets of apikeys that never refill
+const RATE_LIMIT_IDLE = time.Hour
+
+// RATE_LIMIT_SWEEP_INTERVAL how often full buckets are removed
+const RATE_LIMIT_SWEEP_INTERVAL = time.Minute
+
+// USAGE_COUNTER_TTL how long datasource usage is counted before it is recounted
+const USAGE_COUNTER_TTL = 10 * time.Minute
+
+// tokenBucket tracks the requests left for an apikey
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// take refills the bucket and removes a token. Returns how long to wait
+// for the next token when the bucket is empty.
+func (self *tokenBucket) take(limit RateLimit, now time.Time) time.Duration {
+	burst := limit.getBurst()
+	if self.updated.IsZero() {
+		self.tokens = burst
+	} else {
+		elapsed := now.Sub(self.updated).Seconds()
+		self.tokens = math.Min(burst, self.tokens+elapsed*limit.RequestsPerSecond)
+	}
+	self.updated = now
+	wait := time.Duration(0)
+	if 1 <= self.tokens {
+		self.tokens--
+	} else if 0 >= limit.RequestsPerSecond {
+		wait = time.Second
+	} else {
+		wait = time.Duration((1 - self.tokens) / limit.RequestsPerSecond * float64(time.Second))
+	}
+	// an idle bucket is full again at this time and can be removed
+	if 0 < limit.RequestsPerSecond {
+		self.full = now.Add(time.Duration((burst - self.tokens) / limit.RequestsPerSecond * float64(time.Second)))
+	} else {
+		self.full = now.Add(RATE_LIMIT_IDLE)
+	}
+	return wait
+}
+
+var rateLimiter = struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}{buckets: make(map[string]*tokenBucket)}
+
+// sweepRateLimiter removes buckets that are full again. A full bucket
+// limits the same as a new one. Must be called holding rateLimiter.
+func sweepRateLimiter(now time.Time) {
+	if now.Sub(rateLimiter.swept) < RATE_LIMIT_SWEEP_INTERVAL {
+		return
+	}
+	rateLimiter.swept = now
+	for key_id, bucket := range rateLimiter.buckets {
+		if !now.Before(bucket.full) {
+			delete(rateLimiter.buckets, key_id)
+		}
+	}
+}
+
+// CheckRateLimit takes a token from the apikey bucket.
+// Returns a rateLimitError when the apikey is over its limit.
+// @param key_id {string}
+// @param customer_id {string}
+// @returns Error
+func CheckRateLimit(key_id string, customer_id string) error {
+	limit, ok := Limits.getRateLimit(customer_id)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	rateLimiter.Lock()
+	defer rateLimiter.Unlock()
+	sweepRateLimiter(now)
+	bucket, ok := rateLimiter.buckets[key_id]
+	if !ok {
+		bucket = &tokenBucket{}
+		rateLimiter.buckets[key_id] = bucket
+	}
+	wait := bucket.take(limit, now)
+	if 0 < wait {
+		return rateLimitError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// usageCounter storage counted for a datasource
+type usageCounter struct {
+	usage   Usage
+	counted time.Time
+}
+
+// usageCounters keeps the storage used by each datasource and the owners of
+// each datasource, so quota checks don't load every layer of every customer.
+// Writes add to the counters, counters are recounted after USAGE_COUNTER_TTL.
+var usageCounters = struct {
+	sync.Mutex
+	datasources map[string]*usageCounter
+	owners      map[string][]string
+}{datasources: make(map[string]*usageCounter)}
+
+// countDatasourceUsage loads a layer and counts its features and bytes
+func countDatasourceUsage(datasource_id string) (Usage, error) {
+	lyr, err := GeoDB.GetLayer(datasource_id)
+	if nil != err {
+		return Usage{}, err
+	}
+	js, err := lyr.MarshalJSON()
+	if nil != err {
+		return Usage{}, err
+	}
+	return Usage{Layers: 1, Features: len(lyr.Features), Bytes: int64(len(js))}, nil
+}
+
+// getDatasourceUsage returns the counted storage of a datasource
+func getDatasourceUsage(datasource_id string) (Usage, error) {
+	now := time.Now()
+	usageCounters.Lock()
+	counter, ok := usageCounters.datasources[datasource_id]
+	if ok && now.Sub(counter.counted) < USAGE_COUNTER_TTL {
+		usage := counter.usage
+		usageCounters.Unlock()
+		return usage, nil
+	}
+	usageCounters.Unlock()
+
+	usage, err := countDatasourceUsage(datasource_id)
+	if nil != err {
+		return usage, err
+	}
+	usageCounters.Lock()
+	usageCounters.datasources[datasource_id] = &usageCounter{usage: usage, counted: now}
+	usageCounters.Unlock()
+	return usage, nil
+}
+
+// addDatasourceUsage adds written features and bytes to the counters of a datasource
+// @param datasource_id {string}
+// @param added {Usage}
+func addDatasourceUsage(datasource_id string, added Usage) {
+	usageCounters.Lock()
+	defer usageCounters.Unlock()
+	if counter, ok := usageCounters.datasources[datasource_id]; ok {
+		counter.usage.Features += added.Features
+		counter.usage.Bytes += added.Bytes
+	}
+}
+
+// resetDatasourceUsage recounts a datasource on the next quota check.
+// Used after writes replacing or deleting a whole layer.
+// @param datasource_id {string}
+func resetDatasourceUsage(datasource_id string) {
+	usageCounters.Lock()
+	defer usageCounters.Unlock()
+	delete(usageCounters.datasources, datasource_id)
+}
+
+// resetDatasourceOwners reloads the datasource owners on the next quota check.
+// Called whenever a customer is saved or deleted.
+func resetDatasourceOwners() {
+	usageCounters.Lock()
+	defer usageCounters.Unlock()
+	usageCounters.owners = nil
+}
+
+// getDatasourceOwners returns the ids of the customers owning a datasource
+func getDatasourceOwners(datasource_id string) ([]string, error) {
+	usageCounters.Lock()
+	owners := usageCounters.owners
+	usageCounters.Unlock()
+	if nil != owners {
+		return owners[datasource_id], nil
+	}
+
+	values, err := DB.GetCustomers()
+	if nil != err {
+		return nil, err
+	}
+	owners = make(map[string][]string)
+	for _, value := range values {
+		customer := Customer{}
+		err = json.Unmarshal([]byte(value), &customer)
+		if nil != err {
+			return nil, err
+		}
+		for _, id := range customer.Datasources {
+			if customer.hasRole(id, ROLE_OWNER) {
+				owners[id] = append(owners[id], customer.Id)
+			}
+		}
+	}
+	usageCounters.Lock()
+	usageCounters.owners = owners
+	usageCounters.Unlock()
+	return owners[datasource_id], nil
+}
+
+// GetCustomerUsage counts the layers, features and bytes owned by a customer
+// @param customer {Customer}
+// @returns Usage
+// @returns Error
+func GetCustomerUsage(customer Customer) (Usage, error) {
+	usage := Usage{}
+	for _, datasource_id := range customer.Datasources {
+		if !customer.hasRole(datasource_id, ROLE_OWNER) {
+			continue
+		}
+		layer_usage, err := getDatasourceUsage(datasource_id)
+		if nil != err {
+			ServerLogger.Warn("Unable to count usage of ", datasource_id, ": ", err)
+			continue
+		}
+		usage.Layers += layer_usage.Layers
+		usage.Features += layer_usage.Features
+		usage.Bytes += layer_usage.Bytes
+	}
+	return usage, nil
+}
+
+// GetUsageReport returns the usage and limits of a customer
+// @param customer {Customer}
+// @returns UsageReport
+// @returns Error
+func GetUsageReport(customer Customer) (UsageReport, error) {
+	usage, err := GetCustomerUsage(customer)
+	report := UsageReport{Usage: usage}
+	if quota, ok := Limits.getQuota(customer.Id); ok {
+		report.Quota = &quota
+	}
+	if limit, ok := Limits.getRateLimit(customer.Id); ok {
+		report.RateLimit = &limit
+	}
+	return report, err
+}
+
+// CheckQuota checks the customer can store the added layers, features and bytes
+// @param customer {Customer}
+// @param added {Usage}
+// @returns Error
+func CheckQuota(customer Customer, added Usage) error {
+	quota, ok := Limits.getQuota(customer.Id)
+	if !ok {
+		return nil
+	}
+	usage, err := GetCustomerUsage(customer)
+	if nil != err {
+		return err
+	}
+	if 0 < quota.MaxLayers && 0 < added.Layers && usage.Layers+added.Layers > quota.MaxLayers {
+		return quotaExceededError{Limit: "max_layers", Max: int64(quota.MaxLayers)}
+	}
+	if 0 < quota.MaxFeatures && 0 < added.Features && usage.Features+added.Features > quota.MaxFeatures {
+		return quotaExceededError{Limit: "max_features", Max: int64(quota.MaxFeatures)}
+	}
+	if 0 < quota.MaxBytes && 0 < added.Bytes && usage.Bytes+added.Bytes > quota.MaxBytes {
+		return quotaExceededError{Limit: "max_bytes", Max: quota.MaxBytes}
+	}
+	return nil
+}
+
+// CheckDatasourceQuota checks every owner of a datasource can store the added features and bytes
+// @param datasource_id {string}
+// @param added {Usage}
+// @returns Error
+func CheckDatasourceQuota(datasource_id string, added Usage) error {
+	if nil == Limits.Quota && 0 == len(Limits.Customers) {
+		return nil
+	}
+	owners, err := getDatasourceOwners(datasource_id)
+	if nil != err {
+		return err
+	}
+	for _, customer_id := range owners {
+		customer, err := DB.GetCustomer(customer_id)
+		if nil != err {
+			return err
+		}
+		err = CheckQuota(customer, added)
+		if nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// getFeatureSizeDifference returns how many bytes replacing a feature adds
+// @param stored {*geojson.Feature}
+// @param feat {*geojson.Feature}
+// @returns int64
+// @returns Error
+func getFeatureSizeDifference(stored *geojson.Feature, feat *geojson.Feature) (int64, error) {
+	before, err := stored.MarshalJSON()
+	if nil != err {
+		return 0, err
+	}
+	after, err := feat.MarshalJSON()
+	if nil != err {
+		return 0, err
+	}
+	return int64(len(after) - len(before)), nil
+}
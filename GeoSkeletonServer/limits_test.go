@@ -0,0 +1,52 @@
+package geo_skeleton_server
+
+import (
+	"testing"
+	"time"
+)
+
+// Unittest tokenBucket.take
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2017, 6, 30, 12, 0, 0, 0, time.UTC)
+	limit := RateLimit{RequestsPerSecond: 2, Burst: 2}
+	bucket := tokenBucket{}
+
+	for i := 0; i < 2; i++ {
+		if wait := bucket.take(limit, now); 0 != wait {
+			t.Errorf("Request %v should be allowed, got wait %v", i, wait)
+		}
+	}
+	if wait := bucket.take(limit, now); 500*time.Millisecond != wait {
+		t.Errorf("Expected wait of 500ms, got %v", wait)
+	}
+	if wait := bucket.take(limit, now.Add(time.Second)); 0 != wait {
+		t.Errorf("Bucket should refill, got wait %v", wait)
+	}
+}
+
+// Unittest sweepRateLimiter
+func TestSweepRateLimiter(t *testing.T) {
+	now := time.Date(2017, 6, 30, 12, 0, 0, 0, time.UTC)
+	limit := RateLimit{RequestsPerSecond: 1, Burst: 10}
+	rateLimiter.Lock()
+	defer rateLimiter.Unlock()
+	rateLimiter.buckets = make(map[string]*tokenBucket)
+	rateLimiter.swept = time.Time{}
+
+	idle := &tokenBucket{}
+	idle.take(limit, now.Add(-time.Hour))
+	busy := &tokenBucket{}
+	for i := 0; i < 10; i++ {
+		busy.take(limit, now)
+	}
+	rateLimiter.buckets["idle"] = idle
+	rateLimiter.buckets["busy"] = busy
+
+	sweepRateLimiter(now)
+	if _, ok := rateLimiter.buckets["idle"]; ok {
+		t.Error("Full bucket should be removed")
+	}
+	if _, ok := rateLimiter.buckets["busy"]; !ok {
+		t.Error("Empty bucket should be kept")
+	}
+}
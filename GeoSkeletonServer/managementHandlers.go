@@ -1,16 +1,13 @@
 package geo_skeleton_server
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"runtime"
 	"time"
 )
 
-//
-// import (
-// 	"./utils"
-// )
-
 // PingHandler provides an api route for server health check
 func PingHandler(w http.ResponseWriter, r *http.Request) {
 	job := HttpRequest{w: w, r: r}
@@ -28,23 +25,219 @@ func PingHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // NewCustomerHandler superuser route to create new api customers/apikeys
-// func NewCustomerHandler(w http.ResponseWriter, r *http.Request) {
-// 	// NetworkLogger.Trace("[In] ", r)
-// 	job := HttpRequest{w: w, r: r}
-// 	if CheckAuthKey(w, r) {
-// 		// new customer
-// 		apikey := utils.NewAPIKey(12)
-// 		customer := Customer{Apikey: apikey}
-// 		err := DB.InsertCustomer(customer)
-// 		if err != nil {
-// 			ServerLogger.Error(err)
-// 			http.Error(w, err.Error(), http.StatusInternalServerError)
-// 			return
-// 		}
-// 		data := HttpMessageResponse{Status: "success", Apikey: apikey, Data: "customer created"}
-// 		js, err := MarshalJsonFromStruct(w, r, data)
-// 		if nil == err {
-// 			SendJsonResponse(w, r, js)
-// 		}
-// 	}
-// }
+// @param apikey superuser key
+// @return json
+func NewCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		err := job.CheckSuperuser()
+		if nil != err {
+			return []byte{}, err
+		}
+		customer := newCustomer()
+		err = DB.InsertCustomer(customer)
+		if nil != err {
+			return []byte{}, err
+		}
+		key, err := DB.CreateApikey(customer.Id, "default", nil)
+		if nil != err {
+			return []byte{}, err
+		}
+		data := HttpMessageResponse{Status: "success", Apikey: key.Apikey, Data: customer}
+		js := job.MarshalJsonFromStruct(data)
+		return js, err
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
+
+// ViewCustomersHandler superuser route listing all customers and their datasources
+// @param apikey superuser key
+// @return json
+func ViewCustomersHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		err := job.CheckSuperuser()
+		if nil != err {
+			return []byte{}, err
+		}
+		values, err := DB.GetCustomers()
+		if nil != err {
+			return []byte{}, err
+		}
+		customers := []Customer{}
+		for _, value := range values {
+			customer := Customer{}
+			err = json.Unmarshal([]byte(value), &customer)
+			if nil != err {
+				return []byte{}, err
+			}
+			customers = append(customers, customer)
+		}
+		data := HttpMessageResponse{Status: "success", Data: customers}
+		js := job.MarshalJsonFromStruct(data)
+		return js, err
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
+
+// DeleteCustomerHandler superuser route to delete a customer/apikey.
+// Layers owned by the customer are not deleted.
+// @param customer customer id
+// @param apikey superuser key
+// @return json
+func DeleteCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		err := job.CheckSuperuser()
+		if nil != err {
+			return []byte{}, err
+		}
+		customer_id, err := job.GetCustomerId()
+		if nil != err {
+			return []byte{}, err
+		}
+		customer, err := DB.LookupCustomer(customer_id)
+		if nil != err {
+			return []byte{}, err
+		}
+		err = DB.DeleteCustomer(customer.Id)
+		if nil != err {
+			return []byte{}, err
+		}
+		data := HttpMessageResponse{Status: "success", Data: "customer deleted"}
+		js := job.MarshalJsonFromStruct(data)
+		return js, err
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
+
+// AssignDatasourceHandler superuser route to assign a datasource to a customer
+// @param customer customer id
+// @param apikey superuser key
+// @body {"datasource": "", "role": "owner"}
+// @return json
+func AssignDatasourceHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		err := job.CheckSuperuser()
+		if nil != err {
+			return []byte{}, err
+		}
+		customer_id, err := job.GetCustomerId()
+		if nil != err {
+			return []byte{}, err
+		}
+		body, err := job.GetRequestBody()
+		if nil != err {
+			return []byte{}, err
+		}
+		req := AssignRequest{}
+		err = json.Unmarshal(body, &req)
+		if nil != err {
+			return []byte{}, err
+		}
+		if "" == req.Datasource {
+			return []byte{}, fmt.Errorf(`Missing parameter`)
+		}
+		if "" == req.Role {
+			req.Role = ROLE_OWNER
+		}
+		if !IsValidRole(req.Role) {
+			return []byte{}, fmt.Errorf("Invalid role: %v", req.Role)
+		}
+		_, err = GeoDB.GetLayer(req.Datasource)
+		if nil != err {
+			return []byte{}, err
+		}
+		customer, err := DB.UpdateCustomer(customer_id, func(customer *Customer) bool {
+			return customer.applyRole(req.Datasource, req.Role)
+		})
+		if nil != err {
+			return []byte{}, err
+		}
+		data := HttpMessageResponse{Status: "success", Datasource: req.Datasource, Data: LayerShare{Customer: customer.Id, Role: req.Role}}
+		js := job.MarshalJsonFromStruct(data)
+		return js, err
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
+
+// UnassignDatasourceHandler superuser route to remove a datasource from a customer
+// @param customer customer id
+// @param ds datasource uuid
+// @param apikey superuser key
+// @return json
+func UnassignDatasourceHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		err := job.CheckSuperuser()
+		if nil != err {
+			return []byte{}, err
+		}
+		customer_id, err := job.GetCustomerId()
+		if nil != err {
+			return []byte{}, err
+		}
+		datasource_id, err := job.GetDatasource()
+		if nil != err {
+			return []byte{}, err
+		}
+		customer, err := DB.LookupCustomer(customer_id)
+		if nil != err {
+			return []byte{}, err
+		}
+		if !customer.hasDatasource(datasource_id) {
+			return []byte{}, fmt.Errorf("Datasource not assigned to customer")
+		}
+		customer.removeDatasource(datasource_id)
+		data := HttpMessageResponse{Status: "success", Datasource: datasource_id, Data: "datasource unassigned"}
+		js := job.MarshalJsonFromStruct(data)
+		return js, err
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
+
+// ViewDatasourcesHandler superuser route listing all layers and their owners
+// @param apikey superuser key
+// @return json
+func ViewDatasourcesHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		err := job.CheckSuperuser()
+		if nil != err {
+			return []byte{}, err
+		}
+		owners, err := DB.GetDatasourceOwners()
+		if nil != err {
+			return []byte{}, err
+		}
+		data := HttpMessageResponse{Status: "success", Data: owners}
+		js := job.MarshalJsonFromStruct(data)
+		return js, err
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
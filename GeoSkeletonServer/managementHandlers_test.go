@@ -0,0 +1,73 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// Unittest superuser management handlers
+func TestManagementHandlers(t *testing.T) {
+	setupTestDb(t)
+
+	for _, authkey := range []string{"", "guess"} {
+		recorder, resp := serveTestRequest(NewCustomerHandler, "/api/v1/customers", "POST", "/api/v1/customers", authkey, "")
+		if http.StatusUnauthorized != recorder.Code || "error" != resp.Status {
+			t.Errorf("Management routes should require the superuser key %q: %v %v", authkey, recorder.Code, resp)
+		}
+	}
+
+	_, resp := serveTestRequest(NewCustomerHandler, "/api/v1/customers", "POST", "/api/v1/customers", SuperuserKey, "")
+	if "success" != resp.Status || "" == resp.Apikey {
+		t.Fatalf("Customer not created: %v", resp)
+	}
+	_, customer, err := DB.AuthenticateApikey(resp.Apikey)
+	if nil != err {
+		t.Fatalf("Apikey of the new customer should authenticate: %v", err)
+	}
+
+	datasource_id, err := DB.NewLayer()
+	if nil != err {
+		t.Fatal(err)
+	}
+	assign := func(body string) HttpMessageResponse {
+		_, resp := serveTestRequest(AssignDatasourceHandler, "/api/v1/customers/{customer}/datasources", "POST", "/api/v1/customers/"+customer.Id+"/datasources", SuperuserKey, body)
+		return resp
+	}
+	if resp := assign(`{"datasource":"` + datasource_id + `","role":"admin"}`); "Invalid role: admin" != resp.Message {
+		t.Errorf("Invalid role should be rejected: %v", resp)
+	}
+	if resp := assign(`{"datasource":"7c2c1a4c6d9b4c0e9b2b8b4c1f6d2e3a"}`); "error" != resp.Status {
+		t.Errorf("Missing layer should not be assigned: %v", resp)
+	}
+	if resp := assign(`{"datasource":"` + datasource_id + `","role":"editor"}`); "success" != resp.Status {
+		t.Fatalf("Layer not assigned: %v", resp)
+	}
+	customer, _ = DB.GetCustomer(customer.Id)
+	if !customer.hasRole(datasource_id, ROLE_EDITOR) || customer.hasRole(datasource_id, ROLE_OWNER) {
+		t.Errorf("Customer should be an editor: %v", customer.Roles)
+	}
+
+	_, resp = serveTestRequest(ViewCustomersHandler, "/api/v1/customers", "GET", "/api/v1/customers", SuperuserKey, "")
+	customers := []Customer{}
+	js, _ := json.Marshal(resp.Data)
+	json.Unmarshal(js, &customers)
+	found := false
+	for _, listed := range customers {
+		found = found || customer.Id == listed.Id
+	}
+	if !found {
+		t.Errorf("Customer not listed: %v", resp)
+	}
+
+	_, resp = serveTestRequest(UnassignDatasourceHandler, "/api/v1/customers/{customer}/datasources/{ds}", "DELETE", "/api/v1/customers/"+customer.Id+"/datasources/"+datasource_id, SuperuserKey, "")
+	customer, _ = DB.GetCustomer(customer.Id)
+	if "success" != resp.Status || customer.hasDatasource(datasource_id) {
+		t.Errorf("Layer not unassigned: %v %v", resp, customer.Datasources)
+	}
+
+	_, resp = serveTestRequest(DeleteCustomerHandler, "/api/v1/customers/{customer}", "DELETE", "/api/v1/customers/"+customer.Id, SuperuserKey, "")
+	if _, err := DB.LookupCustomer(customer.Id); "success" != resp.Status || nil == err {
+		t.Errorf("Customer not deleted: %v", resp)
+	}
+}
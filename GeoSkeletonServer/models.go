@@ -1,32 +1,181 @@
 package geo_skeleton_server
 
-import "./utils"
-import "github.com/paulmach/go.geojson"
+import (
+	"time"
 
-// Customer structure for database
+	"./utils"
+	"github.com/paulmach/go.geojson"
+)
+
+// Datasource roles
+const (
+	ROLE_VIEWER string = "viewer"
+	ROLE_EDITOR string = "editor"
+	ROLE_OWNER  string = "owner"
+)
+
+var roleLevels = map[string]int{
+	ROLE_VIEWER: 1,
+	ROLE_EDITOR: 2,
+	ROLE_OWNER:  3,
+}
+
+// IsValidRole checks if role is a supported datasource role
+func IsValidRole(role string) bool {
+	_, ok := roleLevels[role]
+	return ok
+}
+
+// Customer structure for database. Customers are identified by a public id,
+// the apikey field is only set on records created before apikeys were hashed.
 type Customer struct {
-	Apikey      string      `json:"apikey"`
-	Datasources []string    `json:"datasources"`
-	TileLayers  []TileLayer `json:"tilelayers"`
+	Id          string            `json:"id"`
+	Apikey      string            `json:"apikey,omitempty"`
+	Datasources []string          `json:"datasources"`
+	Roles       map[string]string `json:"roles,omitempty"`
+	TileLayers  []TileLayer       `json:"tilelayers"`
 }
 
 func (self *Customer) hasDatasource(datasource_id string) bool {
 	return utils.StringInSlice(datasource_id, self.Datasources)
 }
 
-func (self *Customer) addDatasource(datasource_id string) {
-	self.Datasources = append(self.Datasources, datasource_id)
-	self.update()
+// getRole returns the customer role for a datasource.
+// Datasources assigned before roles existed belong to their owner.
+func (self *Customer) getRole(datasource_id string) string {
+	if !self.hasDatasource(datasource_id) {
+		return ""
+	}
+	if role, ok := self.Roles[datasource_id]; ok {
+		return role
+	}
+	return ROLE_OWNER
 }
 
-func (self *Customer) removeDatasource(datasource_id string) {
+// hasRole checks if customer has at least the requested role for a datasource
+func (self *Customer) hasRole(datasource_id string, role string) bool {
+	current := self.getRole(datasource_id)
+	if "" == current {
+		return false
+	}
+	return roleLevels[current] >= roleLevels[role]
+}
+
+// setRole assigns datasource to customer with requested role
+func (self *Customer) setRole(datasource_id string, role string) {
+	if !self.hasDatasource(datasource_id) {
+		self.Datasources = append(self.Datasources, datasource_id)
+	}
+	if nil == self.Roles {
+		self.Roles = make(map[string]string)
+	}
+	self.Roles[datasource_id] = role
+}
+
+// migrateRoles sets the owner role on datasources without an assigned role.
+// Returns true if the customer was changed.
+func (self *Customer) migrateRoles() bool {
+	changed := false
+	for _, datasource_id := range self.Datasources {
+		if _, ok := self.Roles[datasource_id]; !ok {
+			self.setRole(datasource_id, ROLE_OWNER)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// applyRole sets the role of a datasource, an empty role removes the datasource.
+// Returns true if the customer was changed.
+func (self *Customer) applyRole(datasource_id string, role string) bool {
+	if "" != role {
+		if role == self.getRole(datasource_id) {
+			return false
+		}
+		self.setRole(datasource_id, role)
+		return true
+	}
 	i := utils.SliceIndex(datasource_id, self.Datasources)
+	if -1 == i {
+		return false
+	}
 	self.Datasources = append(self.Datasources[:i], self.Datasources[i+1:]...)
-	self.update()
+	delete(self.Roles, datasource_id)
+	return true
+}
+
+// updateRole saves the role of a datasource on the stored customer record
+// and keeps the customer in sync with it
+func (self *Customer) updateRole(datasource_id string, role string) {
+	customer, err := DB.UpdateCustomer(self.Id, func(customer *Customer) bool {
+		return customer.applyRole(datasource_id, role)
+	})
+	if nil != err {
+		ServerLogger.Error(err)
+		return
+	}
+	*self = customer
 }
 
-func (self Customer) update() {
-	DB.InsertCustomer(self)
+func (self *Customer) addDatasource(datasource_id string) {
+	self.updateRole(datasource_id, ROLE_OWNER)
+}
+
+func (self *Customer) removeDatasource(datasource_id string) {
+	self.updateRole(datasource_id, "")
+}
+
+// newCustomer creates a customer with a new id
+func newCustomer() Customer {
+	id, _ := utils.NewUUID()
+	return Customer{Id: id}
+}
+
+// LayerMeta structure for database
+type LayerMeta struct {
+	Datasource string `json:"datasource"`
+	Public     bool   `json:"public"`
+}
+
+// LayerShare lists a customer with access to a datasource
+type LayerShare struct {
+	Customer string `json:"customer"`
+	Role     string `json:"role"`
+}
+
+// ShareRequest http request body for sharing layers.
+// The customer can be given by id or by one of their apikeys.
+type ShareRequest struct {
+	Customer string `json:"customer"`
+	Apikey   string `json:"apikey"`
+	Role     string `json:"role"`
+}
+
+// getCustomer returns the customer id or apikey the request refers to
+func (self ShareRequest) getCustomer() string {
+	if "" != self.Customer {
+		return self.Customer
+	}
+	return self.Apikey
+}
+
+// AssignRequest http request body for assigning datasources to customers
+type AssignRequest struct {
+	Datasource string `json:"datasource"`
+	Role       string `json:"role"`
+}
+
+// ApikeyRequest http request body for creating and rotating apikeys.
+// Expires is a unix timestamp and grace_period is in seconds.
+type ApikeyRequest struct {
+	Label       string `json:"label"`
+	Expires     int64  `json:"expires"`
+	GracePeriod int64  `json:"grace_period"`
+}
+
+// PublicRequest http request body for publishing layers
+type PublicRequest struct {
+	Public bool `json:"public"`
 }
 
 type TileLayer struct {
@@ -40,23 +189,65 @@ type PageViewData struct {
 	Version string
 }
 
+// LoginViewData for the login template
+type LoginViewData struct {
+	Next    string
+	Message string
+	Version string
+}
+
 type TcpData struct {
+	Id          string                     `json:"id"`
 	Apikey      string                     `json:"apikey"`
+	Prefix      string                     `json:"prefix"`
+	Salt        string                     `json:"salt"`
+	Hash        string                     `json:"hash"`
+	Customer    string                     `json:"customer"`
+	Label       string                     `json:"label"`
+	Created     time.Time                  `json:"created"`
+	Expires     *time.Time                 `json:"expires"`
+	LastUsed    *time.Time                 `json:"last_used"`
+	Revoked     *time.Time                 `json:"revoked"`
 	Datasources []string                   `json:"datasources"`
+	Roles       map[string]string          `json:"roles"`
 	Datasource  string                     `json:"datasource"`
+	Public      bool                       `json:"public"`
 	Layer       *geojson.FeatureCollection `json:"layer"`
 	Feature     *geojson.Feature           `json:"feature"`
 }
 
 type TcpMessage struct {
-	Apikey     string                     `json:"apikey"`
-	Method     string                     `json:"method"`
-	Datasource string                     `json:"datasource"`
-	File       string                     `json:"file"`
-	GeoId      string                     `json:"geo_id"`
-	Layer      *geojson.FeatureCollection `json:"layer"`
-	Feature    *geojson.Feature           `json:"feature"`
-	Data       TcpData                    `json:"data"`
+	Apikey         string                     `json:"apikey"`
+	Authkey        string                     `json:"authkey"`
+	Method         string                     `json:"method"`
+	Datasource     string                     `json:"datasource"`
+	File           string                     `json:"file"`
+	GeoId          string                     `json:"geo_id"`
+	Version        string                     `json:"version"`
+	Role           string                     `json:"role"`
+	KeyId          string                     `json:"key_id"`
+	Label          string                     `json:"label"`
+	Expires        int64                      `json:"expires"`
+	GracePeriod    int64                      `json:"grace_period"`
+	Timestamp      int64                      `json:"timestamp"`
+	BeginTimestamp int64                      `json:"begin_timestamp"`
+	EndTimestamp   int64                      `json:"end_timestamp"`
+	Stream         bool                       `json:"stream"`
+	Offset         int                        `json:"offset"`
+	Limit          int                        `json:"limit"`
+	Layer          *geojson.FeatureCollection `json:"layer"`
+	Feature        *geojson.Feature           `json:"feature"`
+	Data           TcpData                    `json:"data"`
+	Requests       []TcpMessage               `json:"requests"`
+	Datasources    []string                   `json:"datasources"`
+	Events         []string                   `json:"events"`
+	Epoch          string                     `json:"epoch"`
+	Since          uint64                     `json:"since"`
+	Name           string                     `json:"name"`
+	Committed      int64                      `json:"committed"`
+	StopAt         int64                      `json:"stop_at"`
+	StopOnError    bool                       `json:"stop_on_error"`
+	Progress       int                        `json:"progress"`
 }
 
 type HttpMessageResponse struct {
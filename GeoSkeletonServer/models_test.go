@@ -0,0 +1,22 @@
+package geo_skeleton_server
+
+import (
+	"testing"
+)
+
+// Unittest Customer.applyRole
+func TestCustomerApplyRole(t *testing.T) {
+	customer := Customer{Id: "customer"}
+	if !customer.applyRole("layer", ROLE_EDITOR) || ROLE_EDITOR != customer.getRole("layer") {
+		t.Errorf("Role not applied: %v", customer)
+	}
+	if customer.applyRole("layer", ROLE_EDITOR) {
+		t.Error("Applying the same role should not change the customer")
+	}
+	if !customer.applyRole("layer", "") || customer.hasDatasource("layer") {
+		t.Errorf("Datasource not removed: %v", customer)
+	}
+	if customer.applyRole("layer", "") {
+		t.Error("Removing a missing datasource should not change the customer")
+	}
+}
@@ -0,0 +1,376 @@
+package geo_skeleton_server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RESTORE_PROGRESS_LINES default number of lines between progress reports
+const RESTORE_PROGRESS_LINES = 1000
+
+// RESTORE_MAX_ERRORS rejected lines listed in a restore report
+const RESTORE_MAX_ERRORS = 100
+
+// RESTORE_FLUSH_TIMEOUT time to wait for the restored commit log to be written
+const RESTORE_FLUSH_TIMEOUT = 30 * time.Second
+
+// restoreMethods commit log methods replayed by a restore
+var restoreMethods = map[string]bool{
+	"insert_apikey":     true,
+	"delete_apikey":     true,
+	"insert_key":        true,
+	"insert_layer_meta": true,
+	"assign_datasource": true,
+	"create_datasource": true,
+	"insert_layer":      true,
+	"delete_datasource": true,
+	"delete_layer":      true,
+	"insert_feature":    true,
+	"edit_feature":      true,
+}
+
+// restoreLock keeps restores from running at the same time
+var restoreLock sync.Mutex
+
+// restoring is set while a restore replays a commit log. Only the replay
+// writes to the database, other requests are refused until it ends.
+var restoring int32
+
+// isRestoring checks if a restore is replaying a commit log
+func isRestoring() bool {
+	return 1 == atomic.LoadInt32(&restoring)
+}
+
+// RestoreOptions commit log replay settings. Lines committed after StopAt,
+// in unix nanoseconds, are not replayed. Progress is the number of lines
+// between progress reports.
+type RestoreOptions struct {
+	StopAt      int64
+	StopOnError bool
+	Progress    int
+}
+
+// RestoreProgress lines replayed so far. Committed is the commit time of the
+// last stamped line applied.
+type RestoreProgress struct {
+	Lines      int   `json:"lines"`
+	Applied    int   `json:"applied"`
+	Failed     int   `json:"failed"`
+	Skipped    int   `json:"skipped"`
+	Bytes      int64 `json:"bytes"`
+	TotalBytes int64 `json:"total_bytes"`
+	Committed  int64 `json:"committed,omitempty"`
+}
+
+// RestoreLineError commit log line rejected during a restore
+type RestoreLineError struct {
+	Line   int    `json:"line"`
+	Method string `json:"method,omitempty"`
+	Error  string `json:"error"`
+}
+
+// RestoreVerification contents of the restored database. Problems make the
+// restore fail, warnings are also found in databases that were never restored.
+type RestoreVerification struct {
+	Customers int      `json:"customers"`
+	Apikeys   int      `json:"apikeys"`
+	Layers    int      `json:"layers"`
+	Features  int      `json:"features"`
+	Problems  []string `json:"problems"`
+	Warnings  []string `json:"warnings"`
+}
+
+// RestoreReport result of a commit log replay. Stopped is set when the
+// replay ended at StopAt. Verified is set when every line was applied and
+// the restored database passed verification.
+type RestoreReport struct {
+	RestoreProgress
+	Stopped      bool                `json:"stopped"`
+	Errors       []RestoreLineError  `json:"errors"`
+	Verification RestoreVerification `json:"verification"`
+	Verified     bool                `json:"verified"`
+}
+
+// checkEmptyDatabase makes sure a restore starts from a fresh database
+func checkEmptyDatabase() error {
+	customers, err := DB.GetCustomers()
+	if nil != err {
+		return err
+	}
+	layers, err := GeoDB.GetLayers()
+	if nil != err {
+		return err
+	}
+	if 0 != len(customers) || 0 != len(layers) {
+		return fmt.Errorf("Database is not empty: %v customers, %v layers", len(customers), len(layers))
+	}
+	return nil
+}
+
+// isCommitLog checks if the file is the commit log the restore writes to
+func isCommitLog(file os.FileInfo) bool {
+	info, err := os.Stat(COMMIT_LOG_FILE)
+	return nil == err && os.SameFile(file, info)
+}
+
+// replayLine applies one commit log line
+// @returns bool line was applied
+// @returns Error
+func replayLine(server *TcpServer, req TcpMessage) (bool, error) {
+	if !restoreMethods[req.Method] {
+		return false, nil
+	}
+	atomic.StoreInt64(&DB.replay_committed, req.Committed)
+	defer atomic.StoreInt64(&DB.replay_committed, 0)
+	if "delete_apikey" == req.Method {
+		err := replayDeleteApikey(req)
+		return nil == err, err
+	}
+	capture := &captureConn{}
+	server.handleRequest(req, capture)
+	_, err := capture.response()
+	return nil == err, err
+}
+
+// replayDeleteApikey replays a customer deletion. Customers are deleted
+// through the http api, the tcp server has no method for it.
+func replayDeleteApikey(req TcpMessage) error {
+	if "" == req.Apikey {
+		return fmt.Errorf("Missing required parameters")
+	}
+	return DB.DeleteCustomer(req.Apikey)
+}
+
+// RestoreCommitLog replays a commit log into the empty database. Lines are
+// applied in order through the tcp methods that wrote them. The replay
+// stops at the first line committed after options.StopAt, lines written
+// before commit logs were stamped are applied until then. The database is
+// verified once the replay ends.
+// @param file {string} commit log path
+// @param options {RestoreOptions}
+// @param progress {func(RestoreProgress)} called every options.Progress lines
+// @returns RestoreReport
+// @returns Error
+func RestoreCommitLog(file string, options RestoreOptions, progress func(RestoreProgress)) (RestoreReport, error) {
+	report := RestoreReport{Errors: []RestoreLineError{}}
+
+	restoreLock.Lock()
+	defer restoreLock.Unlock()
+	batchLock.Lock()
+	defer batchLock.Unlock()
+	atomic.StoreInt32(&restoring, 1)
+	defer atomic.StoreInt32(&restoring, 0)
+
+	fh, err := os.Open(file)
+	if nil != err {
+		return report, err
+	}
+	defer fh.Close()
+	info, err := fh.Stat()
+	if nil != err {
+		return report, err
+	}
+	if isCommitLog(info) {
+		return report, fmt.Errorf("Move %v before restoring it, replayed lines are written to the commit log", file)
+	}
+	err = checkEmptyDatabase()
+	if nil != err {
+		return report, err
+	}
+	report.TotalBytes = info.Size()
+
+	interval := options.Progress
+	if 0 >= interval {
+		interval = RESTORE_PROGRESS_LINES
+	}
+
+	server := &TcpServer{}
+	reader := bufio.NewReader(fh)
+	for {
+		line, err := reader.ReadString('\n')
+		if "" == line && io.EOF == err {
+			break
+		}
+		if nil != err && io.EOF != err {
+			return report, err
+		}
+		if nil != progress && 0 != report.Lines && 0 == report.Lines%interval {
+			progress(report.RestoreProgress)
+		}
+		report.Lines++
+		report.Bytes += int64(len(line))
+
+		line = strings.TrimSpace(line)
+		if "" == line {
+			continue
+		}
+		req := TcpMessage{}
+		err = json.Unmarshal([]byte(line), &req)
+		if nil == err && 0 != options.StopAt && options.StopAt < req.Committed {
+			report.Stopped = true
+			break
+		}
+		applied := false
+		if nil == err {
+			applied, err = replayLine(server, req)
+		}
+		if nil != err {
+			report.Failed++
+			if RESTORE_MAX_ERRORS > len(report.Errors) {
+				report.Errors = append(report.Errors, RestoreLineError{Line: report.Lines, Method: req.Method, Error: err.Error()})
+			}
+			if options.StopOnError {
+				break
+			}
+			continue
+		}
+		if !applied {
+			report.Skipped++
+			continue
+		}
+		report.Applied++
+		if 0 != req.Committed {
+			report.Committed = req.Committed
+		}
+	}
+
+	err = DB.FlushCommitLog(RESTORE_FLUSH_TIMEOUT)
+	if nil != err {
+		return report, err
+	}
+	report.Verification, err = VerifyDatabase()
+	if nil != err {
+		return report, err
+	}
+	report.Verified = 0 == report.Failed && 0 == len(report.Verification.Problems)
+	return report, nil
+}
+
+// VerifyDatabase checks every layer, customer and apikey record can be read
+// and refers to existing records
+// @returns RestoreVerification
+// @returns Error
+func VerifyDatabase() (RestoreVerification, error) {
+	verification := RestoreVerification{Problems: []string{}, Warnings: []string{}}
+
+	layers, err := GeoDB.GetLayers()
+	if nil != err {
+		return verification, err
+	}
+	existing := make(map[string]bool)
+	for _, datasource_id := range layers {
+		lyr, err := GeoDB.GetLayer(datasource_id)
+		if nil != err {
+			verification.Problems = append(verification.Problems, fmt.Sprintf("Layer %v can't be read: %v", datasource_id, err))
+			continue
+		}
+		existing[datasource_id] = true
+		verification.Layers++
+		if nil != lyr {
+			verification.Features += len(lyr.Features)
+		}
+	}
+
+	values, err := DB.GetCustomers()
+	if nil != err {
+		return verification, err
+	}
+	customers := make(map[string]bool)
+	for _, value := range values {
+		customer := Customer{}
+		err = json.Unmarshal([]byte(value), &customer)
+		if nil != err {
+			verification.Problems = append(verification.Problems, fmt.Sprintf("Customer record can't be read: %v", err))
+			continue
+		}
+		customers[customer.Id] = true
+		verification.Customers++
+		// deleted layers are removed from their customers
+		for _, datasource_id := range customer.Datasources {
+			if !existing[datasource_id] {
+				verification.Problems = append(verification.Problems, fmt.Sprintf("Customer %v is assigned missing datasource %v", customer.Id, datasource_id))
+			}
+		}
+	}
+
+	keys, err := DB.GetApikeys()
+	if nil != err {
+		verification.Problems = append(verification.Problems, fmt.Sprintf("Apikey records can't be read: %v", err))
+		return verification, nil
+	}
+	for _, key := range keys {
+		verification.Apikeys++
+		if !customers[key.Customer] {
+			verification.Problems = append(verification.Problems, fmt.Sprintf("Apikey %v belongs to missing customer %v", key.Id, key.Customer))
+		}
+	}
+	return verification, nil
+}
+
+// RestoreDatabase replays a commit log into new database files, used by the
+// -restore flag before the server starts. The database is restored next to
+// the working directory and only moved into place once every line was
+// applied and the result verified, a failed restore leaves its files for
+// inspection.
+// @param file {string} commit log path
+// @param options {RestoreOptions}
+// @returns RestoreReport
+// @returns Error
+func RestoreDatabase(file string, options RestoreOptions) (RestoreReport, error) {
+	targets := []string{API_DB_FILE, GEO_DB_FILE, COMMIT_LOG_FILE}
+	for _, target := range targets {
+		if _, err := os.Lstat(target); nil == err {
+			return RestoreReport{}, fmt.Errorf("%v exists, restores need a fresh database", target)
+		}
+	}
+
+	staging, err := ioutil.TempDir(".", "restore-")
+	if nil != err {
+		return RestoreReport{}, err
+	}
+	restored := []string{}
+	for _, target := range targets {
+		restored = append(restored, filepath.Join(staging, filepath.Base(target)))
+	}
+	API_DB_FILE, GEO_DB_FILE, COMMIT_LOG_FILE = restored[0], restored[1], restored[2]
+	err = DB.Init()
+	if nil != err {
+		return RestoreReport{}, err
+	}
+
+	report, err := RestoreCommitLog(file, options, func(progress RestoreProgress) {
+		percent := 100.0
+		if 0 != progress.TotalBytes {
+			percent = RoundToPrecision(100*float64(progress.Bytes)/float64(progress.TotalBytes), 1)
+		}
+		ServerLogger.Info(fmt.Sprintf("Restored %v lines (%v%%), %v applied, %v failed", progress.Lines, percent, progress.Applied, progress.Failed))
+	})
+	if nil != err {
+		return report, fmt.Errorf("%v, restored files left in %v", err, staging)
+	}
+	if !report.Verified {
+		return report, fmt.Errorf("Restore not verified, restored files left in %v", staging)
+	}
+
+	for i, target := range targets {
+		if _, err := os.Lstat(restored[i]); os.IsNotExist(err) {
+			continue
+		}
+		err = os.Rename(restored[i], target)
+		if nil != err {
+			return report, err
+		}
+	}
+	API_DB_FILE, GEO_DB_FILE, COMMIT_LOG_FILE = targets[0], targets[1], targets[2]
+	os.Remove(staging)
+	return report, nil
+}
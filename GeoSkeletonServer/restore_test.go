@@ -0,0 +1,94 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/paulmach/go.geojson"
+)
+
+// Unittest Database.commit
+func TestCommitLogStamp(t *testing.T) {
+	db := Database{commit_log_queue: make(chan string, 1), commit_log_pending: &sync.WaitGroup{}}
+	before := time.Now().UnixNano()
+	db.commit(`{"method": "delete_apikey", "apikey":"0b5a4ac8e1b04bd1be2b5ee0a1a3cf3e"}`)
+
+	req := TcpMessage{}
+	err := json.Unmarshal([]byte(<-db.commit_log_queue), &req)
+	if nil != err {
+		t.Fatalf("Stamped line is not valid json: %v", err)
+	}
+	if "delete_apikey" != req.Method || "0b5a4ac8e1b04bd1be2b5ee0a1a3cf3e" != req.Apikey {
+		t.Errorf("Stamped line lost its fields: %v", req)
+	}
+	if before > req.Committed || time.Now().UnixNano() < req.Committed {
+		t.Errorf("Commit time out of range: %v", req.Committed)
+	}
+
+	if nil == db.FlushCommitLog(10*time.Millisecond) {
+		t.Error("Flush should time out while the line is not written")
+	}
+	db.commit_log_pending.Done()
+	if nil != db.FlushCommitLog(10*time.Millisecond) {
+		t.Error("Flush should return once the line is written")
+	}
+}
+
+// Unittest Database.commitLayer
+func TestCommitLayer(t *testing.T) {
+	db := Database{commit_log_queue: make(chan string, 1), commit_log_pending: &sync.WaitGroup{}}
+	feat := geojson.NewPointFeature([]float64{-76.6, 50.7})
+	err := db.commitLayer(layerCommit{Method: "edit_feature", Datasource: "20f3332781ea4d7b8d509d12517ac5fa", GeoId: "1", Feature: feat})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// layer writes are replayed through the tcp method of the same name
+	req := TcpMessage{}
+	err = json.Unmarshal([]byte(<-db.commit_log_queue), &req)
+	if nil != err {
+		t.Fatalf("Layer commit is not valid json: %v", err)
+	}
+	if "edit_feature" != req.Method || "20f3332781ea4d7b8d509d12517ac5fa" != req.Datasource || "1" != req.GeoId || nil == req.Feature || 0 == req.Committed {
+		t.Errorf("Layer commit can't be replayed: %v", req)
+	}
+	if _, ok := getTcpMethod(req.Method); !ok || !restoreMethods[req.Method] {
+		t.Errorf("Layer commit method is not replayed: %v", req.Method)
+	}
+}
+
+// Unittest requests are refused while a restore replays a commit log
+func TestRefuseWhileRestoring(t *testing.T) {
+	atomic.StoreInt32(&restoring, 1)
+	defer atomic.StoreInt32(&restoring, 0)
+
+	server := &TcpServer{}
+	capture := &captureConn{}
+	server.handleRequest(TcpMessage{Method: "ping"}, &tcpConn{Conn: capture})
+	resp := batchResponse{}
+	json.Unmarshal(capture.buffer.Bytes(), &resp)
+	if "error" != resp.Status || "Restore in progress" != resp.Error {
+		t.Errorf("Tcp request should be refused: %v", capture.buffer.String())
+	}
+
+	// the replay itself is not refused
+	capture = &captureConn{}
+	server.handleRequest(TcpMessage{Method: "ping"}, capture)
+	if _, err := capture.response(); nil != err {
+		t.Errorf("Replayed request should not be refused: %v", err)
+	}
+
+	handler := refuseWhileRestoring(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/ping", nil))
+	if http.StatusServiceUnavailable != recorder.Code {
+		t.Errorf("Http request should be refused, got %v", recorder.Code)
+	}
+}
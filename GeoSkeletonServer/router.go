@@ -13,7 +13,7 @@ func Router() *mux.Router {
 		var handler http.Handler
 		// log.Println("Attaching HTTP handler for route:", route.Method, route.Pattern)
 		ServerLogger.Info("Attaching HTTP handler for route: ", route.Method, " ", route.Pattern)
-		handler = route.HandlerFunc
+		handler = refuseWhileRestoring(route.HandlerFunc)
 		router.
 			Methods(route.Method).
 			Path(route.Pattern).
@@ -22,3 +22,18 @@ func Router() *mux.Router {
 	}
 	return router
 }
+
+// refuseWhileRestoring answers requests with 503 while a restore replays a
+// commit log
+func refuseWhileRestoring(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isRestoring() {
+			handler(w, r)
+			return
+		}
+		job := HttpRequest{w: w, r: r}
+		job.w.Header().Set("Content-Type", "application/json")
+		job.WriteHeaders(http.StatusServiceUnavailable)
+		job.SendJsonResponse(job.MarshalJsonFromStruct(HttpMessageResponse{Status: "error", Message: "Restore in progress"}))
+	}
+}
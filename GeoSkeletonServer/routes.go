@@ -19,6 +19,8 @@ var routes = apiRoutes{
 	apiRoute{"Index", "GET", "/", IndexHandler},
 	apiRoute{"Map", "GET", "/map", MapHandler},
 	apiRoute{"Dashboard", "GET", "/dashboard", DashboardHandler},
+	apiRoute{"LoginPage", "GET", "/login", LoginPageHandler},
+	apiRoute{"Login", "POST", "/login", LoginHandler},
 
 	// Health check
 	apiRoute{"Ping", "GET", "/ping", PingHandler},
@@ -26,6 +28,7 @@ var routes = apiRoutes{
 	// Layers
 	apiRoute{"ViewLayers", "GET", "/api/v1/layers", ViewLayersHandler},
 	apiRoute{"ViewCustomer", "GET", "/api/v1/customer", ViewLayersHandler},
+	apiRoute{"ViewUsage", "GET", "/api/v1/customer/usage", ViewUsageHandler},
 	apiRoute{"ViewLayer", "GET", "/api/v1/layer/{ds}", ViewLayerHandler},
 	apiRoute{"NewLayer", "POST", "/api/v1/layer", NewLayerHandler},
 	apiRoute{"DeleteLayer", "DELETE", "/api/v1/layer/{ds}", DeleteLayerHandler},
@@ -33,13 +36,32 @@ var routes = apiRoutes{
 	apiRoute{"NewFeature", "POST", "/api/v1/layer/{ds}/feature", NewFeatureHandler},
 	apiRoute{"ViewFeature", "GET", "/api/v1/layer/{ds}/feature/{k}", ViewFeatureHandler},
 	apiRoute{"EditFeature", "PUT", "/api/v1/layer/{ds}/feature/{k}", EditFeatureHandler},
+	apiRoute{"ViewFeatureHistory", "GET", "/api/v1/layer/{ds}/feature/{k}/history", ViewFeatureHistoryHandler},
 
 	apiRoute{"ViewLayerTimestamps", "GET", "/api/v1/layer/{ds}/ts", ViewLayerTimestampsHandler},
 	apiRoute{"ViewLayerPerviousTimestamp", "GET", "/api/v1/layer/{ds}/ts/{ts}", ViewLayerPerviousTimestampHandler},
+	apiRoute{"ViewLayerTimestampDiff", "GET", "/api/v1/layer/{ds}/ts/{a}/diff/{b}", ViewLayerTimestampDiffHandler},
+	apiRoute{"RestoreLayerTimestamp", "POST", "/api/v1/layer/{ds}/ts/{ts}/restore", RestoreLayerTimestampHandler},
+
+	// Sharing
+	apiRoute{"ShareLayer", "POST", "/api/v1/layer/{ds}/share", ShareLayerHandler},
+	apiRoute{"ViewLayerShares", "GET", "/api/v1/layer/{ds}/share", ViewLayerSharesHandler},
+	apiRoute{"RevokeLayerShare", "DELETE", "/api/v1/layer/{ds}/share", RevokeLayerShareHandler},
+	apiRoute{"PublishLayer", "PUT", "/api/v1/layer/{ds}/public", PublishLayerHandler},
+
+	// Apikeys
+	apiRoute{"ViewApikeys", "GET", "/api/v1/apikeys", ViewApikeysHandler},
+	apiRoute{"NewApikey", "POST", "/api/v1/apikeys", NewApikeyHandler},
+	apiRoute{"RotateApikey", "POST", "/api/v1/apikeys/{key}/rotate", RotateApikeyHandler},
+	apiRoute{"RevokeApikey", "DELETE", "/api/v1/apikeys/{key}", RevokeApikeyHandler},
 
 	// Superuser apiRoutes
-	// apiRoute{"NewCustomerHandler", "POST", "/api/v1/customer", NewCustomerHandler},
-	//apiRoute{"AllCustomerDatasources", "GET", "/api/v1/customers", AllCustomerDatasources},
+	apiRoute{"NewCustomer", "POST", "/api/v1/customers", NewCustomerHandler},
+	apiRoute{"ViewCustomers", "GET", "/api/v1/customers", ViewCustomersHandler},
+	apiRoute{"DeleteCustomer", "DELETE", "/api/v1/customers/{customer}", DeleteCustomerHandler},
+	apiRoute{"AssignDatasource", "POST", "/api/v1/customers/{customer}/datasources", AssignDatasourceHandler},
+	apiRoute{"UnassignDatasource", "DELETE", "/api/v1/customers/{customer}/datasources/{ds}", UnassignDatasourceHandler},
+	apiRoute{"ViewDatasources", "GET", "/api/v1/datasources", ViewDatasourcesHandler},
 
 	// Web Socket apiRoute
 	apiRoute{"Socket", "GET", "/ws/{ds}", serveWs},
@@ -0,0 +1,217 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ShareLayerHandler shares a layer with another customer. Requires owner role.
+// @param ds
+// @param apikey
+// @body {"customer": "", "role": "viewer"}
+// @return json
+func ShareLayerHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		customer, err := job.GetCustomer()
+		if nil != err {
+			return []byte{}, err
+		}
+		datasource_id, err := job.GetDatasource()
+		if nil != err {
+			return []byte{}, err
+		}
+		if customer.hasRole(datasource_id, ROLE_OWNER) {
+			body, err := job.GetRequestBody()
+			if nil != err {
+				return []byte{}, err
+			}
+			share := ShareRequest{}
+			err = json.Unmarshal(body, &share)
+			if nil != err {
+				return []byte{}, err
+			}
+			if "" == share.Role {
+				share.Role = ROLE_VIEWER
+			}
+			if !IsValidRole(share.Role) {
+				return []byte{}, fmt.Errorf("Invalid role: %v", share.Role)
+			}
+			target, err := DB.LookupCustomer(share.getCustomer())
+			if nil != err {
+				return []byte{}, err
+			}
+			if customer.Id == target.Id {
+				return []byte{}, fmt.Errorf("Cannot change own role")
+			}
+			// hold the layer so owners can't demote each other at the same time
+			unlock := lockLayer(datasource_id)
+			defer unlock()
+			if ROLE_OWNER != share.Role {
+				roles, err := DB.GetDatasourceRoles(datasource_id)
+				if nil != err {
+					return []byte{}, err
+				}
+				owners := 0
+				for _, role := range roles {
+					if ROLE_OWNER == role {
+						owners++
+					}
+				}
+				if ROLE_OWNER == roles[target.Id] && 1 >= owners {
+					return []byte{}, fmt.Errorf("Cannot demote the last owner")
+				}
+			}
+			target, err = DB.UpdateCustomer(target.Id, func(target *Customer) bool {
+				return target.applyRole(datasource_id, share.Role)
+			})
+			if nil != err {
+				return []byte{}, err
+			}
+			data := HttpMessageResponse{Status: "success", Datasource: datasource_id, Data: LayerShare{Customer: target.Id, Role: share.Role}}
+			js := job.MarshalJsonFromStruct(data)
+			return js, err
+		}
+		return []byte{}, fmt.Errorf(`Unauthorized`)
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
+
+// ViewLayerSharesHandler lists customers with access to a layer. Requires owner role.
+// @param ds
+// @param apikey
+// @return json
+func ViewLayerSharesHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		customer, err := job.GetCustomer()
+		if nil != err {
+			return []byte{}, err
+		}
+		datasource_id, err := job.GetDatasource()
+		if nil != err {
+			return []byte{}, err
+		}
+		if customer.hasRole(datasource_id, ROLE_OWNER) {
+			shares, err := DB.GetLayerShares(datasource_id)
+			if nil != err {
+				return []byte{}, err
+			}
+			data := make(map[string]interface{})
+			data["shares"] = shares
+			data["public"] = DB.IsPublicLayer(datasource_id)
+			resp := HttpMessageResponse{Status: "success", Datasource: datasource_id, Data: data}
+			js := job.MarshalJsonFromStruct(resp)
+			return js, err
+		}
+		return []byte{}, fmt.Errorf(`Unauthorized`)
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
+
+// RevokeLayerShareHandler removes another customer's access to a layer. Requires owner role.
+// @param ds
+// @param apikey
+// @body {"customer": ""}
+// @return json
+func RevokeLayerShareHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		customer, err := job.GetCustomer()
+		if nil != err {
+			return []byte{}, err
+		}
+		datasource_id, err := job.GetDatasource()
+		if nil != err {
+			return []byte{}, err
+		}
+		if customer.hasRole(datasource_id, ROLE_OWNER) {
+			body, err := job.GetRequestBody()
+			if nil != err {
+				return []byte{}, err
+			}
+			share := ShareRequest{}
+			err = json.Unmarshal(body, &share)
+			if nil != err {
+				return []byte{}, err
+			}
+			target, err := DB.LookupCustomer(share.getCustomer())
+			if nil != err {
+				return []byte{}, err
+			}
+			if customer.Id == target.Id {
+				return []byte{}, fmt.Errorf("Cannot revoke own access")
+			}
+			if !target.hasDatasource(datasource_id) {
+				return []byte{}, fmt.Errorf("Layer not shared with customer")
+			}
+			target.removeDatasource(datasource_id)
+			data := HttpMessageResponse{Status: "success", Datasource: datasource_id, Data: "share revoked"}
+			js := job.MarshalJsonFromStruct(data)
+			return js, err
+		}
+		return []byte{}, fmt.Errorf(`Unauthorized`)
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
+
+// PublishLayerHandler marks a layer as public so it can be read without an apikey. Requires owner role.
+// @param ds
+// @param apikey
+// @body {"public": true}
+// @return json
+func PublishLayerHandler(w http.ResponseWriter, r *http.Request) {
+	job := HttpRequest{w: w, r: r}
+	js, err := func() ([]byte, error) {
+		customer, err := job.GetCustomer()
+		if nil != err {
+			return []byte{}, err
+		}
+		datasource_id, err := job.GetDatasource()
+		if nil != err {
+			return []byte{}, err
+		}
+		if customer.hasRole(datasource_id, ROLE_OWNER) {
+			body, err := job.GetRequestBody()
+			if nil != err {
+				return []byte{}, err
+			}
+			req := PublicRequest{}
+			err = json.Unmarshal(body, &req)
+			if nil != err {
+				return []byte{}, err
+			}
+			meta, err := DB.GetLayerMeta(datasource_id)
+			if nil != err {
+				return []byte{}, err
+			}
+			meta.Public = req.Public
+			err = DB.InsertLayerMeta(meta)
+			if nil != err {
+				return []byte{}, err
+			}
+			data := HttpMessageResponse{Status: "success", Datasource: datasource_id, Data: meta}
+			js := job.MarshalJsonFromStruct(data)
+			return js, err
+		}
+		return []byte{}, fmt.Errorf(`Unauthorized`)
+	}()
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js = job.MarshalJsonFromStruct(data)
+	}
+	job.SendJsonResponse(js)
+}
@@ -0,0 +1,126 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+var testDbOnce sync.Once
+
+// setupTestDb initializes DB on temporary files unless another test already did
+func setupTestDb(t *testing.T) {
+	testDbOnce.Do(func() {
+		if nil != DB.commit_log_queue {
+			return
+		}
+		dir, err := ioutil.TempDir("", "gskel")
+		if nil != err {
+			t.Fatal(err)
+		}
+		API_DB_FILE = filepath.Join(dir, "api.db")
+		GEO_DB_FILE = filepath.Join(dir, "geo.db")
+		COMMIT_LOG_FILE = filepath.Join(dir, "api_commit.log")
+		DB = Database{File: API_DB_FILE}
+		err = DB.Init()
+		if nil != err {
+			t.Fatal(err)
+		}
+	})
+}
+
+// newTestCustomer creates a customer holding role on datasource_id
+// @returns Customer
+// @returns string apikey
+func newTestCustomer(t *testing.T, datasource_id string, role string) (Customer, string) {
+	customer := newCustomer()
+	customer.applyRole(datasource_id, role)
+	err := DB.InsertCustomer(customer)
+	if nil != err {
+		t.Fatal(err)
+	}
+	key, err := DB.CreateApikey(customer.Id, "test", nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return customer, key.Apikey
+}
+
+// serveTestRequest sends a request to handler mounted on pattern
+// @returns *httptest.ResponseRecorder
+// @returns HttpMessageResponse
+func serveTestRequest(handler http.HandlerFunc, pattern string, method string, url string, apikey string, body string) (*httptest.ResponseRecorder, HttpMessageResponse) {
+	router := mux.NewRouter()
+	router.HandleFunc(pattern, handler)
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	if "" != apikey {
+		r.Header.Set("X-API-Key", apikey)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, r)
+	resp := HttpMessageResponse{}
+	json.Unmarshal(recorder.Body.Bytes(), &resp)
+	return recorder, resp
+}
+
+// Unittest ShareLayerHandler
+func TestShareLayerHandler(t *testing.T) {
+	setupTestDb(t)
+	datasource_id := "6e3e3cf4ae7a4ca8a0fbbd1d3cbdd1a5"
+	url := "/api/v1/layer/" + datasource_id + "/share"
+	share := func(apikey string, body string) HttpMessageResponse {
+		_, resp := serveTestRequest(ShareLayerHandler, "/api/v1/layer/{ds}/share", "POST", url, apikey, body)
+		return resp
+	}
+	role := func(customer Customer) string {
+		roles, err := DB.GetDatasourceRoles(datasource_id)
+		if nil != err {
+			t.Fatal(err)
+		}
+		return roles[customer.Id]
+	}
+
+	owner, owner_apikey := newTestCustomer(t, datasource_id, ROLE_OWNER)
+	other, other_apikey := newTestCustomer(t, datasource_id, ROLE_VIEWER)
+
+	resp := share(owner_apikey, `{"customer":"`+owner.Id+`","role":"viewer"}`)
+	if "Cannot change own role" != resp.Message || ROLE_OWNER != role(owner) {
+		t.Errorf("Owner should not change their own role: %v", resp)
+	}
+	resp = share(other_apikey, `{"customer":"`+owner.Id+`","role":"viewer"}`)
+	if "Unauthorized" != resp.Message {
+		t.Errorf("Viewer should not share the layer: %v", resp)
+	}
+	resp = share(owner_apikey, `{"customer":"`+other.Id+`","role":"owner"}`)
+	if "success" != resp.Status || ROLE_OWNER != role(other) {
+		t.Fatalf("Owner should share the layer: %v", resp)
+	}
+
+	// both owners demote each other, only one of them can succeed
+	var wg sync.WaitGroup
+	results := make([]HttpMessageResponse, 2)
+	for i, req := range [][]string{{owner_apikey, other.Id}, {other_apikey, owner.Id}} {
+		wg.Add(1)
+		go func(i int, apikey string, target string) {
+			defer wg.Done()
+			results[i] = share(apikey, `{"customer":"`+target+`","role":"viewer"}`)
+		}(i, req[0], req[1])
+	}
+	wg.Wait()
+	owners := 0
+	for _, customer := range []Customer{owner, other} {
+		if ROLE_OWNER == role(customer) {
+			owners++
+		}
+	}
+	if 1 != owners {
+		t.Errorf("Layer should keep one owner: %v %v", owners, results)
+	}
+}
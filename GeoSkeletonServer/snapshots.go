@@ -0,0 +1,294 @@
+package geo_skeleton_server
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"github.com/paulmach/go.geojson"
+)
+
+// PropertyChange holds the before and after values of a feature property
+type PropertyChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// GeometryChange holds the before and after geometry of a feature
+type GeometryChange struct {
+	Before *geojson.Geometry `json:"before"`
+	After  *geojson.Geometry `json:"after"`
+}
+
+// FeatureChange describes how a single feature differs between two snapshots
+type FeatureChange struct {
+	GeoId      string                    `json:"geo_id"`
+	Properties map[string]PropertyChange `json:"properties,omitempty"`
+	Geometry   *GeometryChange           `json:"geometry,omitempty"`
+}
+
+// LayerDiff lists added, removed and modified features between two snapshots
+type LayerDiff struct {
+	From     string             `json:"from"`
+	To       string             `json:"to"`
+	Added    []*geojson.Feature `json:"added"`
+	Removed  []*geojson.Feature `json:"removed"`
+	Modified []FeatureChange    `json:"modified"`
+}
+
+// HasChanges returns true if any features were added, removed or modified
+func (self LayerDiff) HasChanges() bool {
+	return 0 != len(self.Added) || 0 != len(self.Removed) || 0 != len(self.Modified)
+}
+
+// GetLayerSnapshot returns the layer as it was stored at the requested timestamp
+// @param datasource_id {string}
+// @param ts {int64}
+// @returns FeatureCollection
+// @returns Error
+func GetLayerSnapshot(datasource_id string, ts int64) (*geojson.FeatureCollection, error) {
+	lyr_ts, err := GeoDB.SelectTimeseriesDatasource(datasource_id)
+	if nil != err {
+		return nil, err
+	}
+	val, err := lyr_ts.GetPreviousByTimestamp(ts)
+	if nil != err {
+		return nil, err
+	}
+	return geojson.UnmarshalFeatureCollection([]byte(val))
+}
+
+// getFeatureGeoId returns the geo_id property of a feature
+func getFeatureGeoId(feat *geojson.Feature) string {
+	return fmt.Sprintf("%v", feat.Properties["geo_id"])
+}
+
+// indexFeatures maps features by geo_id, preserving the original order of keys
+func indexFeatures(lyr *geojson.FeatureCollection) (map[string]*geojson.Feature, []string) {
+	index := make(map[string]*geojson.Feature)
+	var keys []string
+	if nil == lyr {
+		return index, keys
+	}
+	for _, feat := range lyr.Features {
+		geo_id := getFeatureGeoId(feat)
+		if _, ok := index[geo_id]; !ok {
+			keys = append(keys, geo_id)
+		}
+		index[geo_id] = feat
+	}
+	return index, keys
+}
+
+// diffFeatures compares two versions of the same feature.
+// Returns nil if both versions are equal.
+func diffFeatures(before *geojson.Feature, after *geojson.Feature) *FeatureChange {
+	change := FeatureChange{GeoId: getFeatureGeoId(after)}
+
+	properties := make(map[string]PropertyChange)
+	for key, value := range before.Properties {
+		if !reflect.DeepEqual(value, after.Properties[key]) {
+			properties[key] = PropertyChange{Before: value, After: after.Properties[key]}
+		}
+	}
+	for key, value := range after.Properties {
+		if _, ok := before.Properties[key]; !ok {
+			properties[key] = PropertyChange{Before: nil, After: value}
+		}
+	}
+	if 0 != len(properties) {
+		change.Properties = properties
+	}
+
+	if !geometryEqual(before.Geometry, after.Geometry) {
+		change.Geometry = &GeometryChange{Before: before.Geometry, After: after.Geometry}
+	}
+
+	if nil == change.Properties && nil == change.Geometry {
+		return nil
+	}
+	return &change
+}
+
+// geometryEqual compares geometries by their geojson encoding
+func geometryEqual(a *geojson.Geometry, b *geojson.Geometry) bool {
+	if nil == a || nil == b {
+		return a == b
+	}
+	a_js, err := a.MarshalJSON()
+	if nil != err {
+		return false
+	}
+	b_js, err := b.MarshalJSON()
+	if nil != err {
+		return false
+	}
+	return bytes.Equal(a_js, b_js)
+}
+
+// DiffLayers matches features by geo_id and returns the changes
+// required to go from layer a to layer b.
+// @param a {FeatureCollection}
+// @param b {FeatureCollection}
+// @returns LayerDiff
+func DiffLayers(a *geojson.FeatureCollection, b *geojson.FeatureCollection) LayerDiff {
+	diff := LayerDiff{
+		Added:    []*geojson.Feature{},
+		Removed:  []*geojson.Feature{},
+		Modified: []FeatureChange{},
+	}
+
+	before, before_keys := indexFeatures(a)
+	after, after_keys := indexFeatures(b)
+
+	for _, geo_id := range before_keys {
+		if _, ok := after[geo_id]; !ok {
+			diff.Removed = append(diff.Removed, before[geo_id])
+		}
+	}
+
+	for _, geo_id := range after_keys {
+		feat, ok := before[geo_id]
+		if !ok {
+			diff.Added = append(diff.Added, after[geo_id])
+			continue
+		}
+		change := diffFeatures(feat, after[geo_id])
+		if nil != change {
+			diff.Modified = append(diff.Modified, *change)
+		}
+	}
+
+	return diff
+}
+
+// DiffLayerSnapshots returns the changes between two stored snapshots of a layer
+// @param datasource_id {string}
+// @param a {int64}
+// @param b {int64}
+// @returns LayerDiff
+// @returns Error
+func DiffLayerSnapshots(datasource_id string, a int64, b int64) (LayerDiff, error) {
+	lyr_a, err := GetLayerSnapshot(datasource_id, a)
+	if nil != err {
+		return LayerDiff{}, err
+	}
+	lyr_b, err := GetLayerSnapshot(datasource_id, b)
+	if nil != err {
+		return LayerDiff{}, err
+	}
+	diff := DiffLayers(lyr_a, lyr_b)
+	diff.From = fmt.Sprintf("%v", a)
+	diff.To = fmt.Sprintf("%v", b)
+	return diff, nil
+}
+
+// RestoreLayerSnapshot replaces the current contents of a layer with the snapshot
+// stored at the requested timestamp. Inserting the layer records a new snapshot.
+// When dry_run is set the layer is left untouched and only the changes are returned.
+// @param datasource_id {string}
+// @param ts {int64}
+// @param dry_run {bool}
+// @returns LayerDiff
+// @returns Error
+func RestoreLayerSnapshot(datasource_id string, ts int64, dry_run bool) (LayerDiff, error) {
+	current, err := GeoDB.GetLayer(datasource_id)
+	if nil != err {
+		return LayerDiff{}, err
+	}
+	snapshot, err := GetLayerSnapshot(datasource_id, ts)
+	if nil != err {
+		return LayerDiff{}, err
+	}
+	diff := DiffLayers(current, snapshot)
+	diff.To = fmt.Sprintf("%v", ts)
+	if dry_run {
+		return diff, nil
+	}
+	err = DB.InsertLayer(datasource_id, snapshot)
+	if nil != err {
+		return LayerDiff{}, err
+	}
+	resetDatasourceUsage(datasource_id)
+	ServerLogger.Info("Layer ", datasource_id, " restored to snapshot ", ts)
+	publishLayerDiff(datasource_id, diff)
+	return diff, nil
+}
+
+// FeatureVersion is a distinct version of a feature found in the layer timeseries
+type FeatureVersion struct {
+	Timestamp string           `json:"timestamp"`
+	Deleted   bool             `json:"deleted,omitempty"`
+	Feature   *geojson.Feature `json:"feature,omitempty"`
+}
+
+// findFeature returns the feature with the matching geo_id
+func findFeature(lyr *geojson.FeatureCollection, geo_id string) (*geojson.Feature, error) {
+	if nil != lyr {
+		for _, feat := range lyr.Features {
+			if getFeatureGeoId(feat) == geo_id {
+				return feat, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Not found")
+}
+
+// GetFeatureHistory walks the layer timeseries and returns every distinct
+// version of a feature, oldest first. A version is marked as deleted when
+// the feature disappears from the layer.
+// @param datasource_id {string}
+// @param geo_id {string}
+// @returns []FeatureVersion
+// @returns Error
+func GetFeatureHistory(datasource_id string, geo_id string) ([]FeatureVersion, error) {
+	lyr_ts, err := GeoDB.SelectTimeseriesDatasource(datasource_id)
+	if nil != err {
+		return nil, err
+	}
+
+	versions := []FeatureVersion{}
+	var previous *geojson.Feature
+	for _, ts := range lyr_ts.GetSnapshots() {
+		val, err := lyr_ts.GetPreviousByTimestamp(ts)
+		if nil != err {
+			return nil, err
+		}
+		lyr, err := geojson.UnmarshalFeatureCollection([]byte(val))
+		if nil != err {
+			return nil, err
+		}
+		timestamp := fmt.Sprintf("%v", ts)
+		feat, err := findFeature(lyr, geo_id)
+		if nil != err {
+			if nil != previous {
+				versions = append(versions, FeatureVersion{Timestamp: timestamp, Deleted: true})
+				previous = nil
+			}
+			continue
+		}
+		if nil == previous || nil != diffFeatures(previous, feat) {
+			versions = append(versions, FeatureVersion{Timestamp: timestamp, Feature: feat})
+		}
+		previous = feat
+	}
+
+	if 0 == len(versions) {
+		return versions, fmt.Errorf("Not found")
+	}
+	return versions, nil
+}
+
+// GetFeatureAtTimestamp returns a feature as it was stored at the requested timestamp
+// @param datasource_id {string}
+// @param geo_id {string}
+// @param ts {int64}
+// @returns Feature
+// @returns Error
+func GetFeatureAtTimestamp(datasource_id string, geo_id string, ts int64) (*geojson.Feature, error) {
+	lyr, err := GetLayerSnapshot(datasource_id, ts)
+	if nil != err {
+		return nil, err
+	}
+	return findFeature(lyr, geo_id)
+}
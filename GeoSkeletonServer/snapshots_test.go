@@ -0,0 +1,183 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/paulmach/go.geojson"
+
+const (
+	testSnapshotBefore string = `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[1,1]},"properties":{"geo_id":"1","name":"hydrant"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[2,2]},"properties":{"geo_id":"2","name":"valve"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[3,3]},"properties":{"geo_id":"3","name":"pipe"}}]}`
+	testSnapshotAfter  string = `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[1,1]},"properties":{"geo_id":"1","name":"hydrant"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[5,5]},"properties":{"geo_id":"2","name":"valve","status":"broken"}},{"type":"Feature","geometry":{"type":"Point","coordinates":[4,4]},"properties":{"geo_id":"4","name":"meter"}}]}`
+)
+
+// Unittest DiffLayers
+func TestDiffLayers(t *testing.T) {
+	before, err := geojson.UnmarshalFeatureCollection([]byte(testSnapshotBefore))
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := geojson.UnmarshalFeatureCollection([]byte(testSnapshotAfter))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff := DiffLayers(before, after)
+
+	if 1 != len(diff.Added) || "4" != getFeatureGeoId(diff.Added[0]) {
+		t.Errorf("Unexpected added features: %v", diff.Added)
+	}
+	if 1 != len(diff.Removed) || "3" != getFeatureGeoId(diff.Removed[0]) {
+		t.Errorf("Unexpected removed features: %v", diff.Removed)
+	}
+	if 1 != len(diff.Modified) {
+		t.Fatalf("Unexpected modified features: %v", diff.Modified)
+	}
+
+	change := diff.Modified[0]
+	if "2" != change.GeoId {
+		t.Errorf("Unexpected modified feature: %v", change.GeoId)
+	}
+	if _, ok := change.Properties["status"]; !ok {
+		t.Errorf("Missing property change: %v", change.Properties)
+	}
+	if _, ok := change.Properties["name"]; ok {
+		t.Errorf("Unchanged property reported: %v", change.Properties)
+	}
+	if nil == change.Geometry {
+		t.Error("Missing geometry change")
+	}
+
+	if DiffLayers(before, before).HasChanges() {
+		t.Error("Identical layers reported changes")
+	}
+}
+
+// newTestSnapshots creates a layer saved as testSnapshotBefore and then as testSnapshotAfter
+// @returns string datasource_id
+// @returns int64 timestamp between the two snapshots
+func newTestSnapshots(t *testing.T) (string, int64) {
+	setupTestDb(t)
+	datasource_id, err := DB.NewLayer()
+	if nil != err {
+		t.Fatal(err)
+	}
+	var ts int64
+	for i, data := range []string{testSnapshotBefore, testSnapshotAfter} {
+		if 1 == i {
+			time.Sleep(time.Millisecond)
+			ts = time.Now().UnixNano()
+			time.Sleep(time.Millisecond)
+		}
+		lyr, err := geojson.UnmarshalFeatureCollection([]byte(data))
+		if nil != err {
+			t.Fatal(err)
+		}
+		err = DB.InsertLayer(datasource_id, lyr)
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	return datasource_id, ts
+}
+
+// Unittest RestoreLayerSnapshot
+func TestRestoreLayerSnapshot(t *testing.T) {
+	datasource_id, ts := newTestSnapshots(t)
+
+	diff, err := RestoreLayerSnapshot(datasource_id, ts, true)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(diff.Added) || "3" != getFeatureGeoId(diff.Added[0]) || 1 != len(diff.Removed) || "4" != getFeatureGeoId(diff.Removed[0]) || 1 != len(diff.Modified) {
+		t.Errorf("Unexpected restore diff: %v", diff)
+	}
+	lyr, err := GeoDB.GetLayer(datasource_id)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err := findFeature(lyr, "4"); nil != err {
+		t.Error("Dry run should not change the layer")
+	}
+
+	_, err = RestoreLayerSnapshot(datasource_id, ts, false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	lyr, err = GeoDB.GetLayer(datasource_id)
+	if nil != err {
+		t.Fatal(err)
+	}
+	before, _ := geojson.UnmarshalFeatureCollection([]byte(testSnapshotBefore))
+	if diff := DiffLayers(before, lyr); diff.HasChanges() {
+		t.Errorf("Layer should match the snapshot: %v", diff)
+	}
+}
+
+// Unittest GetFeatureAtTimestamp
+func TestGetFeatureAtTimestamp(t *testing.T) {
+	datasource_id, ts := newTestSnapshots(t)
+
+	feat, err := GetFeatureAtTimestamp(datasource_id, "2", ts)
+	if nil != err || nil != feat.Properties["status"] {
+		t.Errorf("Expected the first version of the feature: %v %v", feat, err)
+	}
+	feat, err = GetFeatureAtTimestamp(datasource_id, "2", time.Now().UnixNano())
+	if nil != err || "broken" != feat.Properties["status"] {
+		t.Errorf("Expected the current version of the feature: %v %v", feat, err)
+	}
+	if _, err := GetFeatureAtTimestamp(datasource_id, "4", ts); nil == err {
+		t.Error("Feature added later should not be found")
+	}
+	if _, err := GetFeatureAtTimestamp(datasource_id, "2", 0); nil == err {
+		t.Error("Feature should not be found before the layer was created")
+	}
+}
+
+// Unittest TcpServer.export_datasource_by_range and export_datasource_by_snapshot
+func TestExportDatasourceSnapshots(t *testing.T) {
+	datasource_id, ts := newTestSnapshots(t)
+	server := &TcpServer{}
+
+	capture := &captureConn{}
+	server.export_datasource_by_range(TcpMessage{Datasource: datasource_id, BeginTimestamp: ts, EndTimestamp: time.Now().UnixNano()}, capture)
+	lines := strings.Split(strings.TrimSpace(capture.buffer.String()), "\n")
+	if 2 != len(lines) {
+		t.Fatalf("Expected one snapshot and the summary: %v", lines)
+	}
+	snapshot := struct {
+		Data rangeSnapshot `json:"data"`
+	}{}
+	json.Unmarshal([]byte(lines[0]), &snapshot)
+	lyr, err := geojson.UnmarshalFeatureCollection(snapshot.Data.Layer)
+	if nil != err || datasource_id != snapshot.Data.Datasource {
+		t.Fatalf("Invalid snapshot: %v %v", lines[0], err)
+	}
+	if _, err := findFeature(lyr, "4"); nil != err {
+		t.Errorf("Expected the second snapshot: %v", lines[0])
+	}
+	summary := struct {
+		Data rangeSummary `json:"data"`
+	}{}
+	json.Unmarshal([]byte(lines[1]), &summary)
+	if 1 != summary.Data.Snapshots {
+		t.Errorf("Unexpected summary: %v", lines[1])
+	}
+
+	capture = &captureConn{}
+	server.export_datasource_by_snapshot(TcpMessage{Datasource: datasource_id, Timestamp: ts}, capture)
+	resp, err := capture.response()
+	if nil != err {
+		t.Fatal(err)
+	}
+	lyr, err = geojson.UnmarshalFeatureCollection(resp.Data)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err := findFeature(lyr, "3"); nil != err {
+		t.Errorf("Expected the first snapshot: %v", string(resp.Data))
+	}
+}
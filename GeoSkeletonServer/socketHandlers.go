@@ -1,7 +1,9 @@
 package geo_skeleton_server
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 )
 
@@ -11,10 +13,11 @@ import (
 )
 
 type connection struct {
-	ws *websocket.Conn
-	ds string
-	ip string
-	c  int
+	ws       *websocket.Conn
+	ds       string
+	ip       string
+	c        int
+	readonly bool
 }
 
 type hub struct {
@@ -61,6 +64,17 @@ func (self hub) broadcastAllDsViewers(update bool, ds string) {
 	}
 }
 
+// connections returns the number of open websockets
+func (self *hub) connections() int {
+	self.guard.RLock()
+	defer self.guard.RUnlock()
+	count := 0
+	for _, sockets := range self.Sockets {
+		count += len(sockets)
+	}
+	return count
+}
+
 // Hub contains active websockets for bidirectional communication
 var Hub = hub{
 	Sockets: make(map[string]map[int]*websocket.Conn),
@@ -85,6 +99,10 @@ func messageListener(conn *connection) {
 			ServerLogger.Warn("%s %s", conn.ip, err)
 			return
 		}
+		// viewers can't send edits to other clients
+		if conn.readonly {
+			continue
+		}
 		for i := range Hub.Sockets[conn.ds] {
 			if Hub.Sockets[conn.ds][i] != conn.ws {
 				ServerLogger.Debug("Sending message to client")
@@ -94,25 +112,60 @@ func messageListener(conn *connection) {
 	}
 }
 
+const (
+	// WEBSOCKET_PROTOCOL subprotocol accepted for layer websockets
+	WEBSOCKET_PROTOCOL = "gospatial"
+	// WEBSOCKET_APIKEY_PREFIX prefixes the apikey sent as a websocket subprotocol.
+	// Browsers can't set headers on websockets, so the apikey is sent as
+	// "apikey.<apikey>" next to the gospatial subprotocol.
+	WEBSOCKET_APIKEY_PREFIX = "apikey."
+)
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{WEBSOCKET_PROTOCOL},
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
 
+// getWebsocketApikey returns the apikey sent in the Sec-WebSocket-Protocol header
+func getWebsocketApikey(r *http.Request) string {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, WEBSOCKET_APIKEY_PREFIX) {
+			return strings.TrimPrefix(protocol, WEBSOCKET_APIKEY_PREFIX)
+		}
+	}
+	return ""
+}
+
 func serveWs(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	ds := vars["ds"]
 	ip := r.RemoteAddr
+
+	// check apikey before upgrading connection
+	job := HttpRequest{w: w, r: r}
+	customer, err := job.GetViewer(ds)
+	if nil == err && !customer.hasRole(ds, ROLE_VIEWER) {
+		job.WriteHeaders(http.StatusUnauthorized)
+		err = fmt.Errorf(`Unauthorized`)
+	}
+	if nil != err {
+		data := HttpMessageResponse{Status: "error", Message: err.Error()}
+		js := job.MarshalJsonFromStruct(data)
+		job.SendJsonResponse(js)
+		return
+	}
+
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		NetworkLogger.Critical(r.RemoteAddr, " WS /ws/"+ds+" [500]")
 		ServerLogger.Error(err)
 		return
 	}
-	conn := connection{ws: ws, ds: ds, ip: ip, c: len(Hub.Sockets[ds])}
+	conn := connection{ws: ws, ds: ds, ip: ip, c: len(Hub.Sockets[ds]), readonly: !customer.hasRole(ds, ROLE_EDITOR)}
 	if _, ok := Hub.Sockets[ds]; ok {
 		Hub.Sockets[ds][len(Hub.Sockets[ds])] = ws
 	} else {
@@ -0,0 +1,169 @@
+package geo_skeleton_server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// DEFAULT_TCP_ALLOWED_NETWORKS only accept local connections
+var DEFAULT_TCP_ALLOWED_NETWORKS = []string{"127.0.0.0/8", "::1/128"}
+
+// TCP_HANDSHAKE_TIMEOUT time allowed for clients to finish the tls handshake
+const TCP_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// TCP_MAX_AUTH_FAILURES failed auth attempts before the connection is closed
+const TCP_MAX_AUTH_FAILURES = 3
+
+// TcpTlsConfig certificate files for the tcp server. When ClientCAFile
+// is set clients must present a certificate signed by it.
+type TcpTlsConfig struct {
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	ClientCAFile string `json:"client_ca_file"`
+}
+
+// TcpConfig tcp server settings read from the config file.
+// MaxConcurrent limits pipelined requests handled at once per connection.
+// Socket adds a unix socket listener, ConnType "unix" disables the tcp port.
+type TcpConfig struct {
+	Host            string        `json:"host"`
+	AllowedNetworks []string      `json:"allowed_networks"`
+	RequireAuth     bool          `json:"require_auth"`
+	TLS             *TcpTlsConfig `json:"tls,omitempty"`
+	MaxConcurrent   int           `json:"max_concurrent_requests"`
+	ConnType        string        `json:"conn_type"`
+	Socket          string        `json:"socket"`
+	SocketMode      string        `json:"socket_mode"`
+}
+
+// getTlsConfig loads the server certificate and client certificate authority
+func (self TcpTlsConfig) getTlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(self.CertFile, self.KeyFile)
+	if nil != err {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if "" != self.ClientCAFile {
+		pem, err := ioutil.ReadFile(self.ClientCAFile)
+		if nil != err {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %v", self.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// getAllowedNetworks parses the networks allowed to connect
+func (self *TcpServer) getAllowedNetworks() ([]*net.IPNet, error) {
+	cidrs := self.AllowedNetworks
+	if 0 == len(cidrs) {
+		cidrs = DEFAULT_TCP_ALLOWED_NETWORKS
+	}
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if nil != err {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// hasRemoteNetworks checks if networks other than loopback are allowed to connect
+func hasRemoteNetworks(networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if !network.IP.IsLoopback() {
+			return true
+		}
+	}
+	return false
+}
+
+// listen opens the tcp listener, wrapped in tls when configured
+func (self *TcpServer) listen(serv string) (net.Listener, error) {
+	if nil == self.TLS {
+		return net.Listen(self.getConnType(), serv)
+	}
+	config, err := self.TLS.getTlsConfig()
+	if nil != err {
+		return nil, err
+	}
+	return tls.Listen(self.getConnType(), serv, config)
+}
+
+// remoteIP returns the ip address of a connection
+func remoteIP(addr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if nil != err {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// isAllowedAddr checks if the remote address is in one of the allowed networks
+func isAllowedAddr(addr net.Addr, networks []*net.IPNet) bool {
+	ip := remoteIP(addr)
+	if nil == ip {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requiresAuth checks if the connection has to send the auth handshake.
+// Clients with a verified certificate are authenticated. Remote clients
+// always have to authenticate, local and unix socket clients only when
+// RequireAuth is set.
+func (self *TcpServer) requiresAuth(conn net.Conn) (bool, error) {
+	if isUnixConn(conn) {
+		return self.RequireAuth, nil
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// clients stalling the handshake would hold the connection open
+		tlsConn.SetDeadline(time.Now().Add(TCP_HANDSHAKE_TIMEOUT))
+		err := tlsConn.Handshake()
+		if nil != err {
+			return true, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		if 0 < len(tlsConn.ConnectionState().VerifiedChains) {
+			return false, nil
+		}
+	}
+	if self.RequireAuth {
+		return true, nil
+	}
+	ip := remoteIP(conn.RemoteAddr())
+	return nil == ip || !ip.IsLoopback(), nil
+}
+
+func (self *TcpServer) auth(req TcpMessage, conn net.Conn) bool {
+	// {"method":"auth","authkey":"su"}
+	if "" == req.Authkey {
+		self.missingParams(conn)
+		return false
+	}
+	if 1 != subtle.ConstantTimeCompare([]byte(req.Authkey), []byte(SuperuserKey)) {
+		NetworkLogger.Warn("Failed tcp auth from ", conn.RemoteAddr().String())
+		self.handleError(errors.New("Unauthorized"), conn)
+		return false
+	}
+	self.handleSuccess(`{"message": "authenticated"}`, conn)
+	return true
+}
@@ -0,0 +1,69 @@
+package geo_skeleton_server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Unittest hasRemoteNetworks
+func TestHasRemoteNetworks(t *testing.T) {
+	parse := func(cidrs ...string) []*net.IPNet {
+		networks := []*net.IPNet{}
+		for _, cidr := range cidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if nil != err {
+				t.Fatal(err)
+			}
+			networks = append(networks, network)
+		}
+		return networks
+	}
+	if hasRemoteNetworks(parse(DEFAULT_TCP_ALLOWED_NETWORKS...)) {
+		t.Error("Default networks should be local")
+	}
+	if !hasRemoteNetworks(parse("127.0.0.0/8", "10.0.0.0/8")) {
+		t.Error("10.0.0.0/8 should be remote")
+	}
+}
+
+// Unittest connections are closed after too many failed auth attempts
+func TestTcpAuthFailures(t *testing.T) {
+	server := &TcpServer{}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.tcpClientHandler(conn)
+	client.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(client)
+
+	for i := 1; i <= TCP_MAX_AUTH_FAILURES; i++ {
+		_, err := client.Write([]byte(`{"method":"auth","authkey":"guess"}` + "\n"))
+		if nil != err {
+			t.Fatalf("Connection closed after %v failed attempts: %v", i-1, err)
+		}
+		line, err := reader.ReadString('\n')
+		if nil != err || !strings.Contains(line, "Unauthorized") {
+			t.Fatalf("Failed auth should be answered: %v %v", line, err)
+		}
+	}
+	if line, err := reader.ReadString('\n'); nil == err {
+		t.Errorf("Connection should be closed after %v failed attempts: %v", TCP_MAX_AUTH_FAILURES, line)
+	}
+
+	// clients authenticating in time stay connected
+	client, conn = net.Pipe()
+	defer client.Close()
+	go server.tcpClientHandler(conn)
+	client.SetDeadline(time.Now().Add(time.Second))
+	reader = bufio.NewReader(client)
+	for _, authkey := range []string{"guess", SuperuserKey, "guess", "guess"} {
+		client.Write([]byte(`{"method":"auth","authkey":"` + authkey + `"}` + "\n"))
+		reader.ReadString('\n')
+	}
+	client.Write([]byte(`{"method":"ping"}` + "\n"))
+	if line, err := reader.ReadString('\n'); nil != err || !strings.Contains(line, "pong") {
+		t.Errorf("Authenticated connection should stay open: %v %v", line, err)
+	}
+}
@@ -0,0 +1,349 @@
+package geo_skeleton_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// batch step statuses
+const (
+	BATCH_STEP_OK              = "ok"
+	BATCH_STEP_ERROR           = "error"
+	BATCH_STEP_ROLLED_BACK     = "rolled_back"
+	BATCH_STEP_ROLLBACK_FAILED = "rollback_failed"
+	BATCH_STEP_SKIPPED         = "skipped"
+)
+
+// batchMethods methods that can be used in a batch. Each of them
+// can be undone by restoring the state saved before the step.
+var batchMethods = map[string]bool{
+	"create_datasource": true,
+	"insert_layer":      true,
+	"delete_datasource": true,
+	"delete_layer":      true,
+	"insert_layer_meta": true,
+	"insert_feature":    true,
+	"edit_feature":      true,
+	"assign_datasource": true,
+}
+
+// batchLayerMethods batch methods changing a layer
+var batchLayerMethods = map[string]bool{
+	"create_datasource": true,
+	"insert_layer":      true,
+	"delete_datasource": true,
+	"delete_layer":      true,
+	"insert_feature":    true,
+	"edit_feature":      true,
+}
+
+// batchLock keeps batches from interleaving with each other. Other writers
+// don't take it, rollbacks check layers weren't changed since their step.
+var batchLock sync.Mutex
+
+// batchUndo undoes an applied batch step. Datasource and Version are set
+// for steps changing a layer and hold the layer version after the step.
+type batchUndo struct {
+	Datasource string
+	Version    string
+	undo       func(json.RawMessage) error
+}
+
+// batchLayerChangedError is returned when a layer was changed by another
+// writer after a batch step, the step is not rolled back
+type batchLayerChangedError struct {
+	Datasource string
+}
+
+func (self batchLayerChangedError) Error() string {
+	return fmt.Sprintf("Layer %v was changed after the batch step, not rolled back", self.Datasource)
+}
+
+// batchStep result of a batch step
+type batchStep struct {
+	Method string          `json:"method"`
+	Status string          `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// batchResult response of a batch
+type batchResult struct {
+	Committed bool        `json:"committed"`
+	Steps     []batchStep `json:"steps"`
+}
+
+// batchResponse legacy response captured from a step
+type batchResponse struct {
+	Status string          `json:"status"`
+	Data   json.RawMessage `json:"data"`
+	Error  string          `json:"error"`
+}
+
+// captureConn collects the response of a batch step instead of writing it to the client
+type captureConn struct {
+	net.Conn
+	buffer bytes.Buffer
+}
+
+func (self *captureConn) Write(b []byte) (int, error) {
+	return self.buffer.Write(b)
+}
+
+// response parses the captured step response
+func (self *captureConn) response() (batchResponse, error) {
+	resp := batchResponse{}
+	err := json.Unmarshal(self.buffer.Bytes(), &resp)
+	if nil != err {
+		return resp, fmt.Errorf("Invalid step response: %v", err)
+	}
+	if "ok" != resp.Status {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// getDatasourceId returns the datasource_id of a step result
+func getDatasourceId(result json.RawMessage) string {
+	data := struct {
+		Datasource string `json:"datasource_id"`
+	}{}
+	json.Unmarshal(result, &data)
+	return data.Datasource
+}
+
+// resolveBatchReference replaces a "$N" datasource with the datasource_id
+// returned by step N so steps can use layers created earlier in the batch.
+func resolveBatchReference(datasource_id string, steps []batchStep) (string, error) {
+	if !strings.HasPrefix(datasource_id, "$") {
+		return datasource_id, nil
+	}
+	i, err := strconv.Atoi(datasource_id[1:])
+	if nil != err || 0 > i || i >= len(steps) {
+		return datasource_id, fmt.Errorf("Invalid step reference: %v", datasource_id)
+	}
+	resolved := getDatasourceId(steps[i].Result)
+	if "" == resolved {
+		return datasource_id, fmt.Errorf("Step %v did not return a datasource", i)
+	}
+	return resolved, nil
+}
+
+// saveLayer returns a function restoring the layer to its current state.
+// Layers that don't exist yet are deleted. Deleting a layer removes it from
+// its customers, their roles are assigned again. No events are published,
+// the events of rolled back steps are discarded instead.
+func saveLayer(datasource_id string) (func() error, error) {
+	lyr, err := GeoDB.GetLayer(datasource_id)
+	if nil != err {
+		return func() error {
+			return deleteBatchLayer(datasource_id)
+		}, nil
+	}
+	roles, err := DB.GetDatasourceRoles(datasource_id)
+	if nil != err {
+		return nil, err
+	}
+	return func() error {
+		err := DB.InsertLayer(datasource_id, lyr)
+		resetDatasourceUsage(datasource_id)
+		if nil != err {
+			return err
+		}
+		for customer_id, role := range roles {
+			_, err = DB.UpdateCustomer(customer_id, func(customer *Customer) bool {
+				return customer.applyRole(datasource_id, role)
+			})
+			if nil != err {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// deleteBatchLayer deletes a layer created by a rolled back batch
+func deleteBatchLayer(datasource_id string) error {
+	err := DB.DeleteLayer(datasource_id)
+	resetDatasourceUsage(datasource_id)
+	return err
+}
+
+// getBatchLayerVersion returns the version of a layer, empty if it doesn't exist
+func getBatchLayerVersion(datasource_id string) string {
+	version, err := GetStoredLayerVersion(datasource_id)
+	if nil != err {
+		return ""
+	}
+	return version
+}
+
+// newBatchUndo records the layer changed by an applied step
+func newBatchUndo(req TcpMessage, result json.RawMessage, undo func(json.RawMessage) error) batchUndo {
+	if !batchLayerMethods[req.Method] {
+		return batchUndo{undo: undo}
+	}
+	datasource_id := req.Datasource
+	if "" == datasource_id {
+		datasource_id = getDatasourceId(result)
+	}
+	return batchUndo{Datasource: datasource_id, Version: getBatchLayerVersion(datasource_id), undo: undo}
+}
+
+// rollback undoes the step. Layers changed since the step are left as they are.
+func (self batchUndo) rollback(result json.RawMessage) error {
+	if "" == self.Datasource {
+		return self.undo(result)
+	}
+	unlock := lockLayer(self.Datasource)
+	defer unlock()
+	if self.Version != getBatchLayerVersion(self.Datasource) {
+		return batchLayerChangedError{Datasource: self.Datasource}
+	}
+	return self.undo(result)
+}
+
+// prepareBatchStep resolves datasource references of a step and saves the
+// state it changes. Returns the function undoing the step.
+func prepareBatchStep(req *TcpMessage, steps []batchStep) (func(json.RawMessage) error, error) {
+	var err error
+	req.Datasource, err = resolveBatchReference(req.Datasource, steps)
+	if nil != err {
+		return nil, err
+	}
+	req.Data.Datasource, err = resolveBatchReference(req.Data.Datasource, steps)
+	if nil != err {
+		return nil, err
+	}
+
+	switch req.Method {
+
+	case "create_datasource", "insert_layer":
+		if "" == req.Datasource {
+			return func(result json.RawMessage) error {
+				return deleteBatchLayer(getDatasourceId(result))
+			}, nil
+		}
+		restore, err := saveLayer(req.Datasource)
+		if nil != err {
+			return nil, err
+		}
+		return func(json.RawMessage) error { return restore() }, nil
+
+	case "delete_datasource", "delete_layer", "insert_feature", "edit_feature":
+		restore, err := saveLayer(req.Datasource)
+		if nil != err {
+			return nil, err
+		}
+		return func(json.RawMessage) error { return restore() }, nil
+
+	case "insert_layer_meta":
+		meta, err := DB.GetLayerMeta(req.Data.Datasource)
+		if nil != err {
+			return nil, err
+		}
+		return func(json.RawMessage) error {
+			return DB.InsertLayerMeta(meta)
+		}, nil
+
+	case "assign_datasource":
+		customer, err := DB.LookupCustomer(req.Apikey)
+		if nil != err {
+			return nil, err
+		}
+		// only the assigned datasource is rolled back, other changes to the customer are kept
+		role := customer.getRole(req.Datasource)
+		return func(json.RawMessage) error {
+			_, err := DB.UpdateCustomer(customer.Id, func(customer *Customer) bool {
+				return customer.applyRole(req.Datasource, role)
+			})
+			return err
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Method not supported in batch: %v", req.Method)
+}
+
+// rollbackBatch undoes the applied steps in reverse order. Returns the
+// datasources every step was rolled back on, their events are discarded.
+func rollbackBatch(steps []batchStep, undo []batchUndo) map[string]bool {
+	rolled_back := make(map[string]bool)
+	failed := make(map[string]bool)
+	for i := len(undo) - 1; i >= 0; i-- {
+		err := undo[i].rollback(steps[i].Result)
+		if nil != err {
+			NetworkLogger.Error("Unable to roll back batch step ", i, ": ", err)
+			steps[i].Status = BATCH_STEP_ROLLBACK_FAILED
+			steps[i].Error = err.Error()
+			failed[undo[i].Datasource] = true
+			continue
+		}
+		steps[i].Status = BATCH_STEP_ROLLED_BACK
+		rolled_back[undo[i].Datasource] = true
+	}
+	discard := make(map[string]bool)
+	for datasource_id := range rolled_back {
+		if "" != datasource_id && !failed[datasource_id] {
+			discard[datasource_id] = true
+		}
+	}
+	return discard
+}
+
+func (self *TcpServer) batch(req TcpMessage, conn net.Conn) {
+	// {"method":"batch","requests":[{"method":"create_datasource"},{"method":"insert_feature","datasource":"$0","feature":{...}}]}
+	if 0 == len(req.Requests) {
+		self.missingParams(conn)
+		return
+	}
+	for _, step := range req.Requests {
+		if !batchMethods[step.Method] {
+			err := tcpError{Code: RPC_INVALID_PARAMS, Message: "Method not supported in batch: " + step.Method}
+			self.handleError(err, conn)
+			return
+		}
+	}
+
+	batchLock.Lock()
+	defer batchLock.Unlock()
+
+	// subscribers only see the steps of committed batches
+	Events.hold()
+	discard := map[string]bool{}
+	defer func() { Events.release(discard) }()
+
+	steps := make([]batchStep, len(req.Requests))
+	for i, step := range req.Requests {
+		steps[i] = batchStep{Method: step.Method, Status: BATCH_STEP_SKIPPED}
+	}
+
+	undo := []batchUndo{}
+	for i, step := range req.Requests {
+		rollback, err := prepareBatchStep(&step, steps)
+		if nil == err {
+			capture := &captureConn{Conn: conn}
+			self.handleRequest(step, capture)
+			var resp batchResponse
+			resp, err = capture.response()
+			steps[i].Result = resp.Data
+		}
+		if nil != err {
+			steps[i].Status = BATCH_STEP_ERROR
+			steps[i].Error = err.Error()
+			discard = rollbackBatch(steps, undo)
+			message := fmt.Sprintf("Batch step %v failed: %v", i, err)
+			self.handleError(tcpError{Code: RPC_BATCH_FAILED, Message: message, Data: batchResult{Steps: steps}}, conn)
+			return
+		}
+		steps[i].Status = BATCH_STEP_OK
+		undo = append(undo, newBatchUndo(step, steps[i].Result, rollback))
+	}
+
+	self.mashalJsonFromStructResponse(batchResult{Committed: true, Steps: steps}, conn)
+}
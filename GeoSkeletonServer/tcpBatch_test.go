@@ -0,0 +1,31 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Unittest resolveBatchReference
+func TestResolveBatchReference(t *testing.T) {
+	steps := []batchStep{
+		{Method: "create_datasource", Result: json.RawMessage(`{"datasource_id":"f79aac397a484998b94b56d345287096"}`)},
+		{Method: "insert_layer_meta", Result: json.RawMessage(`{"datasource":"f79aac397a484998b94b56d345287096"}`)},
+	}
+
+	datasource_id, err := resolveBatchReference("20f3332781ea4d7b8d509d12517ac5fa", steps)
+	if nil != err || "20f3332781ea4d7b8d509d12517ac5fa" != datasource_id {
+		t.Errorf("Datasource should not change: %v %v", datasource_id, err)
+	}
+
+	datasource_id, err = resolveBatchReference("$0", steps)
+	if nil != err || "f79aac397a484998b94b56d345287096" != datasource_id {
+		t.Errorf("Reference not resolved: %v %v", datasource_id, err)
+	}
+
+	for _, reference := range []string{"$1", "$2", "$-1", "$a"} {
+		_, err = resolveBatchReference(reference, steps)
+		if nil == err {
+			t.Errorf("Invalid reference should fail: %v", reference)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// tcpEventNotification JSON-RPC 2.0 notification carrying an event
+type tcpEventNotification struct {
+	JsonRpc string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  Event  `json:"params"`
+}
+
+// tcpSubscription response of subscribe
+type tcpSubscription struct {
+	Subscribed bool   `json:"subscribed"`
+	Epoch      string `json:"epoch"`
+	Sequence   uint64 `json:"sequence"`
+}
+
+// tcpEventLine legacy tcp event line
+type tcpEventLine struct {
+	Event Event `json:"event"`
+}
+
+// writeEvent writes one event line, framed as a JSON-RPC notification
+// when the subscription was made over JSON-RPC
+func writeEvent(event Event, conn net.Conn) error {
+	var js []byte
+	var err error
+	if isRpc(conn) {
+		js, err = json.Marshal(tcpEventNotification{JsonRpc: JSONRPC_VERSION, Method: "event", Params: event})
+	} else {
+		js, err = json.Marshal(tcpEventLine{Event: event})
+	}
+	if nil != err {
+		return err
+	}
+	_, err = conn.Write(append(js, '\n'))
+	return err
+}
+
+// streamEvents writes missed events followed by new events until the
+// subscriber is closed or the connection fails
+func (self *TcpServer) streamEvents(subscriber *eventSubscriber, missed []Event, conn net.Conn) {
+	for _, event := range missed {
+		if nil != writeEvent(event, conn) {
+			Events.unsubscribe(subscriber)
+			return
+		}
+	}
+	var last Event
+	for event := range subscriber.events {
+		if nil != writeEvent(event, conn) {
+			Events.unsubscribe(subscriber)
+			return
+		}
+		last = event
+	}
+	if subscriber.dropped {
+		message := fmt.Sprintf("Subscription dropped, subscribe again with epoch %v and since %v", last.Epoch, last.Sequence)
+		self.handleError(tcpError{Code: RPC_SERVER_ERROR, Message: message}, conn)
+	}
+}
+
+// subscribe replaces the subscription of a connection. Returns the new
+// subscription, or the current one when the filter is invalid.
+func (self *TcpServer) subscribe(req TcpMessage, conn net.Conn, current *eventSubscriber) *eventSubscriber {
+	// {"method":"subscribe"}
+	// {"method":"subscribe","datasources":["20f3332781ea4d7b8d509d12517ac5fa"],"events":["feature_inserted","feature_edited"],"epoch":"9b2a4c6e0f1d4e3a8c5b7d9e1f2a3b4c","since":42}
+	datasources := req.Datasources
+	if "" != req.Datasource {
+		datasources = append(datasources, req.Datasource)
+	}
+	filter, err := NewEventFilter(datasources, req.Events)
+	if nil != err {
+		self.handleError(tcpError{Code: RPC_INVALID_PARAMS, Message: err.Error()}, conn)
+		return current
+	}
+	if nil != current {
+		Events.unsubscribe(current)
+	}
+	subscriber, missed, sequence, err := Events.subscribe(filter, req.Epoch, req.Since)
+	if nil != err {
+		self.handleError(err, conn)
+		return nil
+	}
+	self.mashalJsonFromStructResponse(tcpSubscription{Subscribed: true, Epoch: Events.epoch, Sequence: sequence}, conn)
+	go self.streamEvents(subscriber, missed, conn)
+	return subscriber
+}
+
+func (self *TcpServer) unsubscribe(subscriber *eventSubscriber, conn net.Conn) {
+	// {"method":"unsubscribe"}
+	if nil != subscriber {
+		Events.unsubscribe(subscriber)
+	}
+	self.handleSuccess(`{"subscribed": false}`, conn)
+}
@@ -0,0 +1,71 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+)
+
+// exportSummary terminates a streamed export. NextOffset is set when
+// more records are left after the requested page.
+type exportSummary struct {
+	Count      int  `json:"count"`
+	Total      int  `json:"total"`
+	Offset     int  `json:"offset"`
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// pageBounds returns the slice bounds of the requested page. A limit of zero returns all records.
+func pageBounds(total int, offset int, limit int) (int, int) {
+	if 0 > offset {
+		offset = 0
+	}
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if 0 < limit && offset+limit < total {
+		end = offset + limit
+	}
+	return offset, end
+}
+
+// exportPage writes the requested page of records. Streamed exports stream
+// every record and answer with a summary, otherwise the page is written as
+// one json array.
+func (self *TcpServer) exportPage(req TcpMessage, records []json.RawMessage, conn net.Conn) {
+	start, end := pageBounds(len(records), req.Offset, req.Limit)
+	page := records[start:end]
+	if !req.Stream {
+		self.mashalJsonFromStructResponse(page, conn)
+		return
+	}
+	for _, record := range page {
+		self.handleStream(string(record), conn)
+	}
+	summary := exportSummary{Count: len(page), Total: len(records), Offset: start}
+	if end < len(records) {
+		summary.NextOffset = &end
+	}
+	js, err := json.Marshal(map[string]exportSummary{"summary": summary})
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	self.handleSuccess(string(js), conn)
+}
+
+// exportStrings pages through a sorted list of strings
+func (self *TcpServer) exportStrings(req TcpMessage, values []string, conn net.Conn) {
+	sort.Strings(values)
+	records := []json.RawMessage{}
+	for _, value := range values {
+		js, err := json.Marshal(value)
+		if err != nil {
+			self.handleError(err, conn)
+			return
+		}
+		records = append(records, js)
+	}
+	self.exportPage(req, records, conn)
+}
@@ -0,0 +1,91 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Unittest pageBounds
+func TestPageBounds(t *testing.T) {
+	tests := []struct {
+		total, offset, limit int
+		start, end           int
+	}{
+		{5, 0, 0, 0, 5},
+		{5, 0, 2, 0, 2},
+		{5, 2, 2, 2, 4},
+		{5, 4, 2, 4, 5},
+		{5, 5, 2, 5, 5},
+		{5, 9, 2, 5, 5},
+		{5, -3, 2, 0, 2},
+		{5, 3, 0, 3, 5},
+		{0, 0, 0, 0, 0},
+	}
+	for _, test := range tests {
+		start, end := pageBounds(test.total, test.offset, test.limit)
+		if test.start != start || test.end != end {
+			t.Errorf("pageBounds(%v, %v, %v) should be %v:%v, got %v:%v", test.total, test.offset, test.limit, test.start, test.end, start, end)
+		}
+	}
+}
+
+// Unittest TcpServer.exportPage
+func TestExportPage(t *testing.T) {
+	server := &TcpServer{}
+	records := []json.RawMessage{}
+	for _, value := range []string{`"a"`, `"b"`, `"c"`, `"d"`, `"e"`} {
+		records = append(records, json.RawMessage(value))
+	}
+	tests := []struct {
+		offset, limit int
+		count         int
+		next          *int
+	}{
+		{0, 2, 2, intPtr(2)},
+		{2, 2, 2, intPtr(4)},
+		// the last page has no next offset
+		{4, 2, 1, nil},
+		{3, 0, 2, nil},
+		{9, 2, 0, nil},
+	}
+	for _, test := range tests {
+		capture := &captureConn{}
+		server.exportPage(TcpMessage{Offset: test.offset, Limit: test.limit, Stream: true}, records, capture)
+		lines := strings.Split(strings.TrimSpace(capture.buffer.String()), "\n")
+		if test.count+1 != len(lines) {
+			t.Fatalf("Offset %v limit %v should stream %v records: %v", test.offset, test.limit, test.count, lines)
+		}
+		resp := struct {
+			Data struct {
+				Summary exportSummary `json:"summary"`
+			} `json:"data"`
+		}{}
+		err := json.Unmarshal([]byte(lines[len(lines)-1]), &resp)
+		if nil != err {
+			t.Fatal(err)
+		}
+		summary := resp.Data.Summary
+		if test.count != summary.Count || len(records) != summary.Total {
+			t.Errorf("Unexpected summary for offset %v limit %v: %v", test.offset, test.limit, summary)
+		}
+		if (nil == test.next) != (nil == summary.NextOffset) || (nil != test.next && *test.next != *summary.NextOffset) {
+			t.Errorf("Offset %v limit %v should have next offset %v: %v", test.offset, test.limit, test.next, summary.NextOffset)
+		}
+	}
+
+	// pages that aren't streamed are one json array
+	capture := &captureConn{}
+	server.exportPage(TcpMessage{Offset: 9, Limit: 2}, records, capture)
+	resp := struct {
+		Data []string `json:"data"`
+	}{}
+	err := json.Unmarshal(capture.buffer.Bytes(), &resp)
+	if nil != err || nil == resp.Data || 0 != len(resp.Data) {
+		t.Errorf("Offset past the end should return an empty page: %v %v", capture.buffer.String(), err)
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -0,0 +1,421 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"net"
+)
+
+// Parameter types used in method descriptions. Types follow JSON schema,
+// geojson parameters are objects.
+const (
+	PARAM_STRING  = "string"
+	PARAM_INTEGER = "integer"
+	PARAM_BOOLEAN = "boolean"
+	PARAM_OBJECT  = "object"
+	PARAM_ARRAY   = "array"
+)
+
+// TcpParam describes a tcp method parameter. Nested parameters
+// are named with their path, e.g. data.datasource.
+type TcpParam struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required"`
+	Description string `json:"description"`
+}
+
+// TcpMethod describes a tcp method. Public methods can be called before the
+// auth handshake. Methods without a handler change the connection itself
+// and are handled by the client handler.
+type TcpMethod struct {
+	Name        string                                 `json:"name"`
+	Group       string                                 `json:"group"`
+	Description string                                 `json:"description"`
+	Params      []TcpParam                             `json:"params"`
+	Example     json.RawMessage                        `json:"example"`
+	Public      bool                                   `json:"public"`
+	AliasOf     string                                 `json:"alias_of,omitempty"`
+	handler     func(*TcpServer, TcpMessage, net.Conn) `json:"-"`
+}
+
+var (
+	paramApikey      = TcpParam{Name: "apikey", Type: PARAM_STRING, Required: true, Description: "customer id or apikey"}
+	paramDatasource  = TcpParam{Name: "datasource", Type: PARAM_STRING, Required: true, Description: "datasource id"}
+	paramKeyId       = TcpParam{Name: "key_id", Type: PARAM_STRING, Required: true, Description: "apikey record id"}
+	paramStream      = TcpParam{Name: "stream", Type: PARAM_BOOLEAN, Description: "write one record per line followed by a summary line"}
+	paramOffset      = TcpParam{Name: "offset", Type: PARAM_INTEGER, Description: "records to skip"}
+	paramLimit       = TcpParam{Name: "limit", Type: PARAM_INTEGER, Description: "records to return, 0 returns all records"}
+	paramFeature     = TcpParam{Name: "feature", Type: PARAM_OBJECT, Required: true, Description: "geojson feature"}
+	paramLayer       = TcpParam{Name: "layer", Type: PARAM_OBJECT, Description: "geojson feature collection"}
+	paramTimestamp   = TcpParam{Name: "timestamp", Type: PARAM_INTEGER, Required: true, Description: "snapshot timestamp in nanoseconds"}
+	paramOptionalDs  = TcpParam{Name: "datasource", Type: PARAM_STRING, Description: "datasource id"}
+	paramGracePeriod = TcpParam{Name: "grace_period", Type: PARAM_INTEGER, Description: "seconds the old apikey keeps working"}
+)
+
+// tcpMethods methods in the order they are listed by help
+var tcpMethods []TcpMethod
+
+// tcpMethodIndex tcp methods by name
+var tcpMethodIndex map[string]TcpMethod
+
+// registered in init, help and describe read the registry
+func init() {
+	tcpMethods = []TcpMethod{
+		{
+			Name:        "ping",
+			Group:       "server",
+			Description: "Checks the server is running and returns its version",
+			Params:      []TcpParam{},
+			Example:     json.RawMessage(`{"method":"ping"}`),
+			Public:      true,
+			handler:     (*TcpServer).ping,
+		},
+		{
+			Name:        "help",
+			Group:       "server",
+			Description: "Lists the method names",
+			Params:      []TcpParam{},
+			Example:     json.RawMessage(`{"method":"help"}`),
+			Public:      true,
+			handler:     (*TcpServer).help,
+		},
+		{
+			Name:        "describe",
+			Group:       "server",
+			Description: "Describes the parameters of one or all methods",
+			Params: []TcpParam{
+				{Name: "name", Type: PARAM_STRING, Description: "method name, all methods are described when empty"},
+			},
+			Example: json.RawMessage(`{"method":"describe","name":"insert_feature"}`),
+			Public:  true,
+			handler: (*TcpServer).describe,
+		},
+		{
+			Name:        "auth",
+			Group:       "server",
+			Description: "Authenticates the connection with the superuser key",
+			Params: []TcpParam{
+				{Name: "authkey", Type: PARAM_STRING, Required: true, Description: "superuser key"},
+			},
+			Example: json.RawMessage(`{"method":"auth","authkey":"su"}`),
+			Public:  true,
+		},
+		{
+			Name:        "batch",
+			Group:       "server",
+			Description: "Applies a list of requests in order or rolls all of them back. A datasource of $N refers to the datasource created by step N",
+			Params: []TcpParam{
+				{Name: "requests", Type: PARAM_ARRAY, Required: true, Description: "requests to apply"},
+			},
+			Example: json.RawMessage(`{"method":"batch","requests":[{"method":"create_datasource"},{"method":"insert_feature","datasource":"$0","feature":{"type":"Feature","geometry":{"type":"Point","coordinates":[0,0]},"properties":{}}}]}`),
+			handler: (*TcpServer).batch,
+		},
+		{
+			Name:        "restore_commit_log",
+			Group:       "server",
+			Description: "Replays a commit log on the server into the empty database and verifies the result. Requires the only open connection, other requests are refused until it ends",
+			Params: []TcpParam{
+				{Name: "file", Type: PARAM_STRING, Required: true, Description: "commit log path on the server"},
+				{Name: "stop_at", Type: PARAM_INTEGER, Description: "skip lines committed after this time in nanoseconds"},
+				{Name: "stop_on_error", Type: PARAM_BOOLEAN, Description: "stop at the first rejected line"},
+				{Name: "progress", Type: PARAM_INTEGER, Description: "lines between progress reports, defaults to 1000"},
+				{Name: "stream", Type: PARAM_BOOLEAN, Description: "stream progress records before the report"},
+			},
+			Example: json.RawMessage(`{"method":"restore_commit_log","file":"api_commit.log.bak","stop_at":1494877512000000000,"stream":true}`),
+			handler: (*TcpServer).restore_commit_log,
+		},
+		{
+			Name:        "subscribe",
+			Group:       "events",
+			Description: "Streams matching events to the connection",
+			Params: []TcpParam{
+				{Name: "datasources", Type: PARAM_ARRAY, Description: "datasource ids to receive events for"},
+				{Name: "events", Type: PARAM_ARRAY, Description: "event types to receive"},
+				{Name: "epoch", Type: PARAM_STRING, Description: "epoch of the last event received, required with since"},
+				{Name: "since", Type: PARAM_INTEGER, Description: "sequence number of the last event received"},
+			},
+			Example: json.RawMessage(`{"method":"subscribe","datasources":["20f3332781ea4d7b8d509d12517ac5fa"],"events":["feature_inserted","feature_edited"],"epoch":"9b2a4c6e0f1d4e3a8c5b7d9e1f2a3b4c","since":42}`),
+		},
+		{
+			Name:        "unsubscribe",
+			Group:       "events",
+			Description: "Stops streaming events to the connection",
+			Params:      []TcpParam{},
+			Example:     json.RawMessage(`{"method":"unsubscribe"}`),
+		},
+		{
+			Name:        "create_apikey",
+			Group:       "apikeys",
+			Description: "Creates a customer and their default apikey",
+			Params:      []TcpParam{},
+			Example:     json.RawMessage(`{"method":"create_apikey"}`),
+			handler:     (*TcpServer).create_apikey,
+		},
+		{
+			Name:        "insert_apikey",
+			Group:       "apikeys",
+			Description: "Inserts a customer record",
+			Params: []TcpParam{
+				{Name: "data.id", Type: PARAM_STRING, Required: true, Description: "customer id"},
+				{Name: "data.datasources", Type: PARAM_ARRAY, Description: "datasource ids"},
+				{Name: "data.roles", Type: PARAM_OBJECT, Description: "roles by datasource id"},
+			},
+			Example: json.RawMessage(`{"method":"insert_apikey","data":{"id":"0b5a4ac8e1b04bd1be2b5ee0a1a3cf3e","datasources":[]}}`),
+			handler: (*TcpServer).insert_apikey,
+		},
+		{
+			Name:        "export_apikeys",
+			Group:       "apikeys",
+			Description: "Exports the customer records",
+			Params:      []TcpParam{paramStream, paramOffset, paramLimit},
+			Example:     json.RawMessage(`{"method":"export_apikeys","stream":true,"offset":0,"limit":100}`),
+			handler:     (*TcpServer).export_apikeys,
+		},
+		{
+			Name:        "export_apikey",
+			Group:       "apikeys",
+			Description: "Exports a customer record",
+			Params:      []TcpParam{paramApikey},
+			Example:     json.RawMessage(`{"method":"export_apikey","apikey":"12dB6BlenIeB"}`),
+			handler:     (*TcpServer).export_apikey,
+		},
+		{
+			Name:        "create_key",
+			Group:       "apikeys",
+			Description: "Creates an additional apikey for a customer",
+			Params: []TcpParam{
+				paramApikey,
+				{Name: "label", Type: PARAM_STRING, Description: "apikey label"},
+				{Name: "expires", Type: PARAM_INTEGER, Description: "expiry time in unix seconds"},
+			},
+			Example: json.RawMessage(`{"method":"create_key","apikey":"12dB6BlenIeB","label":"ci","expires":1735689600}`),
+			handler: (*TcpServer).create_key,
+		},
+		{
+			Name:        "insert_key",
+			Group:       "apikeys",
+			Description: "Inserts a hashed apikey record",
+			Params: []TcpParam{
+				{Name: "data.id", Type: PARAM_STRING, Required: true, Description: "apikey record id"},
+				{Name: "data.hash", Type: PARAM_STRING, Required: true, Description: "salted apikey hash"},
+				{Name: "data.customer", Type: PARAM_STRING, Required: true, Description: "customer id"},
+				{Name: "data.prefix", Type: PARAM_STRING, Description: "public apikey prefix"},
+				{Name: "data.salt", Type: PARAM_STRING, Description: "apikey salt"},
+				{Name: "data.label", Type: PARAM_STRING, Description: "apikey label"},
+			},
+			Example: json.RawMessage(`{"method":"insert_key","data":{"id":"...","prefix":"...","salt":"...","hash":"...","customer":"...","label":"..."}}`),
+			handler: (*TcpServer).insert_key,
+		},
+		{
+			Name:        "list_keys",
+			Group:       "apikeys",
+			Description: "Lists the apikeys of a customer",
+			Params:      []TcpParam{paramApikey},
+			Example:     json.RawMessage(`{"method":"list_keys","apikey":"12dB6BlenIeB"}`),
+			handler:     (*TcpServer).list_keys,
+		},
+		{
+			Name:        "rotate_key",
+			Group:       "apikeys",
+			Description: "Replaces an apikey, the old apikey expires after the grace period",
+			Params:      []TcpParam{paramKeyId, paramGracePeriod},
+			Example:     json.RawMessage(`{"method":"rotate_key","key_id":"...","grace_period":3600}`),
+			handler:     (*TcpServer).rotate_key,
+		},
+		{
+			Name:        "revoke_key",
+			Group:       "apikeys",
+			Description: "Disables an apikey",
+			Params:      []TcpParam{paramKeyId},
+			Example:     json.RawMessage(`{"method":"revoke_key","key_id":"..."}`),
+			handler:     (*TcpServer).revoke_key,
+		},
+		{
+			Name:        "insert_feature",
+			Group:       "features",
+			Description: "Adds a feature to a layer",
+			Params:      []TcpParam{paramDatasource, paramFeature},
+			Example:     json.RawMessage(`{"method":"insert_feature","datasource":"20f3332781ea4d7b8d509d12517ac5fa","feature":{"type":"Feature","geometry":{"type":"Point","coordinates":[0,0]},"properties":{}}}`),
+			handler:     (*TcpServer).insert_feature,
+		},
+		{
+			Name:        "edit_feature",
+			Group:       "features",
+			Description: "Replaces a feature, fails when version doesn't match the stored feature",
+			Params: []TcpParam{
+				paramDatasource,
+				{Name: "geo_id", Type: PARAM_STRING, Required: true, Description: "feature id"},
+				paramFeature,
+				{Name: "version", Type: PARAM_STRING, Description: "expected feature version"},
+			},
+			Example: json.RawMessage(`{"method":"edit_feature","datasource":"20f3332781ea4d7b8d509d12517ac5fa","geo_id":"...","version":"3f786850e387550fdab836ed7e6dc881de23001b","feature":{"type":"Feature","geometry":{"type":"Point","coordinates":[0,0]},"properties":{}}}`),
+			handler: (*TcpServer).edit_feature,
+		},
+		{
+			Name:        "assign_datasource",
+			Group:       "datasources",
+			Description: "Gives a customer a role on a datasource",
+			Params: []TcpParam{
+				paramApikey,
+				paramDatasource,
+				{Name: "role", Type: PARAM_STRING, Description: "owner, editor or viewer, defaults to owner"},
+			},
+			Example: json.RawMessage(`{"method":"assign_datasource","apikey":"12dB6BlenIeB","datasource":"20f3332781ea4d7b8d509d12517ac5fa","role":"viewer"}`),
+			handler: (*TcpServer).assign_datasource,
+		},
+		{
+			Name:        "create_datasource",
+			Group:       "datasources",
+			Description: "Creates a layer, or inserts the layer when a datasource is given",
+			Params:      []TcpParam{paramOptionalDs, paramLayer},
+			Example:     json.RawMessage(`{"method":"create_datasource"}`),
+			handler:     (*TcpServer).create_datasource,
+		},
+		{
+			Name:        "insert_layer",
+			Group:       "datasources",
+			Description: "Inserts a layer",
+			Params:      []TcpParam{paramDatasource, paramLayer},
+			Example:     json.RawMessage(`{"method":"insert_layer","datasource":"20f3332781ea4d7b8d509d12517ac5fa","layer":{"type":"FeatureCollection","features":[]}}`),
+			AliasOf:     "create_datasource",
+			handler:     (*TcpServer).create_datasource,
+		},
+		{
+			Name:        "delete_datasource",
+			Group:       "datasources",
+			Description: "Deletes a layer",
+			Params:      []TcpParam{paramDatasource},
+			Example:     json.RawMessage(`{"method":"delete_datasource","datasource":"f79aac397a484998b94b56d345287096"}`),
+			handler:     (*TcpServer).delete_datasource,
+		},
+		{
+			Name:        "delete_layer",
+			Group:       "datasources",
+			Description: "Deletes a layer",
+			Params:      []TcpParam{paramDatasource},
+			Example:     json.RawMessage(`{"method":"delete_layer","datasource":"f79aac397a484998b94b56d345287096"}`),
+			AliasOf:     "delete_datasource",
+			handler:     (*TcpServer).delete_datasource,
+		},
+		{
+			Name:        "insert_layer_meta",
+			Group:       "datasources",
+			Description: "Saves layer metadata",
+			Params: []TcpParam{
+				{Name: "data.datasource", Type: PARAM_STRING, Required: true, Description: "datasource id"},
+				{Name: "data.public", Type: PARAM_BOOLEAN, Description: "layer can be read without an apikey"},
+			},
+			Example: json.RawMessage(`{"method":"insert_layer_meta","data":{"datasource":"f79aac397a484998b94b56d345287096","public":true}}`),
+			handler: (*TcpServer).insert_layer_meta,
+		},
+		{
+			Name:        "export_datasources",
+			Group:       "datasources",
+			Description: "Exports the datasource ids",
+			Params:      []TcpParam{paramStream, paramOffset, paramLimit},
+			Example:     json.RawMessage(`{"method":"export_datasources","stream":true,"offset":0,"limit":100}`),
+			handler:     (*TcpServer).export_datasources,
+		},
+		{
+			Name:        "export_datasource",
+			Group:       "datasources",
+			Description: "Exports a layer as geojson",
+			Params:      []TcpParam{paramDatasource},
+			Example:     json.RawMessage(`{"method":"export_datasource","datasource":"20f3332781ea4d7b8d509d12517ac5fa"}`),
+			handler:     (*TcpServer).export_datasource,
+		},
+		{
+			Name:        "export_layer",
+			Group:       "datasources",
+			Description: "Exports a layer as geojson",
+			Params:      []TcpParam{paramDatasource},
+			Example:     json.RawMessage(`{"method":"export_layer","datasource":"20f3332781ea4d7b8d509d12517ac5fa"}`),
+			AliasOf:     "export_datasource",
+			handler:     (*TcpServer).export_datasource,
+		},
+		{
+			Name:        "import_file",
+			Group:       "datasources",
+			Description: "Imports a geojson or ogr2ogr readable file into a new layer",
+			Params: []TcpParam{
+				{Name: "file", Type: PARAM_STRING, Required: true, Description: "file path on the server"},
+			},
+			Example: json.RawMessage(`{"method":"import_file","file":"springfield_projects_edit.geojson"}`),
+			handler: (*TcpServer).import_file,
+		},
+		{
+			Name:        "export_datasource_snapshots",
+			Group:       "snapshots",
+			Description: "Lists the snapshot timestamps of a layer",
+			Params:      []TcpParam{paramDatasource},
+			Example:     json.RawMessage(`{"method":"export_datasource_snapshots","datasource":"20f3332781ea4d7b8d509d12517ac5fa"}`),
+			handler:     (*TcpServer).export_datasource_snapshots,
+		},
+		{
+			Name:        "export_datasource_by_snapshot",
+			Group:       "snapshots",
+			Description: "Exports a layer as it was stored at a snapshot",
+			Params:      []TcpParam{paramDatasource, paramTimestamp},
+			Example:     json.RawMessage(`{"method":"export_datasource_by_snapshot","datasource":"20f3332781ea4d7b8d509d12517ac5fa","timestamp":1494877512000000000}`),
+			handler:     (*TcpServer).export_datasource_by_snapshot,
+		},
+		{
+			Name:        "export_datasource_by_range",
+			Group:       "snapshots",
+			Description: "Streams every snapshot of a layer within a time range on its own line, the response holds the number of snapshots",
+			Params: []TcpParam{
+				paramDatasource,
+				{Name: "begin_timestamp", Type: PARAM_INTEGER, Required: true, Description: "range start in nanoseconds"},
+				{Name: "end_timestamp", Type: PARAM_INTEGER, Required: true, Description: "range end in nanoseconds"},
+			},
+			Example: json.RawMessage(`{"method":"export_datasource_by_range","datasource":"20f3332781ea4d7b8d509d12517ac5fa","begin_timestamp":1494877512000000000,"end_timestamp":1494963912000000000}`),
+			handler: (*TcpServer).export_datasource_by_range,
+		},
+	}
+
+	tcpMethodIndex = make(map[string]TcpMethod)
+	for _, method := range tcpMethods {
+		tcpMethodIndex[method.Name] = method
+	}
+}
+
+// getTcpMethod returns the registered method
+func getTcpMethod(name string) (TcpMethod, bool) {
+	method, ok := tcpMethodIndex[name]
+	return method, ok
+}
+
+// isPublicMethod checks if the method can be called before the auth handshake
+func isPublicMethod(name string) bool {
+	method, ok := getTcpMethod(name)
+	return ok && method.Public
+}
+
+func (self *TcpServer) ping(req TcpMessage, conn net.Conn) {
+	// {"method":"ping"}
+	self.handleSuccess(`{"message": "pong", "version": "`+VERSION+`"}`, conn)
+}
+
+func (self *TcpServer) help(req TcpMessage, conn net.Conn) {
+	// {"method":"help"}
+	names := []string{}
+	for _, method := range tcpMethods {
+		names = append(names, method.Name)
+	}
+	self.mashalJsonFromStructResponse(names, conn)
+}
+
+func (self *TcpServer) describe(req TcpMessage, conn net.Conn) {
+	// {"method":"describe"}
+	// {"method":"describe","name":"insert_feature"}
+	if "" == req.Name {
+		self.mashalJsonFromStructResponse(tcpMethods, conn)
+		return
+	}
+	method, ok := getTcpMethod(req.Name)
+	if !ok {
+		self.handleError(tcpError{Code: RPC_INVALID_PARAMS, Message: "Method not found: " + req.Name}, conn)
+		return
+	}
+	self.mashalJsonFromStructResponse(method, conn)
+}
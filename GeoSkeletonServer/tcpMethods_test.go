@@ -0,0 +1,33 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Unittest tcpMethods
+func TestTcpMethods(t *testing.T) {
+	if len(tcpMethods) != len(tcpMethodIndex) {
+		t.Error("Method names should be unique")
+	}
+	for _, method := range tcpMethods {
+		req := TcpMessage{}
+		err := json.Unmarshal(method.Example, &req)
+		if nil != err || method.Name != req.Method {
+			t.Errorf("Example of %v should call it: %v", method.Name, err)
+		}
+		if "" != method.AliasOf {
+			if _, ok := getTcpMethod(method.AliasOf); !ok {
+				t.Errorf("%v is an alias of an unknown method", method.Name)
+			}
+		}
+	}
+	for _, name := range []string{"insert_layer", "delete_layer", "export_layer"} {
+		if _, ok := getTcpMethod(name); !ok {
+			t.Errorf("%v should be registered", name)
+		}
+	}
+	if !isPublicMethod("ping") || isPublicMethod("export_apikeys") || isPublicMethod("bogus") {
+		t.Error("Public methods not registered")
+	}
+}
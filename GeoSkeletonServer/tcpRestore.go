@@ -0,0 +1,48 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// tcpRestoreProgress progress line of a streamed restore
+type tcpRestoreProgress struct {
+	Progress RestoreProgress `json:"progress"`
+}
+
+func (self *TcpServer) restore_commit_log(req TcpMessage, conn net.Conn) {
+	// {"method":"restore_commit_log","file":"api_commit.log.bak"}
+	// {"method":"restore_commit_log","file":"api_commit.log.bak","stop_at":1494877512000000000,"stream":true,"progress":1000}
+	if "" == req.File {
+		self.missingParams(conn)
+		return
+	}
+	// replayed writes can't be told apart from writes of other clients
+	clients := int(self.ActiveClients()) - 1 + Hub.connections()
+	if 0 < clients {
+		self.handleError(fmt.Errorf("Restores need the only connection to the server, %v other clients are connected", clients), conn)
+		return
+	}
+	options := RestoreOptions{StopAt: req.StopAt, StopOnError: req.StopOnError, Progress: req.Progress}
+	var progress func(RestoreProgress)
+	if req.Stream {
+		progress = func(status RestoreProgress) {
+			js, err := json.Marshal(tcpRestoreProgress{Progress: status})
+			if nil == err {
+				self.handleStream(string(js), conn)
+			}
+		}
+	}
+	report, err := RestoreCommitLog(req.File, options, progress)
+	if nil != err {
+		self.handleError(err, conn)
+		return
+	}
+	if !report.Verified {
+		message := fmt.Sprintf("Restore not verified: %v lines failed, %v problems", report.Failed, len(report.Verification.Problems))
+		self.handleError(tcpError{Code: RPC_RESTORE_FAILED, Message: message, Data: report}, conn)
+		return
+	}
+	self.mashalJsonFromStructResponse(report, conn)
+}
@@ -0,0 +1,261 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+const JSONRPC_VERSION = "2.0"
+
+// JSON-RPC 2.0 error codes
+const (
+	RPC_PARSE_ERROR      = -32700
+	RPC_INVALID_REQUEST  = -32600
+	RPC_METHOD_NOT_FOUND = -32601
+	RPC_INVALID_PARAMS   = -32602
+	RPC_INTERNAL_ERROR   = -32603
+	RPC_SERVER_ERROR     = -32000
+	RPC_UNAUTHORIZED     = -32001
+	RPC_BATCH_FAILED     = -32002
+	RPC_RESTORE_FAILED   = -32003
+)
+
+// RpcRequest JSON-RPC 2.0 request. Params are named and use the same
+// fields as the legacy tcp message.
+type RpcRequest struct {
+	JsonRpc string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params"`
+}
+
+// RpcError JSON-RPC 2.0 error object
+type RpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// RpcResponse JSON-RPC 2.0 response
+type RpcResponse struct {
+	JsonRpc string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id"`
+	Result  *json.RawMessage `json:"result,omitempty"`
+	Error   *RpcError        `json:"error,omitempty"`
+}
+
+// tcpErrorResponse legacy tcp error response
+type tcpErrorResponse struct {
+	Status string           `json:"status"`
+	Id     *json.RawMessage `json:"id,omitempty"`
+	Error  string           `json:"error"`
+	Data   interface{}      `json:"data,omitempty"`
+}
+
+// tcpSuccessResponse legacy tcp success response
+type tcpSuccessResponse struct {
+	Status string           `json:"status"`
+	Id     *json.RawMessage `json:"id,omitempty"`
+	Data   json.RawMessage  `json:"data"`
+}
+
+// tcpMessageResponse result of tcp methods acting on a single record
+type tcpMessageResponse struct {
+	Apikey     string `json:"apikey,omitempty"`
+	Customer   string `json:"customer,omitempty"`
+	Id         string `json:"id,omitempty"`
+	Role       string `json:"role,omitempty"`
+	Datasource string `json:"datasource_id,omitempty"`
+	Version    string `json:"version,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// tcpImportResponse result of import_file
+type tcpImportResponse struct {
+	Datasource string `json:"datasource"`
+}
+
+// tcpStreamRecord record streamed ahead of the response to a tagged request.
+// Records carry the request id as request so they can't be mistaken for the response.
+type tcpStreamRecord struct {
+	Status  string           `json:"status,omitempty"`
+	Request *json.RawMessage `json:"request"`
+	Data    json.RawMessage  `json:"data"`
+}
+
+// tcpStreamNotification JSON-RPC 2.0 notification carrying a streamed record
+type tcpStreamNotification struct {
+	JsonRpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  tcpStreamRecord `json:"params"`
+}
+
+// tcpError is an error with a JSON-RPC error code and optional error data
+type tcpError struct {
+	Code    int
+	Message string
+	Data    interface{}
+}
+
+func (self tcpError) Error() string {
+	return self.Message
+}
+
+// getErrorCode returns the JSON-RPC error code of an error
+func getErrorCode(err error) int {
+	if rpcErr, ok := err.(tcpError); ok {
+		return rpcErr.Code
+	}
+	return RPC_SERVER_ERROR
+}
+
+// getErrorData returns the data attached to an error
+func getErrorData(err error) interface{} {
+	if rpcErr, ok := err.(tcpError); ok {
+		return rpcErr.Data
+	}
+	return nil
+}
+
+// tcpConn answers a request tagged with an id. Responses written through it
+// carry the request id and are framed as JSON-RPC responses when rpc is set.
+type tcpConn struct {
+	net.Conn
+	id           *json.RawMessage
+	rpc          bool
+	notification bool
+}
+
+// writeResponse writes a JSON-RPC response. Notifications are not answered.
+func (self *tcpConn) writeResponse(resp RpcResponse) {
+	if self.notification {
+		return
+	}
+	resp.JsonRpc = JSONRPC_VERSION
+	resp.Id = self.id
+	js, err := json.Marshal(resp)
+	if err != nil {
+		resp.Result = nil
+		resp.Error = &RpcError{Code: RPC_INTERNAL_ERROR, Message: err.Error()}
+		js, _ = json.Marshal(resp)
+	}
+	self.Write(append(js, '\n'))
+}
+
+// writeResult writes a successful response
+func (self *tcpConn) writeResult(data string) {
+	if !self.rpc {
+		js, err := json.Marshal(tcpSuccessResponse{Status: "ok", Id: self.id, Data: json.RawMessage(data)})
+		if err != nil {
+			self.writeError(err)
+			return
+		}
+		self.Write(append(js, '\n'))
+		return
+	}
+	result := json.RawMessage(data)
+	self.writeResponse(RpcResponse{Result: &result})
+}
+
+// writeStream writes a streamed record. Records are sent without an id,
+// only the final response answers the request.
+func (self *tcpConn) writeStream(data json.RawMessage) {
+	if self.notification {
+		return
+	}
+	var js []byte
+	var err error
+	if self.rpc {
+		js, err = json.Marshal(tcpStreamNotification{JsonRpc: JSONRPC_VERSION, Method: "stream", Params: tcpStreamRecord{Request: self.id, Data: data}})
+	} else {
+		js, err = json.Marshal(tcpStreamRecord{Status: "stream", Request: self.id, Data: data})
+	}
+	if err != nil {
+		self.writeError(err)
+		return
+	}
+	self.Write(append(js, '\n'))
+}
+
+// writeError writes an error response
+func (self *tcpConn) writeError(err error) {
+	if !self.rpc {
+		js, _ := json.Marshal(tcpErrorResponse{Status: "error", Id: self.id, Error: err.Error(), Data: getErrorData(err)})
+		self.Write(append(js, '\n'))
+		return
+	}
+	self.writeResponse(RpcResponse{Error: &RpcError{Code: getErrorCode(err), Message: err.Error(), Data: getErrorData(err)}})
+}
+
+// isRpc checks if responses are framed as JSON-RPC
+func isRpc(conn net.Conn) bool {
+	tagged, ok := conn.(*tcpConn)
+	return ok && tagged.rpc
+}
+
+// isTagged checks if the request was tagged with an id
+func isTagged(conn net.Conn) bool {
+	tagged, ok := conn.(*tcpConn)
+	return ok && nil != tagged.id
+}
+
+// lockedConn serializes writes of concurrently handled requests
+type lockedConn struct {
+	net.Conn
+	lock sync.Mutex
+}
+
+func (self *lockedConn) Write(b []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.Conn.Write(b)
+}
+
+// parseTcpRequest parses a legacy or JSON-RPC 2.0 request line. Returns the
+// connection responses have to be written to, which frames them to match the request.
+// Legacy requests can be tagged with an id. Lines that can't be parsed are answered
+// as JSON-RPC when rpc is set. JSON-RPC batches are not supported and are
+// answered with a single invalid request error.
+func parseTcpRequest(message string, conn net.Conn, rpc bool) (TcpMessage, net.Conn, error) {
+	req := TcpMessage{}
+	if strings.HasPrefix(strings.TrimSpace(message), "[") {
+		return req, &tcpConn{Conn: conn, rpc: true}, tcpError{Code: RPC_INVALID_REQUEST, Message: "Invalid request: batch requests are not supported"}
+	}
+	raw := RpcRequest{}
+	err := json.Unmarshal([]byte(message), &raw)
+	if err != nil {
+		if rpc {
+			conn = &tcpConn{Conn: conn, rpc: true}
+		}
+		return req, conn, tcpError{Code: RPC_PARSE_ERROR, Message: fmt.Sprintf("Parse error: %v", err)}
+	}
+
+	// legacy request
+	if "" == raw.JsonRpc {
+		if nil != raw.Id {
+			conn = &tcpConn{Conn: conn, id: raw.Id}
+		}
+		err = json.Unmarshal([]byte(message), &req)
+		if err != nil {
+			return req, conn, tcpError{Code: RPC_INVALID_REQUEST, Message: fmt.Sprintf("Invalid request: %v", err)}
+		}
+		return req, conn, nil
+	}
+
+	writer := &tcpConn{Conn: conn, id: raw.Id, rpc: true, notification: nil == raw.Id}
+	if JSONRPC_VERSION != raw.JsonRpc || "" == raw.Method {
+		writer.notification = false
+		return req, writer, tcpError{Code: RPC_INVALID_REQUEST, Message: "Invalid request"}
+	}
+	if 0 != len(raw.Params) && "null" != string(raw.Params) {
+		err = json.Unmarshal(raw.Params, &req)
+		if err != nil {
+			return req, writer, tcpError{Code: RPC_INVALID_PARAMS, Message: fmt.Sprintf("Invalid params: %v", err)}
+		}
+	}
+	req.Method = raw.Method
+	return req, writer, nil
+}
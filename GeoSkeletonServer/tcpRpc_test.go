@@ -0,0 +1,73 @@
+package geo_skeleton_server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Unittest parseTcpRequest
+func TestParseTcpRequest(t *testing.T) {
+	req, writer, err := parseTcpRequest(`{"method":"export_apikey","apikey":"12dB6BlenIeB"}`, nil, false)
+	if nil != err || "12dB6BlenIeB" != req.Apikey {
+		t.Errorf("Legacy request not parsed: %v %v", req, err)
+	}
+	if isRpc(writer) || isTagged(writer) {
+		t.Error("Legacy request should not be answered as JSON-RPC")
+	}
+
+	req, writer, err = parseTcpRequest(`{"jsonrpc":"2.0","id":7,"method":"export_apikey","params":{"apikey":"12dB6BlenIeB"}}`, nil, false)
+	if nil != err || "export_apikey" != req.Method || "12dB6BlenIeB" != req.Apikey {
+		t.Errorf("JSON-RPC request not parsed: %v %v", req, err)
+	}
+	rpc, ok := writer.(*tcpConn)
+	if !ok || !rpc.rpc || "7" != string(*rpc.id) {
+		t.Error("JSON-RPC request should be answered with its id")
+	}
+
+	req, writer, err = parseTcpRequest(`{"id":"a","method":"ping"}`, nil, false)
+	if nil != err || isRpc(writer) || !isTagged(writer) {
+		t.Errorf("Tagged legacy request not parsed: %v %v", req, err)
+	}
+
+	_, _, err = parseTcpRequest(`{"method":`, nil, true)
+	if RPC_PARSE_ERROR != getErrorCode(err) {
+		t.Errorf("Expected parse error, got %v", err)
+	}
+
+	_, writer, err = parseTcpRequest(`[{"jsonrpc":"2.0","id":1,"method":"ping"}]`, nil, false)
+	if RPC_INVALID_REQUEST != getErrorCode(err) || !isRpc(writer) {
+		t.Errorf("Expected invalid request for batch, got %v", err)
+	}
+}
+
+// Unittest streamed records of tagged requests
+func TestStreamedResponse(t *testing.T) {
+	server := &TcpServer{}
+	id := json.RawMessage(`7`)
+	for _, rpc := range []bool{true, false} {
+		capture := &captureConn{}
+		conn := &tcpConn{Conn: capture, id: &id, rpc: rpc}
+		server.handleStream(`{"layer":1}`, conn)
+		server.handleStream(`{"layer":2}`, conn)
+		server.handleSuccess(`{"snapshots":2}`, conn)
+		lines := strings.Split(strings.TrimSpace(capture.buffer.String()), "\n")
+		if 3 != len(lines) {
+			t.Fatalf("Expected 3 lines, got %v", lines)
+		}
+		answers := []string{}
+		for _, line := range lines {
+			resp := map[string]json.RawMessage{}
+			err := json.Unmarshal([]byte(line), &resp)
+			if nil != err {
+				t.Fatalf("Invalid line %v: %v", line, err)
+			}
+			if answer, ok := resp["id"]; ok {
+				answers = append(answers, string(answer))
+			}
+		}
+		if 1 != len(answers) || "7" != answers[0] || strings.Contains(lines[2], "stream") {
+			t.Errorf("Only the final line should answer the request: %v", lines)
+		}
+	}
+}
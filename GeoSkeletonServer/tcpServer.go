@@ -11,22 +11,32 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"./utils"
 	"github.com/paulmach/go.geojson"
 )
 
 const (
-	TCP_DEFAULT_CONN_HOST = "localhost"
-	TCP_DEFAULT_CONN_PORT = "3333"
-	TCP_DEFAULT_CONN_TYPE = "tcp"
+	TCP_DEFAULT_CONN_HOST               = "localhost"
+	TCP_DEFAULT_CONN_PORT               = "3333"
+	TCP_DEFAULT_CONN_TYPE               = "tcp"
+	TCP_DEFAULT_MAX_CONCURRENT_REQUESTS = 4
 )
 
 type TcpServer struct {
-	Host             string
-	Port             string
-	ConnType         string
-	ActiveTcpClients int
+	Host                  string
+	Port                  string
+	ConnType              string
+	ActiveTcpClients      int32
+	AllowedNetworks       []string
+	RequireAuth           bool
+	TLS                   *TcpTlsConfig
+	MaxConcurrentRequests int
+	SocketFile            string
+	SocketMode            os.FileMode
 }
 
 func (self *TcpServer) getHost() string {
@@ -53,180 +63,269 @@ func (self *TcpServer) getConnType() string {
 	return self.ConnType
 }
 
-func (self TcpServer) Start() {
+func (self *TcpServer) getMaxConcurrentRequests() int {
+	if 0 >= self.MaxConcurrentRequests {
+		return TCP_DEFAULT_MAX_CONCURRENT_REQUESTS
+	}
+	return self.MaxConcurrentRequests
+}
+
+// ActiveClients returns the number of open tcp connections
+func (self *TcpServer) ActiveClients() int32 {
+	return atomic.LoadInt32(&self.ActiveTcpClients)
+}
+
+// Start listens on the tcp port and, when SocketFile is set, on a unix
+// socket. With ConnType "unix" only the unix socket is opened.
+func (self *TcpServer) Start() {
+	networks, err := self.getAllowedNetworks()
+	if err != nil {
+		ServerLogger.Error("Error parsing allowed networks:", err.Error())
+		panic(err)
+	}
+
+	if "" != self.SocketFile {
+		l, err := self.listenUnix()
+		if err != nil {
+			ServerLogger.Error("Error listening:", err.Error())
+			panic(err)
+		}
+		ServerLogger.Info("Unix socket listening on " + self.SocketFile)
+		go self.serve(l, networks)
+	}
+
+	if TCP_UNIX_CONN_TYPE == self.getConnType() {
+		if "" == self.SocketFile {
+			err := errors.New("Unix conn type requires a socket file")
+			ServerLogger.Error("Error listening:", err.Error())
+			panic(err)
+		}
+		return
+	}
+
 	go func() {
 		// Check settings and apply defaults
 		serv := fmt.Sprintf("%v:%v", self.getHost(), self.getPort())
 
 		// Listen for incoming connections.
-		l, err := net.Listen(self.getConnType(), serv)
+		l, err := self.listen(serv)
 		if err != nil {
 			ServerLogger.Error("Error listening:", err.Error())
 			panic(err)
 		}
 		ServerLogger.Info("Tcp Listening on " + serv)
+		if nil == self.TLS && hasRemoteNetworks(networks) {
+			ServerLogger.Warn("Tcp server accepts remote networks without tls, authkeys and data are sent in plaintext")
+		}
 
-		// Close the listener when the application closes.
-		defer l.Close()
-
-		for {
-			// Listen for an incoming connection.
-			conn, err := l.Accept()
-			if err != nil {
-				NetworkLogger.Error("Error accepting connection: ", err.Error())
-				return
-				// conn.Close()
-			}
+		self.serve(l, networks)
+	}()
+}
 
-			NetworkLogger.Info("Connection open ", conn.RemoteAddr().String(), " [TCP]")
+// serve accepts connections until the listener fails
+func (self *TcpServer) serve(l net.Listener, networks []*net.IPNet) {
+	// Close the listener when the application closes.
+	defer l.Close()
 
-			// check for local connection
-			if strings.Contains(conn.RemoteAddr().String(), "127.0.0.1") {
-				// Handle connections in a new goroutine.
-				go self.tcpClientHandler(conn)
-			} else {
-				// don't accept not local connections
-				conn.Close()
-			}
+	for {
+		// Listen for an incoming connection.
+		conn, err := l.Accept()
+		if err != nil {
+			NetworkLogger.Error("Error accepting connection: ", err.Error())
+			return
+			// conn.Close()
+		}
 
+		NetworkLogger.Info("Connection open ", conn.RemoteAddr().String(), " [TCP]")
+
+		// check connection comes from an allowed network, unix socket
+		// access is controlled by the socket file permissions
+		if isUnixConn(conn) || isAllowedAddr(conn.RemoteAddr(), networks) {
+			// Handle connections in a new goroutine.
+			go self.tcpClientHandler(conn)
+		} else {
+			// don't accept connections from other networks
+			NetworkLogger.Warn("Connection refused ", conn.RemoteAddr().String(), " [TCP]")
+			conn.Close()
 		}
-	}()
+
+	}
 }
 
 // close tcp client
 func (self *TcpServer) closeClient(conn net.Conn) {
-	self.ActiveTcpClients--
+	atomic.AddInt32(&self.ActiveTcpClients, -1)
 	conn.Close()
 }
 
-// Handles incoming requests.
+// Handles incoming requests. Requests tagged with an id are handled
+// concurrently and answered in the order they finish, untagged requests
+// are handled in order.
 func (self *TcpServer) tcpClientHandler(conn net.Conn) {
 
-	self.ActiveTcpClients++
+	atomic.AddInt32(&self.ActiveTcpClients, 1)
 	defer self.closeClient(conn)
 
+	// wait for pipelined requests before closing
+	var pending sync.WaitGroup
+	defer pending.Wait()
+	limit := make(chan bool, self.getMaxConcurrentRequests())
+
+	required, err := self.requiresAuth(conn)
+	if err != nil {
+		NetworkLogger.Warn("TLS handshake failed: ", err)
+		return
+	}
+	authenticated := !required
+	failures := 0
+
+	locked := &lockedConn{Conn: conn}
 	reader := bufio.NewReader(conn)
 	tp := textproto.NewReader(reader)
 
-	for {
-		// will listen for message to process ending in newline (\n)
-		message, _ := tp.ReadLine()
+	// switches to JSON-RPC responses for bad lines once the client used it
+	rpc := false
 
-		// output message received
-		NetworkLogger.Info("[TCP] Message Received: ", string([]byte(message)))
+	// events stream to the connection after subscribe is called
+	var subscription *eventSubscriber
+	defer func() {
+		if nil != subscription {
+			Events.unsubscribe(subscription)
+		}
+	}()
 
-		// json parse message
-		req := TcpMessage{}
-		err := json.Unmarshal([]byte(message), &req)
+	for {
+		// will listen for message to process ending in newline (\n)
+		message, err := tp.ReadLine()
 		if err != nil {
-			// invalid message
-			// close connection
-			// '\x04' end of transmittion character
-			NetworkLogger.Warn("error:", err)
-			resp := `{"status": "error", "error": "` + fmt.Sprintf("%v", err) + `",""}`
-			conn.Write([]byte(resp + "\n"))
 			NetworkLogger.Info("Connection closed", " [TCP]")
 			return
 		}
 
-		switch {
-
-		case req.Method == "ping":
-			self.handleSuccess(`{"message": "pong", "version": "`+VERSION+`"}`, conn)
-
-		case req.Method == "help":
-			conn.Write([]byte("Methods:\n"))
-			conn.Write([]byte("\t ping\n"))
-			conn.Write([]byte("\t assign_datasource\n"))
-			conn.Write([]byte("\t create_apikey\n"))
-			conn.Write([]byte("\t insert_apikey\n"))
-			conn.Write([]byte("\t insert_feature\n"))
-			conn.Write([]byte("\t edit_feature\n"))
-			conn.Write([]byte("\t create_datasource\n"))
-			conn.Write([]byte("\t export_apikeys\n"))
-			conn.Write([]byte("\t export_apikey\n"))
-			conn.Write([]byte("\t export_datasources\n"))
-			conn.Write([]byte("\t export_datasource\n"))
-			conn.Write([]byte("\t import_file\n"))
-
-		// APIKEYS
-		case req.Method == "create_apikey":
-			self.create_apikey(req, conn)
-
-		case req.Method == "insert_apikey":
-			self.insert_apikey(req, conn)
-
-		case req.Method == "export_apikeys":
-			self.export_apikeys(req, conn)
-
-		case req.Method == "export_apikey":
-			self.export_apikey(req, conn)
-
-		// FEATURE
-		case req.Method == "insert_feature":
-			self.insert_feature(req, conn)
-
-		case req.Method == "edit_feature":
-			self.edit_feature(req, conn)
-
-		// DATASOURCES
-		case req.Method == "assign_datasource":
-			self.assign_datasource(req, conn)
-
-		case req.Method == "create_datasource":
-			self.create_datasource(req, conn)
-
-		case req.Method == "insert_layer":
-			self.create_datasource(req, conn)
+		// output message received
+		NetworkLogger.Info("[TCP] Message Received: ", message)
 
-		case req.Method == "delete_layer":
-			self.delete_datasource(req, conn)
+		// json parse message, invalid messages are answered and skipped
+		req, writer, err := parseTcpRequest(message, locked, rpc)
+		rpc = rpc || isRpc(writer)
+		if err != nil {
+			NetworkLogger.Warn("error:", err)
+			self.handleError(err, writer)
+			continue
+		}
 
-		case req.Method == "delete_datasource":
-			self.delete_datasource(req, conn)
+		// connections have to authenticate before calling other methods
+		if !authenticated && !isPublicMethod(req.Method) {
+			self.handleError(tcpError{Code: RPC_UNAUTHORIZED, Message: "Unauthorized, send auth first"}, writer)
+			continue
+		}
 
-		// TODO: ERROR HANDLING
-		case req.Method == "export_datasources":
-			self.export_datasources(req, conn)
+		if "auth" == req.Method {
+			if self.auth(req, writer) {
+				authenticated = true
+				continue
+			}
+			// don't let clients guess the authkey on one connection
+			if !authenticated {
+				failures++
+			}
+			if TCP_MAX_AUTH_FAILURES <= failures {
+				NetworkLogger.Warn("Too many failed auth attempts, closing ", conn.RemoteAddr().String(), " [TCP]")
+				return
+			}
+			continue
+		}
 
-		case req.Method == "export_datasource":
-			self.export_datasource(req, conn)
+		if "subscribe" == req.Method {
+			subscription = self.subscribe(req, writer, subscription)
+			continue
+		}
 
-		case req.Method == "export_layer":
-			self.export_datasource(req, conn)
+		if "unsubscribe" == req.Method {
+			self.unsubscribe(subscription, writer)
+			subscription = nil
+			continue
+		}
 
-		case req.Method == "import_file":
-			self.import_file(req, conn)
+		if !isTagged(writer) {
+			self.handleRequest(req, writer)
+			continue
+		}
 
-			/*
+		// blocks reading when the connection is at its concurrency limit
+		limit <- true
+		pending.Add(1)
+		go func(req TcpMessage, writer net.Conn) {
+			defer pending.Done()
+			defer func() { <-limit }()
+			self.handleRequest(req, writer)
+		}(req, writer)
+	}
+}
 
-			   "export_datasource_snapshots
-			   "export_datasource_by_snapshot"
-			   "export_datasource_by_range"
+// handleRequest calls the registered method
+func (self *TcpServer) handleRequest(req TcpMessage, conn net.Conn) {
+	method, ok := getTcpMethod(req.Method)
+	if !ok {
+		self.handleError(tcpError{Code: RPC_METHOD_NOT_FOUND, Message: "Method not found"}, conn)
+		return
+	}
+	if nil == method.handler {
+		self.handleError(tcpError{Code: RPC_INVALID_REQUEST, Message: "Method can only be called on the connection: " + req.Method}, conn)
+		return
+	}
+	// restores replay lines through captured connections
+	if _, replay := conn.(*captureConn); isRestoring() && !replay {
+		self.handleError(tcpError{Code: RPC_SERVER_ERROR, Message: "Restore in progress"}, conn)
+		return
+	}
+	method.handler(self, req, conn)
+}
 
-			*/
+func (self *TcpServer) handleError(err error, conn net.Conn) {
+	if tagged, ok := conn.(*tcpConn); ok {
+		tagged.writeError(err)
+		return
+	}
+	js, _ := json.Marshal(tcpErrorResponse{Status: "error", Error: err.Error(), Data: getErrorData(err)})
+	conn.Write(append(js, '\n'))
+}
 
-		default:
-			err := errors.New("Method not found")
-			self.handleError(err, conn)
-		}
+func (self *TcpServer) handleSuccess(data string, conn net.Conn) {
+	if tagged, ok := conn.(*tcpConn); ok {
+		tagged.writeResult(data)
+		return
 	}
+	self.writeSuccess(data, conn)
 }
 
-func (self TcpServer) handleError(err error, conn net.Conn) {
-	conn.Write([]byte("{\"status\": \"error\", \"error\": \"" + err.Error() + "\"}\n"))
+// writeSuccess writes a legacy success response to an untagged request
+func (self *TcpServer) writeSuccess(data string, conn net.Conn) {
+	js, err := json.Marshal(tcpSuccessResponse{Status: "ok", Data: json.RawMessage(data)})
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	conn.Write(append(js, '\n'))
 }
 
-func (self TcpServer) handleSuccess(data string, conn net.Conn) {
-	conn.Write([]byte("{\"status\": \"ok\", \"data\": " + data + "}\n"))
+// handleStream writes one record of a streamed response. Untagged requests
+// get a line per record, tagged requests get notifications and are answered
+// by the handleSuccess following the records.
+func (self *TcpServer) handleStream(data string, conn net.Conn) {
+	if tagged, ok := conn.(*tcpConn); ok {
+		tagged.writeStream(json.RawMessage(data))
+		return
+	}
+	self.writeSuccess(data, conn)
 }
 
-func (self TcpServer) missingParams(conn net.Conn) {
-	err := errors.New("Missing required parameters")
+func (self *TcpServer) missingParams(conn net.Conn) {
+	err := tcpError{Code: RPC_INVALID_PARAMS, Message: "Missing required parameters"}
 	self.handleError(err, conn)
 }
 
-func (self TcpServer) mashalJsonFromStructResponse(data interface{}, conn net.Conn) {
+func (self *TcpServer) mashalJsonFromStructResponse(data interface{}, conn net.Conn) {
 	js, err := json.Marshal(data)
 	if err != nil {
 		self.handleError(err, conn)
@@ -236,46 +335,59 @@ func (self TcpServer) mashalJsonFromStructResponse(data interface{}, conn net.Co
 }
 
 // APIKEYS
-func (self TcpServer) create_apikey(req TcpMessage, conn net.Conn) {
+func (self *TcpServer) create_apikey(req TcpMessage, conn net.Conn) {
 	// {"method":"create_apikey"}
-	apikey := utils.NewAPIKey(12)
-	customer := Customer{Apikey: apikey}
+	customer := newCustomer()
 	err := DB.InsertCustomer(customer)
 	if err != nil {
 		self.handleError(err, conn)
 		return
 	}
-	self.handleSuccess(`{"apikey": "`+apikey+`"}`, conn)
+	key, err := DB.CreateApikey(customer.Id, "default", nil)
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	self.mashalJsonFromStructResponse(tcpMessageResponse{Apikey: key.Apikey, Customer: customer.Id}, conn)
 }
 
-func (self TcpServer) insert_apikey(req TcpMessage, conn net.Conn) {
-	// {"method": "insert_apikey"}
-	if "" == req.Data.Apikey {
+func (self *TcpServer) insert_apikey(req TcpMessage, conn net.Conn) {
+	// {"method": "insert_apikey", "data": {"id": "...", "datasources": []}}
+	if "" == req.Data.Id && "" == req.Data.Apikey {
 		self.missingParams(conn)
 		return
 	}
-	customer := Customer{Apikey: req.Data.Apikey, Datasources: req.Data.Datasources}
-	err := DB.InsertCustomer(customer)
+	customer := Customer{Id: req.Data.Id, Apikey: req.Data.Apikey, Datasources: req.Data.Datasources, Roles: req.Data.Roles}
+	customer.migrateRoles()
+	var err error
+	if "" == customer.Id {
+		// commit logs written before apikeys were hashed
+		customer, err = DB.migrateCustomer(customer)
+	} else {
+		err = DB.InsertCustomer(customer)
+	}
 	if err != nil {
 		self.handleError(err, conn)
 		return
 	}
-	self.handleSuccess(`{"apikey": "`+req.Data.Apikey+`"}`, conn)
+	self.mashalJsonFromStructResponse(tcpMessageResponse{Customer: customer.Id}, conn)
 }
 
-func (self TcpServer) export_apikeys(req TcpMessage, conn net.Conn) {
+func (self *TcpServer) export_apikeys(req TcpMessage, conn net.Conn) {
 	// {"method":"export_apikeys"}
+	// {"method":"export_apikeys","stream":true,"offset":0,"limit":100}
 	apikeys, err := DB.GetCustomers()
 	if err != nil {
 		self.handleError(err, conn)
 		return
 	}
-	self.mashalJsonFromStructResponse(apikeys, conn)
+	// customers are exported as json strings whether streamed or not
+	self.exportStrings(req, apikeys, conn)
 }
 
-func (self TcpServer) export_apikey(req TcpMessage, conn net.Conn) {
+func (self *TcpServer) export_apikey(req TcpMessage, conn net.Conn) {
 	// {"method":"export_apikey","apikey":"12dB6BlenIeB"}
-	apikey, err := DB.GetCustomer(req.Apikey)
+	apikey, err := DB.LookupCustomer(req.Apikey)
 	if err != nil {
 		self.handleError(err, conn)
 		return
@@ -283,38 +395,151 @@ func (self TcpServer) export_apikey(req TcpMessage, conn net.Conn) {
 	self.mashalJsonFromStructResponse(apikey, conn)
 }
 
+func (self *TcpServer) create_key(req TcpMessage, conn net.Conn) {
+	// {"method":"create_key","apikey":"12dB6BlenIeB","label":"ci","expires":1735689600}
+	if "" == req.Apikey {
+		self.missingParams(conn)
+		return
+	}
+	customer, err := DB.LookupCustomer(req.Apikey)
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	key, err := DB.CreateApikey(customer.Id, req.Label, expiresAt(req.Expires))
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	self.mashalJsonFromStructResponse(key.public(), conn)
+}
+
+func (self *TcpServer) insert_key(req TcpMessage, conn net.Conn) {
+	// {"method":"insert_key","data":{"id":"...","prefix":"...","salt":"...","hash":"...","customer":"...","label":"..."}}
+	if "" == req.Data.Id || "" == req.Data.Hash || "" == req.Data.Customer {
+		self.missingParams(conn)
+		return
+	}
+	key := ApiKey{
+		Id:       req.Data.Id,
+		Prefix:   req.Data.Prefix,
+		Salt:     req.Data.Salt,
+		Hash:     req.Data.Hash,
+		Customer: req.Data.Customer,
+		Label:    req.Data.Label,
+		Created:  req.Data.Created,
+		Expires:  req.Data.Expires,
+		LastUsed: req.Data.LastUsed,
+		Revoked:  req.Data.Revoked,
+	}
+	err := DB.InsertApikey(key)
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	self.mashalJsonFromStructResponse(tcpMessageResponse{Id: key.Id}, conn)
+}
+
+func (self *TcpServer) list_keys(req TcpMessage, conn net.Conn) {
+	// {"method":"list_keys","apikey":"12dB6BlenIeB"}
+	if "" == req.Apikey {
+		self.missingParams(conn)
+		return
+	}
+	customer, err := DB.LookupCustomer(req.Apikey)
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	keys, err := DB.GetCustomerApikeys(customer.Id)
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	for i := range keys {
+		keys[i] = keys[i].public()
+	}
+	self.mashalJsonFromStructResponse(keys, conn)
+}
+
+func (self *TcpServer) rotate_key(req TcpMessage, conn net.Conn) {
+	// {"method":"rotate_key","key_id":"...","grace_period":3600}
+	if "" == req.KeyId {
+		self.missingParams(conn)
+		return
+	}
+	key, err := DB.GetApikeyById(req.KeyId)
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	rotated, err := DB.RotateApikey(key, time.Duration(req.GracePeriod)*time.Second)
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	self.mashalJsonFromStructResponse(rotated.public(), conn)
+}
+
+func (self *TcpServer) revoke_key(req TcpMessage, conn net.Conn) {
+	// {"method":"revoke_key","key_id":"..."}
+	if "" == req.KeyId {
+		self.missingParams(conn)
+		return
+	}
+	key, err := DB.GetApikeyById(req.KeyId)
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	key, err = DB.RevokeApikey(key)
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	self.mashalJsonFromStructResponse(key.public(), conn)
+}
+
 // DATASOURCES
-func (self TcpServer) assign_datasource(req TcpMessage, conn net.Conn) {
+func (self *TcpServer) assign_datasource(req TcpMessage, conn net.Conn) {
 	// {"method":"assign_datasource"}
+	// {"method":"assign_datasource","apikey":"12dB6BlenIeB","datasource":"20f3332781ea4d7b8d509d12517ac5fa","role":"viewer"}
 	datasource_id := req.Datasource
 	apikey := req.Apikey
+	role := req.Role
 
 	if "" == datasource_id || "" == apikey {
 		self.missingParams(conn)
 		return
 	}
 
-	customer, err := DB.GetCustomer(apikey)
-	if err != nil {
-		self.handleError(err, conn)
+	// datasources assigned without a role belong to their owner
+	if "" == role {
+		role = ROLE_OWNER
+	}
+	if !IsValidRole(role) {
+		self.handleError(fmt.Errorf("Invalid role: %v", role), conn)
 		return
 	}
 
-	_, err = GeoDB.GetLayer(datasource_id)
+	_, err := GeoDB.GetLayer(datasource_id)
 	if err != nil {
 		self.handleError(err, conn)
 		return
 	}
 
-	if !utils.StringInSlice(datasource_id, customer.Datasources) {
-		customer.Datasources = append(customer.Datasources, datasource_id)
-		DB.InsertCustomer(customer)
+	_, err = DB.UpdateCustomer(apikey, func(customer *Customer) bool {
+		return customer.applyRole(datasource_id, role)
+	})
+	if err != nil {
+		self.handleError(err, conn)
+		return
 	}
 
-	self.handleSuccess(`{}`, conn)
+	self.mashalJsonFromStructResponse(tcpMessageResponse{Role: role}, conn)
 }
 
-func (self TcpServer) create_datasource(req TcpMessage, conn net.Conn) {
+func (self *TcpServer) create_datasource(req TcpMessage, conn net.Conn) {
 	// {"method":"create_datasource"}
 	datasource_id := req.Datasource
 	var err error
@@ -322,30 +547,33 @@ func (self TcpServer) create_datasource(req TcpMessage, conn net.Conn) {
 	fmt.Println(req.Datasource, req.Layer)
 
 	if "" != req.Datasource {
-		err = GeoDB.InsertLayer(req.Datasource, req.Layer)
+		err = DB.InsertLayer(req.Datasource, req.Layer)
 	} else {
-		datasource_id, err = GeoDB.NewLayer()
+		datasource_id, err = DB.NewLayer()
 	}
 
 	if err != nil {
 		self.handleError(err, conn)
 		return
 	}
+	resetDatasourceUsage(datasource_id)
+	publishLayerEvent(EVENT_LAYER_CREATED, datasource_id)
 
-	self.handleSuccess(`{"datasource_id":"`+datasource_id+`"}`, conn)
+	self.mashalJsonFromStructResponse(tcpMessageResponse{Datasource: datasource_id}, conn)
 }
 
-func (self TcpServer) export_datasources(req TcpMessage, conn net.Conn) {
+func (self *TcpServer) export_datasources(req TcpMessage, conn net.Conn) {
 	// {"method":"export_datasources"}
+	// {"method":"export_datasources","stream":true,"offset":0,"limit":100}
 	layers, err := GeoDB.GetLayers()
 	if err != nil {
 		self.handleError(err, conn)
 		return
 	}
-	self.mashalJsonFromStructResponse(layers, conn)
+	self.exportStrings(req, layers, conn)
 }
 
-func (self TcpServer) export_datasource(req TcpMessage, conn net.Conn) {
+func (self *TcpServer) export_datasource(req TcpMessage, conn net.Conn) {
 	// {"method":"export_datasource","datasource":"20f3332781ea4d7b8d509d12517ac5fa"}
 	layer, err := GeoDB.GetLayer(req.Datasource)
 	if err != nil {
@@ -355,58 +583,179 @@ func (self TcpServer) export_datasource(req TcpMessage, conn net.Conn) {
 	self.mashalJsonFromStructResponse(layer, conn)
 }
 
-func (self TcpServer) delete_datasource(req TcpMessage, conn net.Conn) {
+func (self *TcpServer) delete_datasource(req TcpMessage, conn net.Conn) {
 	// {"method":"delete_layer", "datasource":"f79aac397a484998b94b56d345287096"}
 	if "" == req.Datasource {
 		self.missingParams(conn)
 		return
 	}
-	err := GeoDB.DeleteLayer(req.Datasource)
+	err := DB.DeleteLayer(req.Datasource)
 	if err != nil {
 		self.handleError(err, conn)
 		return
 	}
-	self.handleSuccess(`{"datasource_id":"`+req.Data.Datasource+`", "message":"layer deleted"}`, conn)
+	resetDatasourceUsage(req.Datasource)
+	publishLayerEvent(EVENT_LAYER_DELETED, req.Datasource)
+	self.mashalJsonFromStructResponse(tcpMessageResponse{Datasource: req.Data.Datasource, Message: "layer deleted"}, conn)
+}
+
+func (self *TcpServer) insert_layer_meta(req TcpMessage, conn net.Conn) {
+	// {"method":"insert_layer_meta","data":{"datasource":"f79aac397a484998b94b56d345287096","public":true}}
+	if "" == req.Data.Datasource {
+		self.missingParams(conn)
+		return
+	}
+	meta := LayerMeta{Datasource: req.Data.Datasource, Public: req.Data.Public}
+	err := DB.InsertLayerMeta(meta)
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	self.mashalJsonFromStructResponse(meta, conn)
+}
+
+// SNAPSHOTS
+
+// rangeSnapshot snapshot streamed by export_datasource_by_range
+type rangeSnapshot struct {
+	Datasource string          `json:"datasource_id"`
+	Timestamp  string          `json:"timestamp"`
+	Layer      json.RawMessage `json:"layer"`
+}
+
+// rangeSummary response of export_datasource_by_range
+type rangeSummary struct {
+	Datasource string `json:"datasource_id"`
+	Snapshots  int    `json:"snapshots"`
+}
+
+func (self *TcpServer) export_datasource_snapshots(req TcpMessage, conn net.Conn) {
+	// {"method":"export_datasource_snapshots","datasource":"20f3332781ea4d7b8d509d12517ac5fa"}
+	if "" == req.Datasource {
+		self.missingParams(conn)
+		return
+	}
+	lyr_ts, err := GeoDB.SelectTimeseriesDatasource(req.Datasource)
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	snapshots := []string{}
+	for _, ts := range lyr_ts.GetSnapshots() {
+		snapshots = append(snapshots, fmt.Sprintf("%v", ts))
+	}
+	self.mashalJsonFromStructResponse(map[string]interface{}{
+		"datasource_id": req.Datasource,
+		"snapshots":     snapshots,
+	}, conn)
+}
+
+func (self *TcpServer) export_datasource_by_snapshot(req TcpMessage, conn net.Conn) {
+	// {"method":"export_datasource_by_snapshot","datasource":"20f3332781ea4d7b8d509d12517ac5fa","timestamp":1494877512000000000}
+	if "" == req.Datasource || 0 == req.Timestamp {
+		self.missingParams(conn)
+		return
+	}
+	layer, err := GetLayerSnapshot(req.Datasource, req.Timestamp)
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	self.mashalJsonFromStructResponse(layer, conn)
+}
+
+func (self *TcpServer) export_datasource_by_range(req TcpMessage, conn net.Conn) {
+	// {"method":"export_datasource_by_range","datasource":"20f3332781ea4d7b8d509d12517ac5fa","begin_timestamp":1494877512000000000,"end_timestamp":1494963912000000000}
+	// Each snapshot within the range is streamed as its own line,
+	// the response holding the number of snapshots sent follows them.
+	if "" == req.Datasource || 0 == req.BeginTimestamp || 0 == req.EndTimestamp {
+		self.missingParams(conn)
+		return
+	}
+	lyr_ts, err := GeoDB.SelectTimeseriesDatasource(req.Datasource)
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	count := 0
+	for _, ts := range lyr_ts.GetSnapshots() {
+		if ts < req.BeginTimestamp || ts > req.EndTimestamp {
+			continue
+		}
+		val, err := lyr_ts.GetPreviousByTimestamp(ts)
+		if err != nil {
+			self.handleError(err, conn)
+			return
+		}
+		js, err := json.Marshal(rangeSnapshot{Datasource: req.Datasource, Timestamp: fmt.Sprintf("%v", ts), Layer: json.RawMessage(val)})
+		if err != nil {
+			self.handleError(err, conn)
+			return
+		}
+		self.handleStream(string(js), conn)
+		count++
+	}
+	self.mashalJsonFromStructResponse(rangeSummary{Datasource: req.Datasource, Snapshots: count}, conn)
 }
 
 // FEATURES
-func (self TcpServer) insert_feature(req TcpMessage, conn net.Conn) {
+func (self *TcpServer) insert_feature(req TcpMessage, conn net.Conn) {
 	// {"method":"insert_feature"}
 	if "" == req.Datasource {
 		self.missingParams(conn)
 		return
 	}
-	err := GeoDB.InsertFeature(req.Datasource, req.Feature)
+	unlock := lockLayer(req.Datasource)
+	defer unlock()
+	err := DB.InsertFeature(req.Datasource, req.Feature)
 	if err != nil {
 		self.handleError(err, conn)
 		return
 	}
-	self.handleSuccess(`{"datasource_id":"`+req.Data.Datasource+`", "message":"feature added"}`, conn)
+	resetDatasourceUsage(req.Datasource)
+	publishFeatureEvent(EVENT_FEATURE_INSERTED, req.Datasource, req.Feature)
+	self.mashalJsonFromStructResponse(tcpMessageResponse{Datasource: req.Data.Datasource, Message: "feature added"}, conn)
 }
 
-func (self TcpServer) edit_feature(req TcpMessage, conn net.Conn) {
+func (self *TcpServer) edit_feature(req TcpMessage, conn net.Conn) {
 	// {"method":"edit_feature"}
+	// {"method":"edit_feature","version":"3f786850e387550fdab836ed7e6dc881de23001b"}
 	if "" == req.Datasource || "" == req.GeoId {
 		self.missingParams(conn)
 		return
 	}
-	err := GeoDB.EditFeature(req.Datasource, req.GeoId, req.Feature)
+	unlock := lockLayer(req.Datasource)
+	defer unlock()
+	version, err := GetStoredFeatureVersion(req.Datasource, req.GeoId)
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	err = CheckVersion(req.Version, version)
 	if err != nil {
 		self.handleError(err, conn)
 		return
 	}
-	self.handleSuccess(`{"datasource_id":"`+req.Datasource+`", "message":"edited added"}`, conn)
+	err = DB.EditFeature(req.Datasource, req.GeoId, req.Feature)
+	if err != nil {
+		self.handleError(err, conn)
+		return
+	}
+	resetDatasourceUsage(req.Datasource)
+	Events.publish(Event{Type: EVENT_FEATURE_EDITED, Datasource: req.Datasource, GeoId: req.GeoId})
+	version, _ = GetStoredFeatureVersion(req.Datasource, req.GeoId)
+	self.mashalJsonFromStructResponse(tcpMessageResponse{Datasource: req.Datasource, Version: version, Message: "edited added"}, conn)
 }
 
 // FILE
-func (self TcpServer) import_file(req TcpMessage, conn net.Conn) {
+func (self *TcpServer) import_file(req TcpMessage, conn net.Conn) {
 	// {"method":"import_file","file":"springfield_projects_edit.geojson"}
 	result, err := importDatasource(req.File)
 	if err != nil {
 		self.handleError(err, conn)
 		return
 	}
-	self.handleSuccess(`{"datasource": "`+result+`"}`, conn)
+	self.mashalJsonFromStructResponse(tcpImportResponse{Datasource: result}, conn)
 }
 
 func importDatasource(importFile string) (string, error) {
@@ -446,7 +795,11 @@ func importDatasource(importFile string) (string, error) {
 	}
 	// Create datasource
 	ds, _ := utils.NewUUID()
-	GeoDB.InsertLayer(ds, geojs)
+	err = DB.InsertLayer(ds, geojs)
+	if err != nil {
+		return "", err
+	}
+	publishLayerEvent(EVENT_LAYER_CREATED, ds)
 	// Cleanup artifacts
 	if geojsonFile != importFile {
 		os.Remove(geojsonFile)
@@ -0,0 +1,111 @@
+package geo_skeleton_server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	TCP_UNIX_CONN_TYPE      = "unix"
+	TCP_DEFAULT_SOCKET_MODE = os.FileMode(0600)
+)
+
+// GetSocketMode parses the octal socket_mode, e.g. "0660". Defaults to
+// owner only access.
+// @returns os.FileMode
+// @returns Error
+func (self TcpConfig) GetSocketMode() (os.FileMode, error) {
+	if "" == self.SocketMode {
+		return TCP_DEFAULT_SOCKET_MODE, nil
+	}
+	mode, err := strconv.ParseUint(self.SocketMode, 8, 32)
+	if nil != err || 0777 < mode {
+		return 0, fmt.Errorf("Invalid socket_mode: %v", self.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+func (self *TcpServer) getSocketMode() os.FileMode {
+	if 0 == self.SocketMode {
+		return TCP_DEFAULT_SOCKET_MODE
+	}
+	return self.SocketMode
+}
+
+// removeStaleSocket removes a socket file left by a server that didn't shut
+// down cleanly. Other files are never removed.
+func removeStaleSocket(socket_file string) error {
+	info, err := os.Lstat(socket_file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if nil != err {
+		return err
+	}
+	if 0 == info.Mode()&os.ModeSocket {
+		return fmt.Errorf("%v exists and is not a socket", socket_file)
+	}
+	// a socket still accepting connections belongs to a running server
+	conn, err := net.Dial(TCP_UNIX_CONN_TYPE, socket_file)
+	if nil == err {
+		conn.Close()
+		return fmt.Errorf("%v is in use", socket_file)
+	}
+	return os.Remove(socket_file)
+}
+
+// unixListener removes the socket file when it is closed. The socket is
+// bound under another name, the listener can't unlink it itself.
+type unixListener struct {
+	net.Listener
+	socket_file string
+}
+
+func (self unixListener) Close() error {
+	err := self.Listener.Close()
+	os.Remove(self.socket_file)
+	return err
+}
+
+// listenUnix opens the unix socket listener. Access is controlled by the
+// socket file permissions, connections are authenticated without the
+// network check. The socket is created in a private directory and moved
+// into place once its permissions are set, so it is never reachable with
+// the umask permissions.
+func (self *TcpServer) listenUnix() (net.Listener, error) {
+	err := removeStaleSocket(self.SocketFile)
+	if nil != err {
+		return nil, err
+	}
+	// TempDir creates the directory with 0700
+	dir, err := ioutil.TempDir(filepath.Dir(self.SocketFile), ".gskel")
+	if nil != err {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	bound_file := filepath.Join(dir, filepath.Base(self.SocketFile))
+	l, err := net.Listen(TCP_UNIX_CONN_TYPE, bound_file)
+	if nil != err {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	err = os.Chmod(bound_file, self.getSocketMode())
+	if nil == err {
+		err = os.Rename(bound_file, self.SocketFile)
+	}
+	if nil != err {
+		l.Close()
+		return nil, err
+	}
+	return unixListener{Listener: l, socket_file: self.SocketFile}, nil
+}
+
+// isUnixConn checks if the connection was made through the unix socket
+func isUnixConn(conn net.Conn) bool {
+	_, ok := conn.(*net.UnixConn)
+	return ok
+}
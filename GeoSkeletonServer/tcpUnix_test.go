@@ -0,0 +1,94 @@
+package geo_skeleton_server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Unittest TcpConfig.GetSocketMode
+func TestGetSocketMode(t *testing.T) {
+	modes := map[string]os.FileMode{"": 0600, "0660": 0660, "666": 0666}
+	for value, expected := range modes {
+		mode, err := TcpConfig{SocketMode: value}.GetSocketMode()
+		if nil != err || expected != mode {
+			t.Errorf("Socket mode %v should be %v: %v %v", value, expected, mode, err)
+		}
+	}
+	for _, value := range []string{"rw", "0999", "01777"} {
+		_, err := TcpConfig{SocketMode: value}.GetSocketMode()
+		if nil == err {
+			t.Errorf("Invalid socket mode should fail: %v", value)
+		}
+	}
+}
+
+// Unittest removeStaleSocket
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gskel")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket_file := filepath.Join(dir, "gskel.sock")
+	if nil != removeStaleSocket(socket_file) {
+		t.Error("Missing socket should be ignored")
+	}
+
+	l, err := net.Listen(TCP_UNIX_CONN_TYPE, socket_file)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if nil == removeStaleSocket(socket_file) {
+		t.Error("Socket in use should not be removed")
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if nil != removeStaleSocket(socket_file) {
+		t.Error("Stale socket should be removed")
+	}
+
+	other_file := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(other_file, []byte("{}"), 0600)
+	if nil == removeStaleSocket(other_file) {
+		t.Error("Files other than sockets should not be removed")
+	}
+}
+
+// Unittest TcpServer.listenUnix
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gskel")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket_file := filepath.Join(dir, "gskel.sock")
+	server := TcpServer{SocketFile: socket_file, SocketMode: 0640}
+	l, err := server.listenUnix()
+	if nil != err {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(socket_file)
+	if nil != err || 0640 != info.Mode().Perm() {
+		t.Errorf("Socket should be created with mode 0640: %v %v", info, err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if 1 != len(files) {
+		t.Errorf("Private directory should be removed: %v", files)
+	}
+
+	conn, err := net.Dial(TCP_UNIX_CONN_TYPE, socket_file)
+	if nil != err {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	l.Close()
+	if _, err := os.Lstat(socket_file); !os.IsNotExist(err) {
+		t.Errorf("Socket should be removed on close: %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package geo_skeleton_server
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulmach/go.geojson"
+)
+
+// layerLocks serializes conditional writes to a layer so a version
+// check and the following write can't interleave with another editor.
+var layerLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+// lockLayer locks a layer for writing and returns the matching unlock function
+func lockLayer(datasource_id string) func() {
+	layerLocks.Lock()
+	lock, ok := layerLocks.locks[datasource_id]
+	if !ok {
+		lock = &sync.Mutex{}
+		layerLocks.locks[datasource_id] = lock
+	}
+	layerLocks.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// versionMismatchError is returned when an expected version doesn't match the stored one
+type versionMismatchError struct {
+	Current string
+}
+
+func (self versionMismatchError) Error() string {
+	return fmt.Sprintf("Precondition failed, current version is %v", self.Current)
+}
+
+// hashVersion returns the hex encoded sha1 of a json document
+func hashVersion(js []byte) string {
+	return fmt.Sprintf("%x", sha1.Sum(js))
+}
+
+// GetFeatureVersion returns the version of a feature derived from its contents
+// @param feat {Feature}
+// @returns string
+// @returns Error
+func GetFeatureVersion(feat *geojson.Feature) (string, error) {
+	js, err := feat.MarshalJSON()
+	if nil != err {
+		return "", err
+	}
+	return hashVersion(js), nil
+}
+
+// GetLayerVersion returns the version of a layer derived from its contents
+// @param lyr {FeatureCollection}
+// @returns string
+// @returns Error
+func GetLayerVersion(lyr *geojson.FeatureCollection) (string, error) {
+	js, err := lyr.MarshalJSON()
+	if nil != err {
+		return "", err
+	}
+	return hashVersion(js), nil
+}
+
+// GetStoredFeatureVersion looks up a feature and returns its current version
+// @param datasource_id {string}
+// @param geo_id {string}
+// @returns string
+// @returns Error
+func GetStoredFeatureVersion(datasource_id string, geo_id string) (string, error) {
+	feat, err := GetStoredFeature(datasource_id, geo_id)
+	if nil != err {
+		return "", err
+	}
+	return GetFeatureVersion(feat)
+}
+
+// GetStoredFeature looks up the current version of a feature
+// @param datasource_id {string}
+// @param geo_id {string}
+// @returns *geojson.Feature
+// @returns Error
+func GetStoredFeature(datasource_id string, geo_id string) (*geojson.Feature, error) {
+	lyr, err := GeoDB.GetLayer(datasource_id)
+	if nil != err {
+		return nil, err
+	}
+	return findFeature(lyr, geo_id)
+}
+
+// GetStoredLayerVersion looks up a layer and returns its current version
+// @param datasource_id {string}
+// @returns string
+// @returns Error
+func GetStoredLayerVersion(datasource_id string) (string, error) {
+	lyr, err := GeoDB.GetLayer(datasource_id)
+	if nil != err {
+		return "", err
+	}
+	return GetLayerVersion(lyr)
+}
+
+// CheckVersion returns a versionMismatchError if expected is set
+// and doesn't match the current version.
+// @param expected {string}
+// @param current {string}
+// @returns Error
+func CheckVersion(expected string, current string) error {
+	if "" == expected || versionFromEtag(expected) == current {
+		return nil
+	}
+	return versionMismatchError{Current: current}
+}
+
+// contentEncodings compressions of http responses in order of preference
+var contentEncodings = []string{"gzip", "deflate"}
+
+// encodedVersion returns the ETag of a version sent with a content encoding
+func encodedVersion(version string, encoding string) string {
+	return version + "-" + encoding
+}
+
+// versionFromEtag returns the version an ETag was made from
+func versionFromEtag(tag string) string {
+	tag = strings.Trim(strings.TrimPrefix(strings.TrimSpace(tag), "W/"), `"`)
+	for _, encoding := range contentEncodings {
+		if strings.HasSuffix(tag, "-"+encoding) {
+			return strings.TrimSuffix(tag, "-"+encoding)
+		}
+	}
+	return tag
+}
+
+// etagMatches checks an If-Match or If-None-Match header against a version.
+// ETags of compressed responses match the version they were made from.
+func etagMatches(header string, version string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		if "*" == strings.TrimSpace(tag) {
+			return true
+		}
+		if versionFromEtag(tag) == version {
+			return true
+		}
+	}
+	return false
+}
+
+// GetLayerLastModified returns the time of the newest layer snapshot
+// @param datasource_id {string}
+// @returns time.Time
+// @returns Error
+func GetLayerLastModified(datasource_id string) (time.Time, error) {
+	lyr_ts, err := GeoDB.SelectTimeseriesDatasource(datasource_id)
+	if nil != err {
+		return time.Time{}, err
+	}
+	var newest int64
+	for _, ts := range lyr_ts.GetSnapshots() {
+		if ts > newest {
+			newest = ts
+		}
+	}
+	if 0 == newest {
+		return time.Time{}, fmt.Errorf("No snapshots found")
+	}
+	return time.Unix(0, newest), nil
+}
+
+// GetFeatureLastModified returns the date_modified property of a feature
+// @param feat {Feature}
+// @returns time.Time
+// @returns bool
+func GetFeatureLastModified(feat *geojson.Feature) (time.Time, bool) {
+	switch modified := feat.Properties["date_modified"].(type) {
+	case float64:
+		return time.Unix(int64(modified), 0), true
+	case int64:
+		return time.Unix(modified, 0), true
+	case int:
+		return time.Unix(int64(modified), 0), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,83 @@
+package geo_skeleton_server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Unittest etagMatches
+func TestEtagMatches(t *testing.T) {
+	version := "3f786850e387550fdab836ed7e6dc881de23001b"
+	tests := []struct {
+		header  string
+		matches bool
+	}{
+		{`"3f786850e387550fdab836ed7e6dc881de23001b"`, true},
+		{`3f786850e387550fdab836ed7e6dc881de23001b`, true},
+		{`W/"3f786850e387550fdab836ed7e6dc881de23001b"`, true},
+		{`"3f786850e387550fdab836ed7e6dc881de23001b-gzip"`, true},
+		{`"3f786850e387550fdab836ed7e6dc881de23001b-deflate"`, true},
+		{`"da39a3ee5e6b4b0d3255bfef95601890afd80709", "3f786850e387550fdab836ed7e6dc881de23001b"`, true},
+		{`*`, true},
+		{`"da39a3ee5e6b4b0d3255bfef95601890afd80709"`, false},
+		{`"da39a3ee5e6b4b0d3255bfef95601890afd80709-gzip"`, false},
+		{`"3f786850e387550fdab836ed7e6dc881de23001b-br"`, false},
+		{`""`, false},
+	}
+	for _, test := range tests {
+		if test.matches != etagMatches(test.header, version) {
+			t.Errorf("etagMatches(%v) should be %v", test.header, test.matches)
+		}
+	}
+}
+
+// Unittest CheckVersion
+func TestCheckVersion(t *testing.T) {
+	version := "3f786850e387550fdab836ed7e6dc881de23001b"
+	for _, expected := range []string{"", version, `"` + version + `"`, version + "-gzip"} {
+		if err := CheckVersion(expected, version); nil != err {
+			t.Errorf("Version %v should match: %v", expected, err)
+		}
+	}
+	err := CheckVersion("da39a3ee5e6b4b0d3255bfef95601890afd80709", version)
+	if e, ok := err.(versionMismatchError); !ok || version != e.Current {
+		t.Errorf("Mismatch should return the current version: %v", err)
+	}
+}
+
+// Unittest HttpRequest.CheckIfMatch
+func TestCheckIfMatch(t *testing.T) {
+	version := "3f786850e387550fdab836ed7e6dc881de23001b"
+	tests := []struct {
+		header string
+		code   int
+	}{
+		{``, http.StatusOK},
+		{`"3f786850e387550fdab836ed7e6dc881de23001b"`, http.StatusOK},
+		{`"3f786850e387550fdab836ed7e6dc881de23001b-gzip"`, http.StatusOK},
+		{`*`, http.StatusOK},
+		{`"da39a3ee5e6b4b0d3255bfef95601890afd80709"`, http.StatusPreconditionFailed},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("PUT", "/api/v1/layer/20f3332781ea4d7b8d509d12517ac5fa/feature/1", nil)
+		if "" != test.header {
+			r.Header.Set("If-Match", test.header)
+		}
+		job := HttpRequest{w: recorder, r: r}
+		err := job.CheckIfMatch(version)
+		if http.StatusOK == test.code {
+			if nil != err || job.wroteHeaders {
+				t.Errorf("If-Match %v should pass: %v", test.header, err)
+			}
+			continue
+		}
+		if _, ok := err.(versionMismatchError); !ok || test.code != recorder.Code {
+			t.Errorf("If-Match %v should fail with %v: %v %v", test.header, test.code, recorder.Code, err)
+		}
+		if `"`+version+`"` != recorder.Header().Get("ETag") {
+			t.Errorf("Failed precondition should return the current version: %v", recorder.Header().Get("ETag"))
+		}
+	}
+}
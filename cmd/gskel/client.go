@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// rpcRequest JSON-RPC 2.0 request
+type rpcRequest struct {
+	JsonRpc string      `json:"jsonrpc"`
+	Id      int         `json:"id"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+// rpcError JSON-RPC 2.0 error object
+type rpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (self rpcError) Error() string {
+	return self.Message
+}
+
+// rpcResponse JSON-RPC 2.0 response or notification
+type rpcResponse struct {
+	Id     *int            `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// rpcStreamRecord record streamed ahead of the response to a request
+type rpcStreamRecord struct {
+	Request int             `json:"request"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// tlsOptions client certificate and certificate authority files
+type tlsOptions struct {
+	Enabled  bool
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// tcpClient sends requests to the tcp server one at a time
+type tcpClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	id     int
+}
+
+// getTlsConfig builds the client tls config
+func (self tlsOptions) getTlsConfig(host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host}
+	if "" != self.CAFile {
+		pem, err := ioutil.ReadFile(self.CAFile)
+		if nil != err {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %v", self.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if "" != self.CertFile {
+		cert, err := tls.LoadX509KeyPair(self.CertFile, self.KeyFile)
+		if nil != err {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// dial connects to the tcp server, or its unix socket when one is given, and
+// sends the auth handshake when an authkey is given
+func dial(host string, port int, socket string, authkey string, options tlsOptions) (*tcpClient, error) {
+	address := net.JoinHostPort(host, fmt.Sprintf("%v", port))
+	var conn net.Conn
+	var err error
+	if "" != socket {
+		conn, err = net.DialTimeout("unix", socket, 10*time.Second)
+	} else if options.Enabled {
+		var config *tls.Config
+		config, err = options.getTlsConfig(host)
+		if nil != err {
+			return nil, err
+		}
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", address, config)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, 10*time.Second)
+	}
+	if nil != err {
+		return nil, err
+	}
+	client := &tcpClient{conn: conn, reader: bufio.NewReader(conn)}
+	if "" != authkey {
+		_, err = client.call("auth", map[string]string{"authkey": authkey})
+		if nil != err {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// Close closes the connection
+func (self *tcpClient) Close() error {
+	return self.conn.Close()
+}
+
+// readLine reads one response line
+func (self *tcpClient) readLine() ([]byte, error) {
+	return self.reader.ReadBytes('\n')
+}
+
+// call sends a JSON-RPC request and returns its result
+func (self *tcpClient) call(method string, params interface{}) (json.RawMessage, error) {
+	return self.callStream(method, params, nil)
+}
+
+// callStream sends a JSON-RPC request and returns its result. Records
+// streamed ahead of the result are passed to stream when it is set.
+func (self *tcpClient) callStream(method string, params interface{}, stream func(json.RawMessage)) (json.RawMessage, error) {
+	self.id++
+	js, err := json.Marshal(rpcRequest{JsonRpc: "2.0", Id: self.id, Method: method, Params: params})
+	if nil != err {
+		return nil, err
+	}
+	_, err = self.conn.Write(append(js, '\n'))
+	if nil != err {
+		return nil, err
+	}
+	for {
+		line, err := self.readLine()
+		if nil != err {
+			return nil, err
+		}
+		resp := rpcResponse{}
+		err = json.Unmarshal(line, &resp)
+		if nil != err {
+			return nil, fmt.Errorf("Invalid response: %v", err)
+		}
+		if "stream" == resp.Method && nil != stream {
+			record := rpcStreamRecord{}
+			if nil == json.Unmarshal(resp.Params, &record) && self.id == record.Request {
+				stream(record.Data)
+			}
+			continue
+		}
+		// skip lines that don't answer this request, e.g. events
+		if nil == resp.Id || self.id != *resp.Id {
+			continue
+		}
+		if nil != resp.Error {
+			return nil, *resp.Error
+		}
+		return resp.Result, nil
+	}
+}
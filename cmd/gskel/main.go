@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_CONFIG_FILE string = "config.json"
+	DEFAULT_HOST        string = "localhost"
+	DEFAULT_TCP_PORT    int    = 3333
+)
+
+// exit codes
+const (
+	EXIT_ERROR = 1
+	EXIT_USAGE = 2
+)
+
+// serverConfig fields read from the server config file
+type serverConfig struct {
+	TcpPort int    `json:"tcp_port"`
+	Authkey string `json:"authkey"`
+	Tcp     struct {
+		ConnType string `json:"conn_type"`
+		Socket   string `json:"socket"`
+	} `json:"tcp"`
+}
+
+// command admin command. Setup registers the command flags and returns
+// the function run once the flags are parsed.
+type command struct {
+	Description string
+	Setup       func(flags *flag.FlagSet) func(client *tcpClient) (interface{}, error)
+}
+
+var commands = map[string]command{
+	"create-apikey": {
+		Description: "create a customer and their default apikey",
+		Setup: func(flags *flag.FlagSet) func(*tcpClient) (interface{}, error) {
+			return func(client *tcpClient) (interface{}, error) {
+				return client.call("create_apikey", nil)
+			}
+		},
+	},
+	"assign": {
+		Description: "give a customer a role on a datasource",
+		Setup: func(flags *flag.FlagSet) func(*tcpClient) (interface{}, error) {
+			customer := flags.String("customer", "", "customer id or apikey (required)")
+			datasource := flags.String("datasource", "", "datasource id (required)")
+			role := flags.String("role", "owner", "owner, editor or viewer")
+			return func(client *tcpClient) (interface{}, error) {
+				if "" == *customer || "" == *datasource {
+					return nil, usageError("-customer and -datasource are required")
+				}
+				return client.call("assign_datasource", map[string]string{
+					"apikey":     *customer,
+					"datasource": *datasource,
+					"role":       *role,
+				})
+			}
+		},
+	},
+	"import": {
+		Description: "import a geojson or ogr2ogr readable file on the server into a new layer",
+		Setup: func(flags *flag.FlagSet) func(*tcpClient) (interface{}, error) {
+			file := flags.String("file", "", "file path on the server (required)")
+			return func(client *tcpClient) (interface{}, error) {
+				if "" == *file {
+					return nil, usageError("-file is required")
+				}
+				return client.call("import_file", map[string]string{"file": *file})
+			}
+		},
+	},
+	"export": {
+		Description: "export a layer, a layer snapshot, the datasource ids or the customers",
+		Setup: func(flags *flag.FlagSet) func(*tcpClient) (interface{}, error) {
+			datasource := flags.String("datasource", "", "datasource id of the layer to export")
+			snapshot := flags.Int64("snapshot", 0, "snapshot timestamp of the layer in nanoseconds")
+			datasources := flags.Bool("datasources", false, "export the datasource ids")
+			apikeys := flags.Bool("apikeys", false, "export the customers")
+			output := flags.String("o", "", "write the export to a file")
+			return func(client *tcpClient) (interface{}, error) {
+				var result json.RawMessage
+				var err error
+				switch {
+				case "" != *datasource && 0 != *snapshot:
+					result, err = client.call("export_datasource_by_snapshot", map[string]interface{}{"datasource": *datasource, "timestamp": *snapshot})
+				case "" != *datasource:
+					result, err = client.call("export_datasource", map[string]string{"datasource": *datasource})
+				case *datasources:
+					result, err = client.call("export_datasources", nil)
+				case *apikeys:
+					result, err = client.call("export_apikeys", nil)
+				default:
+					return nil, usageError("one of -datasource, -datasources or -apikeys is required")
+				}
+				if nil != err || "" == *output {
+					return result, err
+				}
+				err = ioutil.WriteFile(*output, prettyJson(result), 0644)
+				if nil != err {
+					return nil, err
+				}
+				return map[string]string{"file": *output}, nil
+			}
+		},
+	},
+	"delete-layer": {
+		Description: "delete a layer",
+		Setup: func(flags *flag.FlagSet) func(*tcpClient) (interface{}, error) {
+			datasource := flags.String("datasource", "", "datasource id (required)")
+			return func(client *tcpClient) (interface{}, error) {
+				if "" == *datasource {
+					return nil, usageError("-datasource is required")
+				}
+				return client.call("delete_layer", map[string]string{"datasource": *datasource})
+			}
+		},
+	},
+	"restore": {
+		Description: "replay a commit log on the server into its empty database",
+		Setup: func(flags *flag.FlagSet) func(*tcpClient) (interface{}, error) {
+			file := flags.String("file", "", "commit log file, read by the server (required)")
+			until := flags.String("until", "", "skip lines committed after this RFC3339 time or unix nanoseconds")
+			progress := flags.Int("progress", 1000, "report progress every n lines, 0 disables progress")
+			stop := flags.Bool("stop_on_error", false, "stop at the first line the server rejects")
+			return func(client *tcpClient) (interface{}, error) {
+				if "" == *file {
+					return nil, usageError("-file is required")
+				}
+				stop_at, err := parseStopAt(*until)
+				if nil != err {
+					return nil, usageError(err.Error())
+				}
+				return restore(client, *file, stop_at, *progress, *stop)
+			}
+		},
+	},
+	"status": {
+		Description: "show the server version and response time",
+		Setup: func(flags *flag.FlagSet) func(*tcpClient) (interface{}, error) {
+			return func(client *tcpClient) (interface{}, error) {
+				start := time.Now()
+				result, err := client.call("ping", nil)
+				if nil != err {
+					return nil, err
+				}
+				latency := time.Since(start)
+				pong := struct {
+					Version string `json:"version"`
+				}{}
+				json.Unmarshal(result, &pong)
+				methods := []string{}
+				result, err = client.call("help", nil)
+				if nil != err {
+					return nil, err
+				}
+				json.Unmarshal(result, &methods)
+				return map[string]interface{}{
+					"address":    client.conn.RemoteAddr().String(),
+					"version":    pong.Version,
+					"latency_ms": float64(latency.Nanoseconds()) / float64(time.Millisecond),
+					"methods":    len(methods),
+				}, nil
+			}
+		},
+	},
+}
+
+// usageError is returned for missing or invalid command flags
+type usageError string
+
+func (self usageError) Error() string {
+	return string(self)
+}
+
+// restoreProgress progress of a commit log replay
+type restoreProgress struct {
+	Lines      int   `json:"lines"`
+	Applied    int   `json:"applied"`
+	Failed     int   `json:"failed"`
+	Bytes      int64 `json:"bytes"`
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+// parseStopAt reads a RFC3339 time or unix nanoseconds
+func parseStopAt(value string) (int64, error) {
+	if "" == value {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseInt(value, 10, 64); nil == err {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if nil != err {
+		return 0, fmt.Errorf("Invalid -until: %v", value)
+	}
+	return t.UnixNano(), nil
+}
+
+// restore replays a commit log on the server with restore_commit_log.
+// Progress lines are written to stderr as the server streams them.
+func restore(client *tcpClient, file string, stop_at int64, progress int, stop bool) (interface{}, error) {
+	params := map[string]interface{}{"file": file, "stop_at": stop_at, "stop_on_error": stop}
+	if 0 < progress {
+		params["stream"] = true
+		params["progress"] = progress
+	}
+	return client.callStream("restore_commit_log", params, func(record json.RawMessage) {
+		status := struct {
+			Progress restoreProgress `json:"progress"`
+		}{}
+		json.Unmarshal(record, &status)
+		fmt.Fprintf(os.Stderr, "%v lines (%v of %v bytes), %v applied, %v failed\n", status.Progress.Lines, status.Progress.Bytes, status.Progress.TotalBytes, status.Progress.Applied, status.Progress.Failed)
+	})
+}
+
+// prettyJson indents json, other values are marshalled first
+func prettyJson(v interface{}) []byte {
+	js, ok := v.(json.RawMessage)
+	if !ok {
+		js, _ = json.Marshal(v)
+	}
+	var out bytes.Buffer
+	if nil != json.Indent(&out, js, "", "  ") {
+		return js
+	}
+	out.WriteByte('\n')
+	return out.Bytes()
+}
+
+// readConfig reads the tcp port, unix socket and authkey from the server config file
+func readConfig(file string) serverConfig {
+	config := serverConfig{}
+	js, err := ioutil.ReadFile(file)
+	if nil == err {
+		json.Unmarshal(js, &config)
+	}
+	return config
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: gskel [options] <command> [command options]\n\nCommands:\n")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-14v %v\n", name, commands[name].Description)
+	}
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	var (
+		host       string
+		port       int
+		authkey    string
+		socket     string
+		configFile string
+		options    tlsOptions
+	)
+	flag.StringVar(&host, "host", DEFAULT_HOST, "tcp server host")
+	flag.IntVar(&port, "port", 0, "tcp server port, defaults to the config file tcp_port or 3333")
+	flag.StringVar(&socket, "socket", "", "unix socket path, used instead of host and port")
+	flag.StringVar(&authkey, "authkey", os.Getenv("GSKEL_AUTHKEY"), "superuser key, defaults to $GSKEL_AUTHKEY or the config file authkey")
+	flag.StringVar(&configFile, "c", DEFAULT_CONFIG_FILE, "server config file")
+	flag.BoolVar(&options.Enabled, "tls", false, "connect with tls")
+	flag.StringVar(&options.CAFile, "ca", "", "certificate authority of the server certificate")
+	flag.StringVar(&options.CertFile, "cert", "", "client certificate")
+	flag.StringVar(&options.KeyFile, "key", "", "client certificate key")
+	flag.Usage = usage
+	flag.Parse()
+
+	if 0 == flag.NArg() {
+		usage()
+		os.Exit(EXIT_USAGE)
+	}
+	name := flag.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %v\n\n", name)
+		usage()
+		os.Exit(EXIT_USAGE)
+	}
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	run := cmd.Setup(flags)
+	flags.Parse(flag.Args()[1:])
+
+	config := readConfig(configFile)
+	if 0 == port {
+		port = DEFAULT_TCP_PORT
+		if 0 != config.TcpPort {
+			port = config.TcpPort
+		}
+	}
+	if "" == authkey {
+		authkey = config.Authkey
+	}
+	// servers without a tcp port are only reachable through their socket
+	if "" == socket && "unix" == config.Tcp.ConnType {
+		socket = config.Tcp.Socket
+	}
+
+	client, err := dial(host, port, socket, authkey, options)
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(EXIT_ERROR)
+	}
+	defer client.Close()
+
+	result, err := run(client)
+	if js, ok := result.(json.RawMessage); nil != result && (!ok || 0 != len(js)) {
+		os.Stdout.Write(prettyJson(result))
+	}
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if rpcErr, ok := err.(rpcError); ok && 0 != len(rpcErr.Data) {
+			os.Stderr.Write(prettyJson(rpcErr.Data))
+		}
+		client.Close()
+		if _, ok := err.(usageError); ok {
+			flags.Usage()
+			os.Exit(EXIT_USAGE)
+		}
+		os.Exit(EXIT_ERROR)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Unittest parseStopAt
+func TestParseStopAt(t *testing.T) {
+	tests := map[string]int64{
+		"":                          0,
+		"1494877512000000000":       1494877512000000000,
+		"2017-05-15T19:45:12Z":      time.Date(2017, 5, 15, 19, 45, 12, 0, time.UTC).UnixNano(),
+		"2017-05-15T21:45:12+02:00": time.Date(2017, 5, 15, 19, 45, 12, 0, time.UTC).UnixNano(),
+	}
+	for value, expected := range tests {
+		stop_at, err := parseStopAt(value)
+		if nil != err || expected != stop_at {
+			t.Errorf("parseStopAt(%q) should be %v, got %v %v", value, expected, stop_at, err)
+		}
+	}
+	for _, value := range []string{"yesterday", "2017-05-15", "15/05/2017 19:45"} {
+		if _, err := parseStopAt(value); nil == err {
+			t.Errorf("parseStopAt(%q) should fail", value)
+		}
+	}
+}
+
+// Unittest commands return a usageError for missing or invalid flags
+func TestCommandUsageErrors(t *testing.T) {
+	tests := map[string][]string{
+		"assign":       {"-customer", "12dB6BlenIeB"},
+		"import":       {},
+		"export":       {},
+		"delete-layer": {},
+		"restore":      {"-file", "api_commit.log", "-until", "yesterday"},
+	}
+	for name, args := range tests {
+		flags := flag.NewFlagSet(name, flag.ContinueOnError)
+		run := commands[name].Setup(flags)
+		err := flags.Parse(args)
+		if nil != err {
+			t.Fatal(err)
+		}
+		// flags are checked before the client is used
+		_, err = run(nil)
+		if _, ok := err.(usageError); !ok {
+			t.Errorf("%v %v should return a usage error, got %v", name, args, err)
+		}
+	}
+}
+
+// Unittest usage errors exit with EXIT_USAGE
+func TestUsageExitCode(t *testing.T) {
+	if "1" == os.Getenv("GSKEL_TEST_MAIN") {
+		os.Args = append([]string{"gskel"}, strings.Fields(os.Getenv("GSKEL_TEST_ARGS"))...)
+		main()
+		return
+	}
+
+	// commands check their flags once connected
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	connect := fmt.Sprintf("-host 127.0.0.1 -port %v -c missing.json ", port)
+
+	tests := map[string]int{
+		"":                               EXIT_USAGE,
+		"unknown-command":                EXIT_USAGE,
+		connect + "delete-layer":         EXIT_USAGE,
+		connect + "restore -until now":   EXIT_USAGE,
+		connect + "restore -unknown 1":   EXIT_USAGE,
+		"-host 127.0.0.1 -port 1 status": EXIT_ERROR,
+	}
+	for args, expected := range tests {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestUsageExitCode$")
+		cmd.Env = append(os.Environ(), "GSKEL_TEST_MAIN=1", "GSKEL_TEST_ARGS="+args, "GSKEL_AUTHKEY=")
+		err := cmd.Run()
+		code := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code = exitErr.ExitCode()
+		}
+		if expected != code {
+			t.Errorf("gskel %v should exit with %v, got %v", args, expected, code)
+		}
+	}
+}
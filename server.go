@@ -12,6 +12,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"time"
 )
 
@@ -23,6 +24,9 @@ import (
 var (
 	port          int
 	tcp_port      int
+	socket_file   string
+	restoreFile   string
+	restoreUntil  string
 	database      string
 	bind          string
 	versionReport bool
@@ -38,10 +42,13 @@ const (
 )
 
 type serverConfig struct {
-	HttpPort int    `json:"http_port"`
-	TcpPort  int    `json:"tcp_port"`
-	Db       string `json:"db"`
-	Authkey  string `json:"authkey"`
+	HttpPort           int                               `json:"http_port"`
+	TcpPort            int                               `json:"tcp_port"`
+	Db                 string                            `json:"db"`
+	Authkey            string                            `json:"authkey"`
+	RejectQueryApikeys bool                              `json:"reject_query_apikeys"`
+	Limits             *geo_skeleton_server.LimitsConfig `json:"limits,omitempty"`
+	Tcp                *geo_skeleton_server.TcpConfig    `json:"tcp,omitempty"`
 }
 
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
@@ -51,6 +58,9 @@ func init() {
 	flag.StringVar(&configFile, "c", DEFAULT_CONFIG_FILE, "server config file")
 	flag.IntVar(&port, "p", DEFAULT_HTTP_PORT, "http server port")
 	flag.IntVar(&tcp_port, "tcp_port", DEFAULT_TCP_PORT, "tcp server port")
+	flag.StringVar(&socket_file, "socket", "", "unix socket path for local administration")
+	flag.StringVar(&restoreFile, "restore", "", "restore a fresh database from a commit log and exit")
+	flag.StringVar(&restoreUntil, "restore_until", "", "skip commit log lines after this time (RFC3339 or unix nanoseconds)")
 	flag.StringVar(&database, "db", db, "app database")
 	flag.StringVar(&geo_skeleton_server.SuperuserKey, "s", "su", "superuser key")
 	flag.BoolVar(&versionReport, "V", false, "App Version")
@@ -116,6 +126,8 @@ func init() {
 			configuration.TcpPort = tcp_port
 		}
 
+		geo_skeleton_server.RejectQueryApikeys = configuration.RejectQueryApikeys
+
 		//configuration.Db = strings.Replace(database, ".db", "", -1) //database
 		//geo_skeleton_server.ServerLogger.Info(strings.Replace(database, ".db", "", -1))
 	}
@@ -186,6 +198,12 @@ func main() {
 		}()
 	}
 
+	// Restore database from commit log
+	if "" != restoreFile {
+		restore()
+		return
+	}
+
 	// Initiate Database
 	//geo_skeleton_server.COMMIT_LOG_FILE = database + "_commit.log"
 	geo_skeleton_server.DB = geo_skeleton_server.Database{File: database + ".db"}
@@ -194,11 +212,34 @@ func main() {
 		panic(err)
 	}
 
+	// rate limits and storage quotas
+	if nil != configuration.Limits {
+		geo_skeleton_server.Limits = *configuration.Limits
+	}
+
 	// geo_skeleton_server.ServerLogger.Info(configuration)
 
 	// start tcp server
 	//tcpServer := geo_skeleton_server.TcpServer{Host: "localhost", Port: "3333"}
 	tcpServer := geo_skeleton_server.TcpServer{Host: "localhost", Port: fmt.Sprintf("%v", configuration.TcpPort)}
+	if nil != configuration.Tcp {
+		if "" != configuration.Tcp.Host {
+			tcpServer.Host = configuration.Tcp.Host
+		}
+		tcpServer.AllowedNetworks = configuration.Tcp.AllowedNetworks
+		tcpServer.RequireAuth = configuration.Tcp.RequireAuth
+		tcpServer.TLS = configuration.Tcp.TLS
+		tcpServer.MaxConcurrentRequests = configuration.Tcp.MaxConcurrent
+		tcpServer.ConnType = configuration.Tcp.ConnType
+		tcpServer.SocketFile = configuration.Tcp.Socket
+		tcpServer.SocketMode, err = configuration.Tcp.GetSocketMode()
+		if err != nil {
+			panic(err)
+		}
+	}
+	if "" != socket_file {
+		tcpServer.SocketFile = socket_file
+	}
 	tcpServer.Start()
 
 	// start http server
@@ -206,3 +247,38 @@ func main() {
 	httpServer.Start()
 
 }
+
+// parseRestoreUntil reads a RFC3339 time or unix nanoseconds
+func parseRestoreUntil(value string) (int64, error) {
+	if "" == value {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseInt(value, 10, 64); nil == err {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid restore_until: %v", value)
+	}
+	return t.UnixNano(), nil
+}
+
+// restore replays the commit log into a fresh database, prints the report
+// and exits with status 1 when the restore wasn't verified
+func restore() {
+	stop_at, err := parseRestoreUntil(restoreUntil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	options := geo_skeleton_server.RestoreOptions{StopAt: stop_at}
+	report, err := geo_skeleton_server.RestoreDatabase(restoreFile, options)
+	js, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(js))
+	if err != nil {
+		geo_skeleton_server.ServerLogger.Error(err)
+		geo_skeleton_server.ServerLogger.Flush()
+		os.Exit(1)
+	}
+	geo_skeleton_server.ServerLogger.Info("Restored ", report.Applied, " commit log lines from ", restoreFile)
+	geo_skeleton_server.ServerLogger.Flush()
+}
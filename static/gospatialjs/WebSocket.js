@@ -3,14 +3,16 @@
 	getWebSocket: function() {
 		var self = this;
 		console.log("Opening websocket");
+		// browsers can't set headers on websockets, the apikey is sent as a subprotocol
+		var protocols = ["gospatial", "apikey." + self.apiClient.apikey];
 		try { 
 			var url = "ws://" + window.location.host + "/ws/" + self.datasources[0];
-			ws = new WebSocket(url);
+			ws = new WebSocket(url, protocols);
 		}
 		catch(err) {
 			console.log(err);
 			var url = "wss://" + window.location.host + "/ws/" + self.datasources[0];
-			ws = new WebSocket(url);
+			ws = new WebSocket(url, protocols);
 		}
 		ws.onopen = function(e) { 
 			console.log("Websocket is open");
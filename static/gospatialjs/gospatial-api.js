@@ -29,14 +29,14 @@ var API = new GoSpatialApiHandler({server:"test",apikey:"1234", id:"1"});
 
 		this.getCustomer = function(callback) {
 			var self = this;
-			this.GET(this.server + "/api/v1/customer" + "?apikey=" + self.apikey, function(error, result){
+			this.GET(this.server + "/api/v1/customer", function(error, result){
 				return callback(error, result);
 			});
 		}
 
 		this.getLayer = function(datasource, callback) {
 			var self = this;
-			this.GET(this.server + "/api/v1/layer/" + datasource + "?apikey=" + self.apikey, function(error, result){
+			this.GET(this.server + "/api/v1/layer/" + datasource, function(error, result){
 				return callback(error, result);
 			});
 		}
@@ -47,7 +47,7 @@ var API = new GoSpatialApiHandler({server:"test",apikey:"1234", id:"1"});
 				feature = JSON.stringify(feature);
 			}
 			this.POST(
-				this.server + '/api/v1/layer/' + datasource + '/feature?apikey=' + self.apikey,
+				this.server + '/api/v1/layer/' + datasource + '/feature',
 				feature,
 				function(error, result) {
 					callback(error, result);
@@ -62,7 +62,7 @@ var API = new GoSpatialApiHandler({server:"test",apikey:"1234", id:"1"});
 				feature = JSON.stringify(feature);
 			}
 			this.PUT(
-				this.server + '/api/v1/layer/' + datasource + '/feature/' + geo_id + '?apikey=' + self.apikey,
+				this.server + '/api/v1/layer/' + datasource + '/feature/' + geo_id,
 				feature,
 				function(error, result) {
 					callback(error, result);
@@ -85,6 +85,7 @@ var API = new GoSpatialApiHandler({server:"test",apikey:"1234", id:"1"});
 				crossDomain: true,
 				url: url,
 				type: type,
+				headers: {"X-API-Key": self.apikey},
 				dataType: opts.dataType || "json",
 				beforeSend: function() {
 					self.ajaxActive++;
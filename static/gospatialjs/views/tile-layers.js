@@ -33,7 +33,8 @@
 			function(isConfirm){
 				if (isConfirm) {
 					$.ajax({
-						url: '/api/v1/tilelayer?apikey=' + self.apikey,
+						url: '/api/v1/tilelayer',
+						headers: {"X-API-Key": self.apikey},
 						data: {
 							tilelayer_name: $("#tilelayer_name").val(),
 							tilelayer_url: $("#tilelayer_url").val()
@@ -28,7 +28,8 @@
 				"info",
 				function(){
 					$.ajax({
-						url: '/api/v1/layer?apikey=' + self.apikey,
+						url: '/api/v1/layer',
+						headers: {"X-API-Key": self.apikey},
 						type: 'POST',
 						success: function(result) {
 							new SwalPpSuccess("Created!", result);
@@ -89,7 +90,8 @@
 				"warning",
 				function(){
 					$.ajax({
-						url: '/api/v1/layer/'+ datasource_id +'?apikey=' + self.apikey,
+						url: '/api/v1/layer/'+ datasource_id,
+						headers: {"X-API-Key": self.apikey},
 						type: 'DELETE',
 						success: function(result) {
 							new SwalPpSuccess("Deleted!", result);
@@ -203,7 +205,7 @@
 							$(container).find(".raw-json").html(JSON.stringify(metadata, null, 2));
 							// download link for geojson file
 							var link = $(container).find("a");
-							link.href = makeGeoJSONFile(data);
+							link.attr("href", makeGeoJSONFile(JSON.stringify(data)));
 						});
 					}
 				}
@@ -250,7 +252,7 @@
 										'</div>' +
 										'<div class="col-md-1 column">' +
 											'<button class="btn btn-sm btn-info downloadLayer" title="view" ds_id=' + ds + '>' + 
-												'<a href="/api/v1/layer/'+ ds +'?apikey=' + self.apikey + '" download="' + ds + '.geojson">' +
+												'<a href="#" download="' + ds + '.geojson">' +
 													// '<i class="fa fa-cloud-download" aria-hidden="true"></i>' + 
 													'<i class="fa fa-download" aria-hidden="true"></i>' + 
 												'</a>' + 